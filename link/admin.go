@@ -0,0 +1,576 @@
+package link
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/GeneralElectric/TrueConnect-Link/trueconnect"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The operation recorded for each change made through the admin API, the prefix of admin addresses that are Unix
+// sockets and the error given to uploads cancelled through the API
+const (
+	adminOperation    = "Admin"
+	unixAddressPrefix = "unix:"
+	adminPathPrefix   = "/v1/"
+	errUploadCanceled = "the upload was cancelled through the admin API"
+)
+
+// targetState describes what the search of a target is doing
+type targetState struct {
+	Name           string     `json:"name"`
+	Location       string     `json:"location"`
+	Paused         bool       `json:"paused"`
+	Searching      bool       `json:"searching"`
+	SearchStarted  *time.Time `json:"search_started,omitempty"`
+	SearchFinished *time.Time `json:"search_finished,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	// when the search last looked at a file, a search that stops looking at files has stalled
+	progressed time.Time
+}
+
+// queuedFile is a found file waiting for an upload worker, or for the time it is tried again after a partial upload
+type queuedFile struct {
+	Record  string     `json:"record"`
+	Path    string     `json:"path"`
+	Target  string     `json:"target"`
+	Size    int64      `json:"size"`
+	Queued  time.Time  `json:"queued"`
+	RetryAt *time.Time `json:"retry_at,omitempty"`
+}
+
+// inFlightUpload is a file being uploaded, sent is updated as the file content is sent
+type inFlightUpload struct {
+	Record    string    `json:"record"`
+	Path      string    `json:"path"`
+	Target    string    `json:"target"`
+	Size      int64     `json:"size"`
+	Started   time.Time `json:"started"`
+	Sent      int64     `json:"sent"`
+	Percent   float64   `json:"percent"`
+	cancel    context.CancelFunc
+	cancelled bool
+	// when content was last sent as nanoseconds since the epoch, an upload that stops sending has stalled
+	progressed int64
+}
+
+// busyWorker is the file an upload worker is handling, a worker that stops making progress outside of an upload has
+// stalled
+type busyWorker struct {
+	record     string
+	path       string
+	progressed time.Time
+}
+
+// serviceControl holds what the admin API shows and changes about the running client. Its methods are safe to call on
+// a nil value, which never pauses and shows nothing
+type serviceControl struct {
+	mutex         sync.Mutex
+	paused        bool
+	pausedTargets map[string]bool
+	// closed and replaced when anything is resumed so that those waiting check again
+	resumed chan struct{}
+	scans   map[string]chan struct{}
+	targets map[string]*targetState
+	queue   map[string]*queuedFile
+	uploads map[string]*inFlightUpload
+	workers map[int]*busyWorker
+}
+
+func newServiceControl() *serviceControl {
+	return &serviceControl{
+		pausedTargets: make(map[string]bool),
+		resumed:       make(chan struct{}),
+		scans:         make(map[string]chan struct{}),
+		targets:       make(map[string]*targetState),
+		queue:         make(map[string]*queuedFile),
+		uploads:       make(map[string]*inFlightUpload),
+		workers:       make(map[int]*busyWorker),
+	}
+}
+
+// addTarget makes the target known to the API before its first search
+func (control *serviceControl) addTarget(target *Target) {
+	if control == nil {
+		return
+	}
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+	if _, exists := control.targets[target.Name]; !exists {
+		control.targets[target.Name] = &targetState{Name: target.Name, Location: target.Location}
+		control.scans[target.Name] = make(chan struct{}, 1)
+	}
+}
+
+// waitForTarget waits while the target is paused, false is returned when the client stops first
+func (control *serviceControl) waitForTarget(ctx context.Context, name string) bool {
+	return control.waitUntil(ctx, func() bool {
+		return !control.pausedTargets[name]
+	})
+}
+
+// waitForUploads waits while uploads are paused, false is returned when the client stops first
+func (control *serviceControl) waitForUploads(ctx context.Context) bool {
+	return control.waitUntil(ctx, func() bool {
+		return !control.paused
+	})
+}
+
+func (control *serviceControl) waitUntil(ctx context.Context, ready func() bool) bool {
+	if control == nil {
+		return ctx.Err() == nil
+	}
+	for {
+		control.mutex.Lock()
+		isReady := ready()
+		resumed := control.resumed
+		control.mutex.Unlock()
+		if isReady {
+			return ctx.Err() == nil
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-resumed:
+		}
+	}
+}
+
+// setPaused pauses or resumes all uploads, or the search of a target when one is named. False is returned when the
+// target is not known
+func (control *serviceControl) setPaused(target string, paused bool) bool {
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+	if target == "" {
+		control.paused = paused
+	} else {
+		state, exists := control.targets[target]
+		if !exists {
+			return false
+		}
+		state.Paused = paused
+		control.pausedTargets[target] = paused
+	}
+	if !paused {
+		close(control.resumed)
+		control.resumed = make(chan struct{})
+	}
+	return true
+}
+
+// scanRequested gives the channel that is sent to when an immediate search of the target is asked for
+func (control *serviceControl) scanRequested(name string) <-chan struct{} {
+	if control == nil {
+		return nil
+	}
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+	return control.scans[name]
+}
+
+// requestScan asks for the target to be searched now rather than at the end of its poll interval, false is returned
+// when the target is not known
+func (control *serviceControl) requestScan(name string) bool {
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+	scan, exists := control.scans[name]
+	if !exists {
+		return false
+	}
+	select {
+	case scan <- struct{}{}:
+	default:
+		// a search has already been asked for
+	}
+	return true
+}
+
+func (control *serviceControl) searchStarted(name string) {
+	if control == nil {
+		return
+	}
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+	if state, exists := control.targets[name]; exists {
+		now := time.Now().UTC()
+		state.Searching = true
+		state.SearchStarted = &now
+		state.progressed = now
+	}
+}
+
+// searchProgressed records that the search of the target has looked at another file
+func (control *serviceControl) searchProgressed(name string) {
+	if control == nil {
+		return
+	}
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+	if state, exists := control.targets[name]; exists {
+		state.progressed = time.Now().UTC()
+	}
+}
+
+func (control *serviceControl) searchFinished(name string, err error) {
+	if control == nil {
+		return
+	}
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+	if state, exists := control.targets[name]; exists {
+		now := time.Now().UTC()
+		state.Searching = false
+		state.SearchFinished = &now
+		state.LastError = ""
+		if err != nil {
+			state.LastError = err.Error()
+		}
+	}
+}
+
+// enqueue records that the found file is waiting for an upload worker, retryAt is set when it waits to be tried again
+func (control *serviceControl) enqueue(record string, found foundFile, retryAt *time.Time) {
+	if control == nil {
+		return
+	}
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+	control.queue[record] = &queuedFile{Record: record, Path: found.uri, Target: found.target.Name, Size: found.size,
+		Queued: time.Now().UTC(), RetryAt: retryAt}
+}
+
+func (control *serviceControl) dequeue(record string) {
+	if control == nil {
+		return
+	}
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+	delete(control.queue, record)
+}
+
+// workerBusy records that the upload worker has moved on to another step in handling the file with the record, which
+// may not be known yet
+func (control *serviceControl) workerBusy(worker int, record string, path string) {
+	if control == nil {
+		return
+	}
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+	control.workers[worker] = &busyWorker{record: record, path: path, progressed: time.Now()}
+}
+
+// workerIdle records that the upload worker has finished handling its file
+func (control *serviceControl) workerIdle(worker int) {
+	if control == nil {
+		return
+	}
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+	delete(control.workers, worker)
+}
+
+// startUpload records the upload of the found file, the context it gives is used for the upload so that it can be
+// cancelled. finished is called once the upload ends and returns true when it was cancelled
+func (control *serviceControl) startUpload(ctx context.Context, record string, found foundFile) (context.Context, func() bool) {
+	if control == nil {
+		return ctx, func() bool { return false }
+	}
+	uploadContext, cancel := context.WithCancel(ctx)
+	upload := &inFlightUpload{Record: record, Path: found.uri, Target: found.target.Name, Size: found.size,
+		Started: time.Now().UTC(), Sent: bytesUploaded(found.progress, found.size), cancel: cancel, progressed: time.Now().UnixNano()}
+	control.mutex.Lock()
+	control.uploads[record] = upload
+	control.mutex.Unlock()
+
+	uploadContext = trueconnect.WithProgress(uploadContext, func(sent int64) {
+		atomic.AddInt64(&upload.Sent, sent)
+		atomic.StoreInt64(&upload.progressed, time.Now().UnixNano())
+	})
+	return uploadContext, func() bool {
+		control.mutex.Lock()
+		defer control.mutex.Unlock()
+		delete(control.uploads, record)
+		cancel()
+		return upload.cancelled
+	}
+}
+
+// cancelUpload cancels the uploads of the file with the path or record, giving the number cancelled
+func (control *serviceControl) cancelUpload(pathOrRecord string) int {
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+	cancelled := 0
+	for record, upload := range control.uploads {
+		if record == pathOrRecord || upload.Path == pathOrRecord {
+			upload.cancelled = true
+			upload.cancel()
+			cancelled++
+		}
+	}
+	return cancelled
+}
+
+// snapshot gives copies of the target states, the queue and the uploads in flight in a stable order
+func (control *serviceControl) snapshot() ([]targetState, []queuedFile, []inFlightUpload) {
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+	targets := make([]targetState, 0, len(control.targets))
+	for _, state := range control.targets {
+		targets = append(targets, *state)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Name < targets[j].Name })
+	queue := make([]queuedFile, 0, len(control.queue))
+	for _, queued := range control.queue {
+		queue = append(queue, *queued)
+	}
+	sort.Slice(queue, func(i, j int) bool { return queue[i].Queued.Before(queue[j].Queued) })
+	uploads := make([]inFlightUpload, 0, len(control.uploads))
+	for _, upload := range control.uploads {
+		copied := inFlightUpload{Record: upload.Record, Path: upload.Path, Target: upload.Target, Size: upload.Size,
+			Started: upload.Started, Sent: atomic.LoadInt64(&upload.Sent)}
+		if copied.Size > 0 {
+			copied.Percent = float64(copied.Sent) * 100 / float64(copied.Size)
+		}
+		uploads = append(uploads, copied)
+	}
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].Started.Before(uploads[j].Started) })
+	return targets, queue, uploads
+}
+
+func (config *AdminConfig) validate() error {
+	if config.Token == "" {
+		return fmt.Errorf("the admin API needs a token")
+	}
+	if strings.HasPrefix(config.Address, unixAddressPrefix) {
+		if len(config.Address) == len(unixAddressPrefix) {
+			return fmt.Errorf("the admin API needs the path of its socket")
+		}
+		return nil
+	}
+	host, _, err := net.SplitHostPort(config.Address)
+	if err != nil {
+		return fmt.Errorf("invalid admin API address %q: %v", config.Address, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("the admin API address %q is not a loopback address or a Unix socket", config.Address)
+	}
+	return nil
+}
+
+// listenAdmin opens the socket the admin API is served on, a Unix socket is only usable by the user running the client
+func listenAdmin(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, unixAddressPrefix) {
+		return net.Listen("tcp", address)
+	}
+	path := address[len(unixAddressPrefix):]
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("the admin API socket %s already exists and is not a socket", path)
+		}
+		// a socket left by a client that did not stop cleanly
+		os.Remove(path)
+	}
+	return listenPrivateUnix(path)
+}
+
+// serveAdmin starts the admin API when it is configured, it is stopped by stopAdmin
+func (linkClient *linkClient) serveAdmin() {
+	config := linkClient.configuration.Admin
+	if config == nil || config.Address == "" {
+		return
+	}
+	listener, err := listenAdmin(config.Address)
+	if err != nil {
+		linkClient.statusRecorder.recordStatus(systemName, adminOperation, failedStatus, "", err.Error())
+		return
+	}
+	linkClient.adminListener = listener
+	go http.Serve(listener, linkClient.adminHandler(config.Token))
+	linkClient.statusRecorder.recordStatus(systemName, adminOperation, startedStatus, "", listener.Addr().String())
+}
+
+// stopAdmin closes the admin API, it is safe to call when it was not started
+func (linkClient *linkClient) stopAdmin() {
+	if linkClient.adminListener != nil {
+		linkClient.adminListener.Close()
+		linkClient.adminListener = nil
+	}
+}
+
+// adminHandler serves the admin API, each request must carry the token as a bearer token
+func (linkClient *linkClient) adminHandler(token string) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		authorization := request.Header.Get("Authorization")
+		given := strings.TrimPrefix(authorization, "Bearer ")
+		if given == authorization || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeAdminResponse(writer, http.StatusUnauthorized, map[string]string{"error": "a valid bearer token is needed"})
+			return
+		}
+		status, response := linkClient.handleAdmin(request)
+		writeAdminResponse(writer, status, response)
+	})
+}
+
+func writeAdminResponse(writer http.ResponseWriter, status int, response interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(response)
+}
+
+// handleAdmin carries out an admin request, giving the HTTP status and the response
+func (linkClient *linkClient) handleAdmin(request *http.Request) (int, interface{}) {
+	control := linkClient.control
+	if control == nil || !strings.HasPrefix(request.URL.Path, adminPathPrefix) {
+		return http.StatusNotFound, map[string]string{"error": "not found"}
+	}
+	parts := strings.Split(strings.Trim(request.URL.Path[len(adminPathPrefix):], "/"), "/")
+	if request.Method == http.MethodGet {
+		targets, queue, uploads := control.snapshot()
+		switch parts[0] {
+		case "targets":
+			return http.StatusOK, targets
+		case "uploads":
+			return http.StatusOK, map[string]interface{}{"paused": control.isPaused(), "queued": queue, "inflight": uploads}
+		case "deadletters":
+			return linkClient.adminDeadLetters(request, false)
+		}
+		return http.StatusNotFound, map[string]string{"error": "not found"}
+	}
+	if request.Method != http.MethodPost {
+		return http.StatusMethodNotAllowed, map[string]string{"error": "use GET to read and POST to make changes"}
+	}
+
+	action := parts[len(parts)-1]
+	switch {
+	case len(parts) == 1 && (action == "pause" || action == "resume"):
+		control.setPaused("", action == "pause")
+		linkClient.recordAdmin(request, action, "all uploads")
+		return http.StatusOK, map[string]bool{"paused": action == "pause"}
+	case len(parts) == 3 && parts[0] == "targets" && (action == "pause" || action == "resume" || action == "scan"):
+		name := parts[1]
+		var known bool
+		if action == "scan" {
+			known = control.requestScan(name)
+		} else {
+			known = control.setPaused(name, action == "pause")
+		}
+		if !known {
+			return http.StatusNotFound, map[string]string{"error": "no target named " + name}
+		}
+		linkClient.recordAdmin(request, action, name)
+		return http.StatusOK, map[string]string{"target": name, "action": action}
+	case len(parts) == 2 && parts[0] == "uploads" && action == "cancel":
+		file := request.URL.Query().Get("path")
+		if file == "" {
+			file = request.URL.Query().Get("record")
+		}
+		cancelled := control.cancelUpload(file)
+		if cancelled == 0 {
+			return http.StatusNotFound, map[string]string{"error": "no upload in flight for " + file}
+		}
+		linkClient.recordAdmin(request, action, file)
+		return http.StatusOK, map[string]int{"cancelled": cancelled}
+	case len(parts) == 2 && parts[0] == "deadletters" && action == "release":
+		return linkClient.adminDeadLetters(request, true)
+	}
+	return http.StatusNotFound, map[string]string{"error": "not found"}
+}
+
+// stalled describes the searches, uploads and upload workers that have made no progress for the time given. A search
+// waiting for an upload worker to take the file it found has not stalled, the workers are checked instead
+func (control *serviceControl) stalled(after time.Duration) []string {
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+	// a search blocked handing over a file is waiting for a worker rather than stalled, files waiting to be tried again
+	// are not handed over by the search
+	waiting := make(map[string]bool)
+	for _, queued := range control.queue {
+		if queued.RetryAt == nil {
+			waiting[queued.Target] = true
+		}
+	}
+	var stalled []string
+	for _, state := range control.targets {
+		if state.Searching && !waiting[state.Name] && time.Since(state.progressed) > after {
+			stalled = append(stalled, "the search of "+state.Name)
+		}
+	}
+	for _, upload := range control.uploads {
+		if time.Since(time.Unix(0, atomic.LoadInt64(&upload.progressed))) > after {
+			stalled = append(stalled, "the upload of "+upload.Path)
+		}
+	}
+	// the progress of a worker uploading its file is that of the upload
+	for _, worker := range control.workers {
+		if _, uploading := control.uploads[worker.record]; !uploading && time.Since(worker.progressed) > after {
+			stalled = append(stalled, "the worker handling "+worker.path)
+		}
+	}
+	sort.Strings(stalled)
+	return stalled
+}
+
+// pending gives the number of files waiting for an upload worker or being uploaded
+func (control *serviceControl) pending() int {
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+	return len(control.queue) + len(control.uploads)
+}
+
+func (control *serviceControl) isPaused() bool {
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+	return control.paused
+}
+
+// adminDeadLetters lists or releases the abandoned files chosen by the query parameters path, pattern, t, since, until
+// and all, which work like the command line arguments of the DeadLetters and Requeue commands
+func (linkClient *linkClient) adminDeadLetters(request *http.Request, release bool) (int, interface{}) {
+	var selector commandSelector
+	query := request.URL.Query()
+	for _, name := range []string{"path", "pattern", "t", "since", "until"} {
+		for _, value := range query[name] {
+			selector.parseArg("-" + name + ":" + value)
+		}
+	}
+	if query.Get("all") == "true" {
+		selector.parseArg("-all")
+	}
+	if release && selector.isEmpty() {
+		return http.StatusBadRequest, map[string]string{"error": "choose the files to release with path, pattern, t, since or until, or use all=true"}
+	}
+	matches, err := selector.matcher()
+	if err != nil {
+		return http.StatusBadRequest, map[string]string{"error": err.Error()}
+	}
+	letters, err := linkClient.fileTransferRecorder.deadLetters(matches)
+	if err != nil {
+		return http.StatusInternalServerError, map[string]string{"error": err.Error()}
+	}
+	var files []failureRecord
+	for _, letter := range letters {
+		if release {
+			if err := linkClient.requeueLetter(letter); err != nil {
+				return http.StatusInternalServerError, map[string]string{"error": letter.failure.Path + ": " + err.Error()}
+			}
+			linkClient.recordAdmin(request, "release", letter.failure.Path)
+		}
+		files = append(files, letter.failure)
+	}
+	return http.StatusOK, files
+}
+
+// recordAdmin records a change made through the admin API and where it was asked for from
+func (linkClient *linkClient) recordAdmin(request *http.Request, action string, subject string) {
+	linkClient.statusRecorder.recordStatus(systemName, adminOperation, strings.Title(action), "",
+		subject+" by "+request.RemoteAddr)
+}
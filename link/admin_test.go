@@ -0,0 +1,209 @@
+package link
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminRequest(tests *testing.T, handler http.Handler, method string, path string, token string, response interface{}) int {
+	request := httptest.NewRequest(method, path, nil)
+	if strings.Contains(token, " ") {
+		request.Header.Set("Authorization", token)
+	} else if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if response != nil {
+		err := json.Unmarshal(recorder.Body.Bytes(), response)
+		if err != nil {
+			tests.Fatal(err, recorder.Body.String())
+		}
+	}
+	return recorder.Code
+}
+
+func TestAdminAPI(tests *testing.T) {
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+	client := linkClient{currentContext: currentContext, statusRecorder: createStatusRecorder(currentContext),
+		fileTransferRecorder: createFileTransferRecorder(), control: newServiceControl()}
+	handler := client.adminHandler("secret")
+	target := Target{Name: "t1", Location: "/in"}
+	client.control.addTarget(&target)
+
+	if code := adminRequest(tests, handler, http.MethodGet, "/v1/targets", "wrong", nil); code != http.StatusUnauthorized {
+		tests.Fatal("request with the wrong token allowed ", code)
+	}
+	for _, authorization := range []string{"secret ", "Basic secret", "Bearer  secret"} {
+		if code := adminRequest(tests, handler, http.MethodGet, "/v1/targets", authorization, nil); code != http.StatusUnauthorized {
+			tests.Fatal("request without a bearer token allowed ", authorization, code)
+		}
+	}
+	var targets []targetState
+	if code := adminRequest(tests, handler, http.MethodGet, "/v1/targets", "secret", &targets); code != http.StatusOK ||
+		len(targets) != 1 || targets[0].Name != "t1" || targets[0].Paused {
+		tests.Fatal("targets not listed ", code, targets)
+	}
+
+	// a paused target is not searched until it is resumed
+	adminRequest(tests, handler, http.MethodPost, "/v1/targets/t1/pause", "secret", nil)
+	waited := make(chan bool)
+	go func() {
+		waited <- client.control.waitForTarget(currentContext, "t1")
+	}()
+	select {
+	case <-waited:
+		tests.Fatal("paused target searched")
+	case <-time.After(50 * time.Millisecond):
+	}
+	adminRequest(tests, handler, http.MethodPost, "/v1/targets/t1/resume", "secret", nil)
+	select {
+	case resumed := <-waited:
+		if !resumed {
+			tests.Fatal("target not resumed")
+		}
+	case <-time.After(time.Second):
+		tests.Fatal("resumed target still waiting")
+	}
+	if code := adminRequest(tests, handler, http.MethodPost, "/v1/targets/t2/pause", "secret", nil); code != http.StatusNotFound {
+		tests.Fatal("unknown target paused ", code)
+	}
+
+	adminRequest(tests, handler, http.MethodPost, "/v1/targets/t1/scan", "secret", nil)
+	select {
+	case <-client.control.scanRequested("t1"):
+	default:
+		tests.Fatal("scan not requested")
+	}
+
+	// uploads in flight are listed with their progress and can be cancelled
+	found := foundFile{uri: "/in/a.zip", size: 200, target: &target}
+	client.control.enqueue("uid2", foundFile{uri: "/in/b.zip", target: &target}, nil)
+	uploadContext, finished := client.control.startUpload(currentContext, "uid1", found)
+	var uploads struct {
+		Paused   bool             `json:"paused"`
+		Queued   []queuedFile     `json:"queued"`
+		InFlight []inFlightUpload `json:"inflight"`
+	}
+	adminRequest(tests, handler, http.MethodGet, "/v1/uploads", "secret", &uploads)
+	if len(uploads.Queued) != 1 || uploads.Queued[0].Path != "/in/b.zip" || len(uploads.InFlight) != 1 || uploads.InFlight[0].Path != "/in/a.zip" {
+		tests.Fatal("uploads not listed ", uploads)
+	}
+	if code := adminRequest(tests, handler, http.MethodPost, "/v1/uploads/cancel?path=/in/a.zip", "secret", nil); code != http.StatusOK {
+		tests.Fatal("upload not cancelled ", code)
+	}
+	if uploadContext.Err() == nil || !finished() {
+		tests.Fatal("the upload context was not cancelled")
+	}
+	if code := adminRequest(tests, handler, http.MethodPost, "/v1/uploads/cancel?path=/in/a.zip", "secret", nil); code != http.StatusNotFound {
+		tests.Fatal("finished upload cancelled ", code)
+	}
+
+	adminRequest(tests, handler, http.MethodPost, "/v1/pause", "secret", nil)
+	adminRequest(tests, handler, http.MethodGet, "/v1/uploads", "secret", &uploads)
+	if !uploads.Paused {
+		tests.Fatal("uploads not paused")
+	}
+	adminRequest(tests, handler, http.MethodPost, "/v1/resume", "secret", nil)
+	if !client.control.waitForUploads(currentContext) {
+		tests.Fatal("uploads not resumed")
+	}
+}
+
+func TestAdminReleaseDeadLetters(tests *testing.T) {
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+	client := linkClient{currentContext: currentContext, statusRecorder: createStatusRecorder(currentContext),
+		fileTransferRecorder: createFileTransferRecorder(), control: newServiceControl()}
+	handler := client.adminHandler("secret")
+	target := Target{Name: "t1", MaxAttempts: 1}
+	client.recordFailure(foundFile{uri: "/in/a.zip", target: &target}, "uid1", errors.New("rejected"))
+	client.recordFailure(foundFile{uri: "/in/b.zip", target: &target}, "uid2", errors.New("rejected"))
+
+	var letters []failureRecord
+	adminRequest(tests, handler, http.MethodGet, "/v1/deadletters", "secret", &letters)
+	if len(letters) != 2 {
+		tests.Fatal("abandoned files not listed ", letters)
+	}
+	if code := adminRequest(tests, handler, http.MethodPost, "/v1/deadletters/release", "secret", nil); code != http.StatusBadRequest {
+		tests.Fatal("release without a selection allowed ", code)
+	}
+	adminRequest(tests, handler, http.MethodPost, "/v1/deadletters/release?path=/in/a.zip", "secret", &letters)
+	if len(letters) != 1 || client.fileTransferRecorder.isAbandoned("uid1") || !client.fileTransferRecorder.isAbandoned("uid2") {
+		tests.Fatal("abandoned file not released ", letters)
+	}
+}
+
+func TestValidateAdmin(tests *testing.T) {
+	for _, config := range []AdminConfig{
+		{Address: "127.0.0.1:9181"},
+		{Address: "0.0.0.0:9181", Token: "t"},
+		{Address: "example.com:9181", Token: "t"},
+		{Address: "unix:", Token: "t"},
+		{Address: "9181", Token: "t"},
+	} {
+		if config.validate() == nil {
+			tests.Fatal("invalid admin API accepted ", config)
+		}
+	}
+	for _, config := range []AdminConfig{
+		{Address: "127.0.0.1:9181", Token: "t"},
+		{Address: "[::1]:9181", Token: "t"},
+		{Address: "localhost:9181", Token: "t"},
+		{Address: "unix:/run/link/admin.sock", Token: "t"},
+	} {
+		if err := config.validate(); err != nil {
+			tests.Fatal(err)
+		}
+	}
+}
+
+func TestListenAdminSocket(tests *testing.T) {
+	if runtime.GOOS == "windows" {
+		tests.Skip("Unix socket permissions are not used on Windows")
+	}
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a file at a mistyped path is never removed
+	path := filepath.Join(dir, "client.json")
+	ioutil.WriteFile(path, []byte("{}"), 0600)
+	if _, err := listenAdmin("unix:" + path); err == nil {
+		tests.Fatal("admin API started over a regular file")
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "{}" {
+		tests.Fatal("regular file replaced")
+	}
+
+	path = filepath.Join(dir, "admin.sock")
+	listener, err := listenAdmin("unix:" + path)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	listener.(interface{ SetUnlinkOnClose(bool) }).SetUnlinkOnClose(false)
+	listener.Close()
+	// the socket left by a client that did not stop cleanly is replaced
+	listener, err = listenAdmin("unix:" + path)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	defer listener.Close()
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		tests.Fatal("socket usable by other users ", info.Mode(), err)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package link
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenPrivateUnix listens on a Unix socket that is created with permission for the user running the client alone, the
+// umask is only changed while the socket is created as the admin API is started before any upload
+func listenPrivateUnix(path string) (net.Listener, error) {
+	previous := syscall.Umask(0177)
+	defer syscall.Umask(previous)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package link
+
+import "net"
+
+// listenPrivateUnix listens on a Unix socket, on Windows who can use it is decided by the permissions of its directory
+func listenPrivateUnix(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,177 @@
+package link
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/GeneralElectric/TrueConnect-Link/trueconnect"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"time"
+)
+
+const maxReportedRecords = 20
+
+// checkState validates the status log and the state file, a state file that cannot be used is moved aside and rebuilt
+// from the status log and entries that cannot be read are removed from it
+func (linkClient *linkClient) checkState() string {
+	var buffer bytes.Buffer
+	statusFileName := linkClient.configuration.ClientID + ".recordStatus"
+	stateFileName := linkClient.configuration.ClientID + ".state"
+
+	entries := 0
+	badRecords, err := readStatusLog(statusFileName, func(StatusRecordEntry) bool {
+		entries++
+		return true
+	})
+	if err != nil && !os.IsNotExist(err) {
+		buffer.WriteString("ERROR: could not read the status log " + statusFileName + ": " + err.Error() + "\n")
+		linkClient.exitCode = 1
+		return buffer.String()
+	}
+	if len(badRecords) == 0 {
+		buffer.WriteString(fmt.Sprintf("OK: %d entries read from the status log %s\n", entries, statusFileName))
+	} else {
+		buffer.WriteString(fmt.Sprintf("WARNING: %d entries read from the status log %s, %d records could not be read and are skipped%s\n",
+			entries, statusFileName, len(badRecords), recordNumbers(badRecords)))
+	}
+
+	problems, removed, err := checkStateFile(stateFileName)
+	if err != nil {
+		buffer.WriteString("ERROR: could not check the state file " + stateFileName + ": " + err.Error() + "\n")
+		linkClient.exitCode = 1
+		return buffer.String()
+	}
+	if removed > 0 {
+		buffer.WriteString(fmt.Sprintf("REPAIRED: removed %d entries that could not be read from the state file %s\n", removed, stateFileName))
+		linkClient.statusRecorder.recordStatus(systemName, checkStateOperation, repairedStatus, "", fmt.Sprintf("removed %d entries", removed))
+	}
+	if len(problems) == 0 {
+		buffer.WriteString("OK: the state file " + stateFileName + " is valid\n")
+		return buffer.String()
+	}
+
+	for _, problem := range problems {
+		buffer.WriteString("ERROR: " + problem + "\n")
+	}
+	if _, err = os.Stat(stateFileName); err == nil {
+		damaged := stateFileName + ".damaged." + time.Now().UTC().Format(segmentTimeLayout)
+		err = os.Rename(stateFileName, damaged)
+		if err != nil {
+			buffer.WriteString("ERROR: could not move the state file aside: " + err.Error() + "\n")
+			linkClient.exitCode = 1
+			return buffer.String()
+		}
+		buffer.WriteString("REPAIRED: moved the state file to " + damaged + "\n")
+	}
+	recorder, err := openFileTransferRecorder(stateFileName, statusFileName)
+	if err != nil {
+		buffer.WriteString("ERROR: could not rebuild the state file: " + err.Error() + "\n")
+		linkClient.exitCode = 1
+		return buffer.String()
+	}
+	recorder.close()
+	buffer.WriteString("REPAIRED: rebuilt the state file " + stateFileName + " from the status log\n")
+	linkClient.statusRecorder.recordStatus(systemName, checkStateOperation, repairedStatus, "", "rebuilt from the status log")
+	return buffer.String()
+}
+
+// checkStateFile checks the state file can be opened and that its pages are consistent, entries that cannot be read
+// are removed. The problems returned mean the file must be rebuilt
+func checkStateFile(fileName string) (problems []string, removed int, err error) {
+	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		return []string{"the state file " + fileName + " does not exist"}, 0, nil
+	}
+
+	defer func() {
+		// bolt panics on some damaged files rather than returning an error
+		if recovered := recover(); recovered != nil {
+			problems = append(problems, fmt.Sprintf("the state file %s is damaged: %v", fileName, recovered))
+		}
+	}()
+
+	db, err := bolt.Open(fileName, 0600, &bolt.Options{Timeout: stateStoreOpenTimeout})
+	if err == bolt.ErrTimeout {
+		return nil, 0, fmt.Errorf("the state file is in use, stop the client before checking it")
+	}
+	if err != nil {
+		return []string{"the state file " + fileName + " cannot be opened: " + err.Error()}, 0, nil
+	}
+	defer db.Close()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		for checkErr := range tx.Check() {
+			problems = append(problems, "the state file "+fileName+" is damaged: "+checkErr.Error())
+		}
+		for _, bucket := range [][]byte{progressBucket, versionsBucket, metaBucket} {
+			if tx.Bucket(bucket) == nil {
+				problems = append(problems, "the state file "+fileName+" has no "+string(bucket)+" bucket")
+			}
+		}
+		return nil
+	})
+	if err != nil || len(problems) > 0 {
+		return problems, 0, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		var invalid [][]byte
+		tx.Bucket(progressBucket).ForEach(func(key []byte, data []byte) error {
+			var progress trueconnect.UploadProgress
+			if json.Unmarshal(data, &progress) != nil {
+				invalid = append(invalid, key)
+			}
+			return nil
+		})
+		for _, key := range invalid {
+			if err := tx.Bucket(progressBucket).Delete(key); err != nil {
+				return err
+			}
+		}
+		removed += len(invalid)
+
+		invalid = nil
+		tx.Bucket(versionsBucket).ForEach(func(key []byte, data []byte) error {
+			var version fileVersion
+			if json.Unmarshal(data, &version) != nil || version.Path != string(key) {
+				invalid = append(invalid, key)
+			}
+			return nil
+		})
+		for _, key := range invalid {
+			if err := tx.Bucket(versionsBucket).Delete(key); err != nil {
+				return err
+			}
+		}
+		removed += len(invalid)
+
+		// state files written before files could be abandoned have no failures bucket
+		failures, err := tx.CreateBucketIfNotExists(failuresBucket)
+		if err != nil {
+			return err
+		}
+		invalid = nil
+		failures.ForEach(func(key []byte, data []byte) error {
+			var failure failureRecord
+			if json.Unmarshal(data, &failure) != nil {
+				invalid = append(invalid, key)
+			}
+			return nil
+		})
+		for _, key := range invalid {
+			if err := failures.Delete(key); err != nil {
+				return err
+			}
+		}
+		removed += len(invalid)
+		return nil
+	})
+	return problems, removed, err
+}
+
+func recordNumbers(records []int) string {
+	if len(records) > maxReportedRecords {
+		return fmt.Sprintf(" (records %v...)", records[:maxReportedRecords])
+	}
+	return fmt.Sprintf(" (records %v)", records)
+}
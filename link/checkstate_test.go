@@ -0,0 +1,53 @@
+package link
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckStateRebuildsDamagedFile(tests *testing.T) {
+	defer os.Remove("TestCheckState.recordStatus")
+	defer os.Remove("TestCheckState.state")
+	statusLog := "2018-01-02T15:04:05Z,TrueConnect-Link,FileUpload,Success,abc~/in/a.zip,ref1\n" +
+		"2018-01-02T15:04:06Z,TrueConnect-Link,FileUp\n"
+	if err := ioutil.WriteFile("TestCheckState.recordStatus", []byte(statusLog), 0600); err != nil {
+		tests.Fatal(err)
+	}
+	if err := ioutil.WriteFile("TestCheckState.state", []byte("this is not a bolt database"), 0600); err != nil {
+		tests.Fatal(err)
+	}
+
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+	client := linkClient{currentContext: currentContext, statusRecorder: createStatusRecorder(currentContext)}
+	client.configuration.ClientID = "TestCheckState"
+	report := client.checkState()
+	if !strings.Contains(report, "1 records could not be read") || !strings.Contains(report, "REPAIRED: rebuilt the state file") {
+		tests.Fatal("unexpected report ", report)
+	}
+	damaged, _ := filepath.Glob("TestCheckState.state.damaged.*")
+	for _, file := range damaged {
+		os.Remove(file)
+	}
+	if len(damaged) != 1 {
+		tests.Fatal("damaged state file not kept")
+	}
+
+	recorder, err := openFileTransferRecorder("TestCheckState.state", "TestCheckState.recordStatus")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	progress, exists := recorder.store.progress("abc~/in/a.zip")
+	recorder.close()
+	if !exists || progress.Reference != "ref1" {
+		tests.Fatal("state not rebuilt from the status log")
+	}
+
+	if report = client.checkState(); !strings.Contains(report, "OK: the state file") {
+		tests.Fatal("rebuilt state file not valid ", report)
+	}
+}
@@ -0,0 +1,413 @@
+package link
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// The operation recorded when the configuration file is changed, what secrets are shown as and the schema a new
+// configuration file refers to
+const (
+	setConfigOperation = "SetConfig"
+	changedStatus      = "Changed"
+	redacted           = "********"
+	configSchemaURL    = "https://raw.githubusercontent.com/GeneralElectric/TrueConnect-Link/master/docs/LinkConfigurationSchema.json#"
+)
+
+// configSetting is a setting given on the command line as -set:<key>=<value>
+type configSetting struct {
+	key   string
+	value string
+}
+
+// configEdits holds the command line arguments describing the changes SetConfig makes to the configuration file
+type configEdits struct {
+	set     []configSetting
+	unset   []string
+	add     bool
+	remove  bool
+	enable  bool
+	disable bool
+}
+
+// parseArg reads a command line argument changing the configuration
+func (edits *configEdits) parseArg(arg string) {
+	switch {
+	case strings.HasPrefix(arg, "-set:"):
+		setting := arg[5:]
+		index := strings.Index(setting, "=")
+		if index < 0 {
+			edits.set = append(edits.set, configSetting{key: setting})
+		} else {
+			edits.set = append(edits.set, configSetting{key: setting[:index], value: setting[index+1:]})
+		}
+	case strings.HasPrefix(arg, "-unset:"):
+		edits.unset = append(edits.unset, arg[7:])
+	case arg == "-add":
+		edits.add = true
+	case arg == "-remove":
+		edits.remove = true
+	case arg == "-enable":
+		edits.enable = true
+	case arg == "-disable":
+		edits.disable = true
+	}
+}
+
+func (edits configEdits) isEmpty() bool {
+	return len(edits.set) == 0 && len(edits.unset) == 0 && !edits.add && !edits.remove && !edits.enable && !edits.disable
+}
+
+// conflict returns an error when the arguments ask for changes that contradict each other
+func (edits configEdits) conflict() error {
+	switch {
+	case edits.enable && edits.disable:
+		return fmt.Errorf("give either -enable or -disable, not both")
+	case edits.add && edits.remove:
+		return fmt.Errorf("give either -add or -remove, not both")
+	case edits.remove && (edits.enable || edits.disable || len(edits.set) > 0 || len(edits.unset) > 0):
+		return fmt.Errorf("a target that is removed cannot also be changed")
+	}
+	return nil
+}
+
+// redactSecrets replaces the secrets in the configuration so that it can be shown
+func (configuration Configuration) redactSecrets() Configuration {
+	if configuration.Secret != "" {
+		configuration.Secret = redacted
+	}
+	if configuration.Admin != nil {
+		admin := *configuration.Admin
+		admin.Token = redacted
+		configuration.Admin = &admin
+	}
+	webhooks := make([]WebhookConfig, len(configuration.Webhooks))
+	for index, webhook := range configuration.Webhooks {
+		if webhook.Secret != "" {
+			webhook.Secret = redacted
+		}
+		if len(webhook.Headers) > 0 {
+			headers := make(map[string]string)
+			for name := range webhook.Headers {
+				headers[name] = redacted
+			}
+			webhook.Headers = headers
+		}
+		webhooks[index] = webhook
+	}
+	if configuration.Webhooks != nil {
+		configuration.Webhooks = webhooks
+	}
+	return configuration
+}
+
+// getConfig gives the configuration loaded from <user>.json as JSON with its secrets redacted, or only the targets
+// named on the command line
+func (linkClient *linkClient) getConfig() string {
+	var names []string
+	for _, target := range linkClient.configuration.Targets {
+		names = append(names, target.Name)
+	}
+	err := linkClient.loadConfig(linkClient.configuration.ClientID + ".json")
+	if err != nil {
+		linkClient.exitCode = 1
+		return err.Error()
+	}
+	var shown interface{} = linkClient.configuration.redactSecrets()
+	if len(names) > 0 {
+		var targets []Target
+		for _, name := range names {
+			target, found := linkClient.configuration.target(name)
+			if !found {
+				linkClient.exitCode = 1
+				return "no target named " + name
+			}
+			targets = append(targets, target)
+		}
+		shown = targets
+	}
+	data, err := json.MarshalIndent(shown, "", "  ")
+	if err != nil {
+		linkClient.exitCode = 1
+		return err.Error()
+	}
+	return string(data) + "\n"
+}
+
+func (configuration *Configuration) target(name string) (Target, bool) {
+	for _, target := range configuration.Targets {
+		if target.Name == name {
+			return target, true
+		}
+	}
+	return Target{}, false
+}
+
+// setConfig changes the configuration file as described by the command line arguments. The changes are made to the
+// targets named on the command line or to the global settings when none are named, the result is checked in the same
+// way as when the client starts before the file is replaced. Settings the client does not know are left as they are
+func (linkClient *linkClient) setConfig() string {
+	edits := linkClient.configuration.edits
+	if edits.isEmpty() {
+		linkClient.exitCode = 1
+		return "give the changes to make with -set:<key>=<value>, -unset:<key>, -add, -remove, -enable or -disable"
+	}
+	if err := edits.conflict(); err != nil {
+		linkClient.exitCode = 1
+		return err.Error()
+	}
+	var names []string
+	for _, target := range linkClient.configuration.Targets {
+		names = append(names, target.Name)
+	}
+	if len(names) == 0 && (edits.add || edits.remove || edits.enable || edits.disable) {
+		linkClient.exitCode = 1
+		return "name the targets to add, remove, enable or disable with -t:<Target>"
+	}
+
+	fileName := linkClient.configuration.ClientID + ".json"
+	document, err := readConfigDocument(fileName, linkClient.configuration.ClientID)
+	if err != nil {
+		linkClient.exitCode = 1
+		return err.Error()
+	}
+	changes, err := applyConfigEdits(document, names, edits)
+	if err != nil {
+		linkClient.exitCode = 1
+		return err.Error()
+	}
+
+	data, err := json.MarshalIndent(document, "", "  ")
+	if err == nil {
+		var configuration Configuration
+		err = json.Unmarshal(data, &configuration)
+		if err == nil {
+			err = configuration.compile()
+		}
+	}
+	if err != nil {
+		linkClient.exitCode = 1
+		return "the configuration was not changed: " + err.Error()
+	}
+	err = replaceFile(fileName, append(data, '\n'))
+	if err != nil {
+		linkClient.exitCode = 1
+		return err.Error()
+	}
+	linkClient.statusRecorder.recordStatus(systemName, setConfigOperation, changedStatus, "",
+		strings.Join(changes, "; ")+" by "+operator())
+	return strings.Join(changes, "\n") + "\nsaved " + fileName + ", the changes are used the next time the client starts\n"
+}
+
+// readConfigDocument reads the configuration file as JSON objects so that settings the client does not know are kept,
+// a new configuration is started when there is no file
+func readConfigDocument(fileName string, clientID string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return map[string]interface{}{"$schema": configSchemaURL, "clientid": clientID}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var document map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err = decoder.Decode(&document)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not valid JSON: %v", fileName, err)
+	}
+	return document, nil
+}
+
+// applyConfigEdits makes the changes to the configuration, to the named targets or to the global settings when none
+// are named, giving a description of each change
+func applyConfigEdits(document map[string]interface{}, names []string, edits configEdits) ([]string, error) {
+	if len(names) == 0 {
+		return applySettings(document, reflect.TypeOf(Configuration{}), edits, "")
+	}
+
+	targetsKey := objectKey(document, "targets")
+	targets, _ := document[targetsKey].([]interface{})
+	var changes []string
+	for _, name := range names {
+		index := -1
+		for position, value := range targets {
+			if object, isObject := value.(map[string]interface{}); isObject && object[objectKey(object, "name")] == name {
+				index = position
+				break
+			}
+		}
+		switch {
+		case edits.add && index >= 0:
+			return nil, fmt.Errorf("a target named %s already exists", name)
+		case edits.add:
+			targets = append(targets, map[string]interface{}{"name": name, "active": true})
+			index = len(targets) - 1
+			changes = append(changes, "added target "+name)
+		case index < 0:
+			return nil, fmt.Errorf("no target named %s", name)
+		case edits.remove:
+			targets = append(targets[:index], targets[index+1:]...)
+			changes = append(changes, "removed target "+name)
+			continue
+		}
+
+		target, isObject := targets[index].(map[string]interface{})
+		if !isObject {
+			return nil, fmt.Errorf("the target %s is not a JSON object", name)
+		}
+		if edits.enable || edits.disable {
+			delete(target, objectKey(target, "active"))
+			target["active"] = edits.enable
+			if edits.enable {
+				changes = append(changes, "enabled target "+name)
+			} else {
+				changes = append(changes, "disabled target "+name)
+			}
+		}
+		targetChanges, err := applySettings(target, reflect.TypeOf(Target{}), edits, " of target "+name)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, targetChanges...)
+	}
+	delete(document, targetsKey)
+	document["targets"] = targets
+	return changes, nil
+}
+
+// applySettings sets and unsets the settings of the object, keys are checked against the settings the described type
+// has and may name a setting of a nested object such as statuslog.format
+func applySettings(object map[string]interface{}, described reflect.Type, edits configEdits, of string) ([]string, error) {
+	var changes []string
+	for _, setting := range edits.set {
+		path, err := settingPath(described, setting.key)
+		if err != nil {
+			return nil, err
+		}
+		parent := object
+		for _, part := range path[:len(path)-1] {
+			key := objectKey(parent, part)
+			child, isObject := parent[key].(map[string]interface{})
+			if !isObject {
+				child = make(map[string]interface{})
+				delete(parent, key)
+				parent[part] = child
+			}
+			parent = child
+		}
+		last := path[len(path)-1]
+		delete(parent, objectKey(parent, last))
+		parent[last] = settingValue(setting.value)
+		changes = append(changes, "set "+strings.Join(path, ".")+of)
+	}
+	for _, key := range edits.unset {
+		path, err := settingPath(described, key)
+		if err != nil {
+			return nil, err
+		}
+		parent := object
+		for _, part := range path[:len(path)-1] {
+			parent, _ = parent[objectKey(parent, part)].(map[string]interface{})
+		}
+		if parent != nil {
+			delete(parent, objectKey(parent, path[len(path)-1]))
+		}
+		changes = append(changes, "unset "+strings.Join(path, ".")+of)
+	}
+	return changes, nil
+}
+
+// settingPath splits the key at dots into the names of the settings it refers to as they are written in the
+// configuration file, an error is returned when the type has no such setting
+func settingPath(described reflect.Type, key string) ([]string, error) {
+	var path []string
+	for _, part := range strings.Split(key, ".") {
+		for described.Kind() == reflect.Ptr {
+			described = described.Elem()
+		}
+		switch described.Kind() {
+		case reflect.Struct:
+			found := false
+			for index := 0; index < described.NumField(); index++ {
+				field := described.Field(index)
+				name := strings.Split(field.Tag.Get("json"), ",")[0]
+				if name != "" && name != "-" && strings.EqualFold(name, part) {
+					path = append(path, name)
+					described = field.Type
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unrecognised setting %q", key)
+			}
+		case reflect.Map:
+			path = append(path, part)
+			described = described.Elem()
+		default:
+			return nil, fmt.Errorf("unrecognised setting %q, %s is not an object", key, strings.Join(path, "."))
+		}
+	}
+	return path, nil
+}
+
+// settingValue reads the value given on the command line as JSON, such as 300, true or ["a","b"], or as a string when
+// it is not JSON
+func settingValue(value string) interface{} {
+	var parsed interface{}
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+	if decoder.Decode(&parsed) == nil && !decoder.More() {
+		return parsed
+	}
+	return value
+}
+
+// objectKey gives the key the object holds the setting under, which may differ in case from the name given as the
+// client reads settings ignoring case
+func objectKey(object map[string]interface{}, name string) string {
+	if _, exists := object[name]; exists {
+		return name
+	}
+	for key := range object {
+		if strings.EqualFold(key, name) {
+			return key
+		}
+	}
+	return name
+}
+
+// replaceFile writes the data to a temporary file beside the file and renames it over the file, so the file is never
+// left partly written. The permissions of the file are kept as it holds secrets
+func replaceFile(fileName string, data []byte) error {
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(fileName); err == nil {
+		mode = info.Mode().Perm()
+	}
+	temporary, err := ioutil.TempFile(filepath.Dir(fileName), filepath.Base(fileName)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name())
+	_, err = temporary.Write(data)
+	if err == nil {
+		err = temporary.Sync()
+	}
+	if closeErr := temporary.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(temporary.Name(), mode)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(temporary.Name(), fileName)
+}
@@ -0,0 +1,176 @@
+package link
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func configCommandClient(currentContext context.Context, args ...string) *linkClient {
+	client := &linkClient{currentContext: currentContext, statusRecorder: createStatusRecorder(currentContext)}
+	client.configuration.getConfigurationFromArgs(append([]string{"-u:TestConfigCommands"}, args...))
+	return client
+}
+
+func TestSetConfig(tests *testing.T) {
+	defer os.Remove("TestConfigCommands.json")
+	err := ioutil.WriteFile("TestConfigCommands.json", []byte(`{
+  "$schema": "schema.json",
+  "clientid": "TestConfigCommands",
+  "Secret": "s3cret",
+  "custom": {"kept": true},
+  "targets": [{"name": "Data", "active": true, "location": "/in", "pollinterval": 60}]
+}`), 0600)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+
+	client := configCommandClient(currentContext, "-c:SetConfig", "-set:concurrentuploads=4", "-set:statuslog.format=jsonl", "-set:secret=changed")
+	output := client.Start()
+	if client.GetExitCode() != 0 {
+		tests.Fatal(output)
+	}
+	client = configCommandClient(currentContext, "-c:SetConfig", "-t:Data", "-set:pollinterval=300", "-set:tenant=t1", "-disable")
+	if output = client.Start(); client.GetExitCode() != 0 {
+		tests.Fatal(output)
+	}
+	client = configCommandClient(currentContext, "-c:SetConfig", "-t:Logs", "-add", "-set:location=/logs", "-set:include=[{\"pattern\":\"*.log\",\"type\":\"glob\"}]")
+	if output = client.Start(); client.GetExitCode() != 0 {
+		tests.Fatal(output)
+	}
+
+	var document map[string]interface{}
+	data, _ := ioutil.ReadFile("TestConfigCommands.json")
+	if err := json.Unmarshal(data, &document); err != nil {
+		tests.Fatal(err)
+	}
+	if document["$schema"] != "schema.json" || document["custom"] == nil || document["Secret"] != nil || document["secret"] != "changed" {
+		tests.Fatal("settings not kept or replaced ", string(data))
+	}
+	loaded := linkClient{}
+	if err := loaded.loadConfig("TestConfigCommands.json"); err != nil {
+		tests.Fatal(err)
+	}
+	config := loaded.configuration
+	if config.ConcurrentUploads != 4 || config.StatusLog == nil || config.StatusLog.Format != "jsonl" || len(config.Targets) != 2 {
+		tests.Fatal("global settings not changed ", string(data))
+	}
+	if data := config.Targets[0]; data.PollInterval != 300 || data.Tenant != "t1" || data.Active || data.Location != "/in" {
+		tests.Fatal("target not changed ", data)
+	}
+	if logs := config.Targets[1]; logs.Name != "Logs" || !logs.Active || logs.Location != "/logs" || len(logs.Include) != 1 {
+		tests.Fatal("target not added ", logs)
+	}
+
+	// changes that leave the configuration invalid or name unknown settings are refused
+	for _, args := range [][]string{
+		{"-set:tenantt=t1", "-t:Data"},
+		{"-set:match=[", "-t:Data"},
+		{"-set:statuslog.format=xml"},
+		{"-t:Data", "-add"},
+		{"-t:Missing", "-enable"},
+		{"-enable"},
+		{"-t:Data", "-enable", "-disable"},
+		{"-t:Data", "-add", "-remove"},
+		{"-t:Data", "-remove", "-set:tenant=t1"},
+		{},
+	} {
+		client = configCommandClient(currentContext, append([]string{"-c:SetConfig"}, args...)...)
+		if output = client.Start(); client.GetExitCode() != 1 {
+			tests.Fatal("invalid change accepted ", args, output)
+		}
+	}
+	if unchanged, _ := ioutil.ReadFile("TestConfigCommands.json"); string(unchanged) != string(data) {
+		tests.Fatal("the configuration was changed by a refused change")
+	}
+
+	client = configCommandClient(currentContext, "-c:SetConfig", "-t:Logs", "-remove")
+	if output = client.Start(); client.GetExitCode() != 0 || !strings.Contains(output, "removed target Logs") {
+		tests.Fatal(output)
+	}
+	client = configCommandClient(currentContext, "-c:SetConfig", "-unset:statuslog.format")
+	if output = client.Start(); client.GetExitCode() != 0 {
+		tests.Fatal(output)
+	}
+	loaded = linkClient{}
+	loaded.loadConfig("TestConfigCommands.json")
+	if len(loaded.configuration.Targets) != 1 || loaded.configuration.StatusLog.Format != "" {
+		tests.Fatal("target not removed or setting not unset ", loaded.configuration)
+	}
+}
+
+func TestGetConfig(tests *testing.T) {
+	defer os.Remove("TestConfigCommands.json")
+	err := ioutil.WriteFile("TestConfigCommands.json", []byte(`{
+  "clientid": "TestConfigCommands",
+  "secret": "s3cret",
+  "admin": {"address": "127.0.0.1:9181", "token": "t0ken"},
+  "webhooks": [{"url": "https://example.com/hook", "secret": "h00k", "headers": {"Authorization": "Bearer abc"}}],
+  "targets": [{"name": "Data", "location": "/in"}, {"name": "Logs", "location": "/logs"}]
+}`), 0600)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+
+	client := configCommandClient(currentContext, "-c:GetConfig")
+	output := client.Start()
+	if client.GetExitCode() != 0 {
+		tests.Fatal(output)
+	}
+	for _, secret := range []string{"s3cret", "t0ken", "h00k", "Bearer abc"} {
+		if strings.Contains(output, secret) {
+			tests.Fatal("secret shown ", output)
+		}
+	}
+	var shown Configuration
+	if err := json.Unmarshal([]byte(output), &shown); err != nil || len(shown.Targets) != 2 || shown.Secret != redacted {
+		tests.Fatal("configuration not shown ", err, output)
+	}
+
+	client = configCommandClient(currentContext, "-c:GetConfig", "-t:Logs")
+	output = client.Start()
+	var targets []Target
+	if err := json.Unmarshal([]byte(output), &targets); err != nil || len(targets) != 1 || targets[0].Location != "/logs" {
+		tests.Fatal("target not shown ", err, output)
+	}
+	client = configCommandClient(currentContext, "-c:GetConfig", "-t:Missing")
+	if output = client.Start(); client.GetExitCode() != 1 {
+		tests.Fatal("unknown target shown ", output)
+	}
+}
+
+func TestSetConfigLocks(tests *testing.T) {
+	defer os.Remove("TestSetConfigLocks.lock")
+	defer os.Remove("TestSetConfigLocks.recordStatus")
+	lock, err := acquireClientLock(context.Background(), "TestSetConfigLocks.lock", AutoCommand, 0)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+
+	// a running client writes the status log the change would be recorded in, so it is not waited for
+	started := time.Now()
+	_, err = newClientStruct(currentContext, []string{"-u:TestSetConfigLocks", "-c:SetConfig", "-wait:5", "-set:concurrentuploads=2"})
+	if err == nil || !strings.Contains(err.Error(), "stop it before changing the configuration") || time.Since(started) > 2*time.Second {
+		tests.Fatal("configuration changed while a client was running ", err)
+	}
+	lock.release()
+
+	client, err := newClientStruct(currentContext, []string{"-u:TestSetConfigLocks", "-c:SetConfig", "-set:concurrentuploads=2"})
+	if err != nil {
+		tests.Fatal(err)
+	}
+	defer client.Dispose()
+	if client.lock == nil || client.fileTransferRecorder.store != nil {
+		tests.Fatal("lock not taken or state opened")
+	}
+}
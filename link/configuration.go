@@ -2,20 +2,28 @@ package link
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"strconv"
 	"strings"
 )
 
 // Commands
 const (
-	UploadCommand    = "Upload"
-	StartCommand     = "Start"
-	AutoCommand      = "Auto"
-	HelpCommand      = "help"
-	TestCommand      = "Test"
-	SetConfigCommand = "SetConfig"
-	GetConfigCommand = "GetConfig"
-	Usage            = `TrueConnect-Link v1.0.1 
+	UploadCommand      = "Upload"
+	StartCommand       = "Start"
+	AutoCommand        = "Auto"
+	HelpCommand        = "help"
+	TestCommand        = "Test"
+	SetConfigCommand   = "SetConfig"
+	GetConfigCommand   = "GetConfig"
+	CheckStateCommand  = "CheckState"
+	DeadLettersCommand = "DeadLetters"
+	RequeueCommand     = "Requeue"
+	StatusCommand      = "Status"
+	ReportCommand      = "Report"
+	ForgetCommand      = "Forget"
+	Usage              = `TrueConnect-Link v1.0.1 
 https://github.com/GeneralElectric/TrueConnect-Link
 Use this tool to upload data to TrueConnect
 			USAGE:
@@ -30,10 +38,22 @@ Use this tool to upload data to TrueConnect
         		            after the configured interval
         		Test		Performs a test of network connectivity to TrueConnect and validates all local configurations
         					against allowed permissions on target tenants
+        		CheckState	validates the status log and the state file, repairing the state file when it is damaged
+        		DeadLetters	lists the files abandoned after failing to upload too many times
+        		Requeue		releases abandoned files so that they are tried again
+        		Status		summarises the uploads of each target from the status log and the state file
+        		Report		exports a row for each upload attempt recorded in the status log
+        		Forget		removes uploads from the state so that their files are uploaded again
+        		GetConfig	shows the configuration or the named targets with their secrets hidden
+        		SetConfig	adds, changes, enables, disables or removes targets and changes global settings
+
+        	Only one client can run with each client ID, a second client fails unless it is given -wait:<seconds> to wait
+        	for the first to stop. Test, Report, GetConfig and help can always be run, Status reads the status log alone
+        	while another client is running and SetConfig fails without waiting.
 
         	Upload:
         		Trueconnectlink -c:Upload -u:<user> -p:<secret> -tenant:<tenant> -datatype:<datatype> -dataformat:<dataformat>
-        						-path:<path> -e:<endpoint> -tokurl:<tokenurl>
+        						-path:<path> -e:<endpoint> -tokurl:<tokenurl> [-force [-reason:<reason>]]
 
         		Args:
         			user 		The UAA clientID used to connect to TrueConnect
@@ -44,6 +64,8 @@ Use this tool to upload data to TrueConnect
         			path		Set the full path of the file to upload
         			e			Sets the url TrueConnect service where the file is to be uploaded
         			tokurl		Sets the OAuth2 service URL from where a bearer token needed for TrueConnect may be obtained
+        			force		OPTIONAL, uploads the file even when it has been uploaded before, this is recorded in the
+        			            status log with who forced it and the reason given
 
         	Start:
         		Trueconnectlink -c:Start -u:<user> [-t:<Target>]
@@ -62,6 +84,91 @@ Use this tool to upload data to TrueConnect
                                 called <user>.json and found in the same folder as the executable)
         	Test:
         		Trueconnectlink -c:Test
+        	CheckState:
+        		Trueconnectlink -c:CheckState -u:<user>
+
+        		Args:
+        			user 		The UAA clientID whose status log (<user>.recordStatus) and state file (<user>.state)
+        			            are checked, the client must not be running
+        	DeadLetters:
+        		Trueconnectlink -c:DeadLetters -u:<user> [-path:<path>] [-pattern:<pattern>] [-t:<Target>]
+        						[-since:<time>] [-until:<time>]
+
+        		Args:
+        			user 		The UAA clientID whose abandoned files are listed, the client must not be running
+        			path		OPTIONAL, only the abandoned file with this full path
+        			pattern		OPTIONAL, only abandoned files whose full path or name match this glob pattern
+        			target		OPTIONAL, MULTIPLE, only abandoned files found by the named targets
+        			since		OPTIONAL, only files abandoned at or after this time, given as 2006-01-02T15:04:05Z
+        			            or 2006-01-02
+        			until		OPTIONAL, only files abandoned before this time
+        	Requeue:
+        		Trueconnectlink -c:Requeue -u:<user> [-path:<path>] [-pattern:<pattern>] [-t:<Target>]
+        						[-since:<time>] [-until:<time>] [-all]
+
+        		Args:
+        			The files to release are chosen as for DeadLetters, at least one argument must be given or -all
+        			to release every abandoned file. Released files are tried again the next time they are found
+        	Status:
+        		Trueconnectlink -c:Status -u:<user> [-t:<Target>] [-since:<time>] [-until:<time>] [-format:<format>]
+
+        		Args:
+        			user 		The UAA clientID whose uploads are summarised
+        			target		OPTIONAL, MULTIPLE, only the named targets are shown
+        			since		OPTIONAL, only uploads at or after this time, given as 2006-01-02T15:04:05Z or 2006-01-02
+        			until		OPTIONAL, only uploads before this time
+        			format		OPTIONAL, table (the default), json or csv
+        	Report:
+        		Trueconnectlink -c:Report -u:<user> [-t:<Target>] [-tenant:<tenant>] [-status:<status>] [-since:<time>]
+        						[-until:<time>] [-format:<format>]
+
+        		Args:
+        			user 		The UAA clientID whose uploads are reported
+        			target		OPTIONAL, MULTIPLE, only uploads of files found by the named targets
+        			tenant		OPTIONAL, MULTIPLE, only uploads to the named tenants
+        			status		OPTIONAL, MULTIPLE, only uploads with this outcome, such as Success or Failed
+        			since		OPTIONAL, only uploads started at or after this time, given as 2006-01-02T15:04:05Z or
+        			            2006-01-02
+        			until		OPTIONAL, only uploads started before this time
+        			format		OPTIONAL, csv (the default), jsonl for JSON Lines or html
+        	Forget:
+        		Trueconnectlink -c:Forget -u:<user> [-path:<path>] [-hash:<sha256>] [-pattern:<pattern>] [-t:<Target>]
+        						[-since:<time>] [-until:<time>] [-all] [-reason:<reason>]
+
+        		Args:
+        			user 		The UAA clientID whose uploads are forgotten, the client must not be running
+        			path		OPTIONAL, only the upload of the file with this full path
+        			hash		OPTIONAL, only uploads of files with this SHA-256 hash
+        			pattern		OPTIONAL, only uploads of files whose full path or name match this glob pattern
+        			target		OPTIONAL, MULTIPLE, only uploads of files found by the named targets
+        			since		OPTIONAL, only files uploaded at or after this time, given as 2006-01-02T15:04:05Z
+        			            or 2006-01-02
+        			until		OPTIONAL, only files uploaded before this time
+        			reason		OPTIONAL, recorded in the status log with who forgot the uploads
+        			At least one of the arguments choosing uploads must be given or -all to forget every upload
+        	GetConfig:
+        		Trueconnectlink -c:GetConfig -u:<user> [-t:<Target>]
+
+        		Args:
+        			user 		The UAA clientID whose configuration (<user>.json) is shown, secrets are shown as ********
+        			target		OPTIONAL, MULTIPLE, only the named targets are shown
+        	SetConfig:
+        		Trueconnectlink -c:SetConfig -u:<user> [-t:<Target>] [-add | -remove] [-enable | -disable]
+        						[-set:<key>=<value>] [-unset:<key>]
+
+        		Args:
+        			user 		The UAA clientID whose configuration (<user>.json) is changed, it is created when missing
+        			target		OPTIONAL, MULTIPLE, the targets changed, the global settings are changed when none are named
+        			add			OPTIONAL, adds the named targets, they are active unless -disable is given
+        			remove		OPTIONAL, removes the named targets
+        			enable		OPTIONAL, makes the named targets active
+        			disable		OPTIONAL, makes the named targets inactive
+        			set			OPTIONAL, MULTIPLE, sets the setting named as in the configuration file, such as tenant or
+        			            statuslog.format, the value is read as JSON such as 300, true or ["a"] or else as text
+        			unset		OPTIONAL, MULTIPLE, removes the setting so that its default is used
+        			The changed configuration is checked as when the client starts and the file is only replaced when
+        			it is valid. It fails while a client is running, the changes are used the next time the client starts
+        			Conflicting arguments such as -enable with -disable, or -remove with other changes, are refused
 	`
 )
 
@@ -91,8 +198,105 @@ type Configuration struct {
 	// The maximum number of concurrent uploads allowed
 	ConcurrentUploads int `json:"concurrentuploads"`
 
+	// How files are recognised as already uploaded, "pathhash" by the same path and content, "hash" by the same content
+	// uploaded to the same tenant or "path" by the same path whatever its content. This is "pathhash" by default
+	DedupPolicy string `json:"deduppolicy"`
+
+	// Describes when the status log is written to disk and rotated, it is never rotated when not set
+	StatusLog *StatusLogConfig `json:"statuslog"`
+
+	// The number of failed attempts to upload a file before it is abandoned, abandoned files are not looked at again
+	// until they are requeued. 10 when not set, -1 never abandons a file
+	MaxAttempts int `json:"maxattempts"`
+
+	// The HTTP endpoints told when files are uploaded, fail or are abandoned and when searches complete
+	Webhooks []WebhookConfig `json:"webhooks"`
+
+	// Describes the endpoint Prometheus scrapes the metrics of the client from, it is not served when not set
+	Metrics *MetricsConfig `json:"metrics"`
+
+	// Describes the local HTTP API used to look at and control the running client, it is not served when not set
+	Admin *AdminConfig `json:"admin"`
+
+	// Describes the liveness and readiness endpoints and when the client is reported as stalled or degraded
+	Health *HealthConfig `json:"health"`
+
 	// The mode of execution, set via command line argument
 	command string
+
+	// the files and times chosen on the command line, set via command line argument
+	selector commandSelector
+
+	// the format of the output of reporting commands, set via command line argument
+	outputFormat string
+
+	// the changes SetConfig makes to the configuration file, set via command line argument
+	edits configEdits
+
+	// when set a file is uploaded even when it has been uploaded before, set via command line argument
+	force bool
+
+	// the reason recorded in the status log for forgetting or forcing uploads, set via command line argument
+	reason string
+
+	// the number of seconds to wait for another client with the same client ID to stop, set via command line argument
+	lockWait int
+}
+
+// StatusLogConfig configuration used to describe when the status log is written to disk and rotated. A rotated log is
+// compressed and the new log starts with the state still needed to resume uploads and avoid duplicates
+type StatusLogConfig struct {
+	// The size in bytes the log can grow to before it is rotated, 0 for no limit
+	MaxSize int64 `json:"maxsize"`
+
+	// The number of seconds after its first entry that the log is rotated, 0 for no limit
+	MaxAge int `json:"maxage"`
+
+	// The number of rotated logs kept, 0 keeps them all
+	Retain int `json:"retain"`
+
+	// When entries are written to disk, "never" leaves it to the operating system (the default), "always" after each
+	// entry and "interval" at most once every sync interval
+	Sync string `json:"sync"`
+
+	// The number of seconds between writes to disk when sync is "interval", 1 by default
+	SyncInterval int `json:"syncinterval"`
+
+	// The format entries are written in, "csv" (the default) or "jsonl" for JSON Lines with typed fields such as the
+	// size and duration of uploads. A log can hold entries in both formats, each is read in the format it was written in
+	Format string `json:"format"`
+
+	// The destinations status entries are copied to as well as the status log, a sink that is slow or broken never
+	// holds up the client, entries are dropped when it falls too far behind
+	Sinks []StatusSinkConfig `json:"sinks"`
+}
+
+// StatusSinkConfig describes a destination status entries are copied to as well as the status log
+type StatusSinkConfig struct {
+	// The kind of sink, "file", "stdout", "syslog", "journald" or "rotatingfile"
+	Type string `json:"type"`
+
+	// The file written by file and rotatingfile sinks
+	Path string `json:"path"`
+
+	// The local socket of syslog or journald, the usual sockets are used when not set
+	Address string `json:"address"`
+
+	// The format entries are written in, "csv" (the default) or "jsonl"
+	Format string `json:"format"`
+
+	// The least severe entries written, "debug" (the default) writes every entry, "info" leaves out entries such as
+	// uploads starting, "warning" leaves out successful operations and "error" only writes failures
+	MinSeverity string `json:"minseverity"`
+
+	// The number of entries held while the sink catches up, 1000 by default. Entries are dropped when it is full
+	Buffer int `json:"buffer"`
+
+	// The size in bytes a rotatingfile sink grows to before it is rotated, 10000000 by default
+	MaxSize int64 `json:"maxsize"`
+
+	// The number of rotated files a rotatingfile sink keeps, 5 by default
+	Retain int `json:"retain"`
 }
 
 // Target is the configuration used to specify a location to search and what data to find there
@@ -115,6 +319,34 @@ type Target struct {
 	// A regular expression used to describe which file to include for upload
 	Match string `json:"match"`
 
+	// Patterns describing which files to include for upload, when any are given a file must match at least one of them
+	Include []FilePattern `json:"include"`
+
+	// Patterns describing files that must not be uploaded even if they are matched by the include patterns
+	Exclude []FilePattern `json:"exclude"`
+
+	// The minimum size in bytes a file must be to be uploaded
+	MinSize int64 `json:"minsize"`
+
+	// The maximum size in bytes a file can be to be uploaded, 0 for no limit
+	MaxSize int64 `json:"maxsize"`
+
+	// The number of seconds since a file was last modified before it will be uploaded, this allows time for files that
+	// are still being written to be finished
+	MinAge int `json:"minage"`
+
+	// Files last modified longer than this number of seconds ago will not be uploaded, 0 for no limit
+	MaxAge int `json:"maxage"`
+
+	// The maximum number of directory levels below the location to search when recursive, 0 for no limit
+	MaxDepth int `json:"maxdepth"`
+
+	// Zero byte files are not uploaded unless this is set
+	IncludeEmpty bool `json:"includeempty"`
+
+	// Temporary files such as *.part or *.tmp are not uploaded unless this is set
+	IncludeTemporary bool `json:"includetemporary"`
+
 	// The data type of the file that match the regular expression in this target location
 	DataType string `json:"datatype"`
 
@@ -124,6 +356,19 @@ type Target struct {
 	// A list of metadata tag that can be extracted from the file path
 	PathEncodedMetaDataTags []PathEncodedMetaDataTag `json:"pathencodedmetadatatags"`
 
+	// A regular expression matched against the file path where each named group, e.g. (?P<TailNo>...), sets the
+	// value of the metadata tag of the same name
+	PathPattern string `json:"pathpattern"`
+
+	// Describes a metadata file written alongside each data file whose values are added to the metadata of the data file
+	Sidecar *SidecarConfig `json:"sidecar"`
+
+	// Describes a program or registered extractor run for each file to find metadata held in the content of the file
+	Extractor *ExtractorConfig `json:"extractor"`
+
+	// Transformations applied to the values of metadata tags extracted from the file, such as those found in the path
+	Transforms []TagTransform `json:"transforms"`
+
 	// a list of static meta data values
 	StaticTags []StaticMetaData `json:"statictags"`
 
@@ -131,10 +376,48 @@ type Target struct {
 	// files that haven't been uploaded yet
 	PollInterval int `json:"pollinterval"`
 
+	// How files found by this target are recognised as already uploaded, the global policy is used when not set
+	DedupPolicy string `json:"deduppolicy"`
+
+	// What is done when a file is found with different content to the last version uploaded from the same path, one of
+	// "reupload" (the default), "ignore" or "append" which only uploads files that have been added to. A new version is
+	// uploaded with the supersedes and version metadata
+	OnChange string `json:"onchange"`
+
+	// Describes what is done with a file once it has been uploaded
+	Disposition *DispositionConfig `json:"disposition"`
+
+	// When set a receipt file is written next to each uploaded file, recording where it was uploaded to and the metadata
+	// sent. Files with a matching receipt are treated as already uploaded
+	Receipt *ReceiptConfig `json:"receipt"`
+
+	// The number of failed attempts to upload a file found by this target before it is abandoned, the global number is
+	// used when not set and -1 never abandons a file
+	MaxAttempts int `json:"maxattempts"`
+
+	// Commands run when this target is searched and when its files are uploaded, fail to upload or are skipped
+	Hooks []HookConfig `json:"hooks"`
+
 	// Command or script to be run on successful upload of the file, the full path of the file uploaded will be added to the
 	// command as the first argument after the command wrapped in double quoates. The file storage reference will be
 	// added as the second argument.
 	OnSuccess string `json:"onsuccess"`
+
+	// the compiled form of the patterns in this target, built once per target
+	compiled *compiledTarget
+}
+
+// FilePattern configuration used to describe a set of files by name or path
+type FilePattern struct {
+	// The regular expression or glob pattern
+	Pattern string `json:"pattern"`
+
+	// The type of pattern, either "regex" (the default) or "glob"
+	Type string `json:"type"`
+
+	// What the pattern is matched against, "name" (the default) for the file name, "path" for the path relative to
+	// the target location or "fullpath" for the whole path
+	Scope string `json:"scope"`
 }
 
 // PathEncodedMetaDataTag configuration used to describe a metadata tag whose value can be found in the file path
@@ -146,6 +429,205 @@ type PathEncodedMetaDataTag struct {
 	Match string `json:"match"`
 }
 
+// SidecarConfig configuration used to describe a metadata file that accompanies each data file
+type SidecarConfig struct {
+	// The path of the sidecar file, where $file is the full path of the data file, $dir its directory, $name its file
+	// name and $base its file name without the extension, e.g. "$file.json" or "$dir/$base.xml". Patterns that match
+	// data files should exclude the sidecar files
+	Name string `json:"name"`
+
+	// The format of the sidecar file, "json" or "xml", when not set this is taken from the sidecar file extension
+	Format string `json:"format"`
+
+	// Maps the fields of the sidecar onto metadata tags, when empty all the top level values are used with their own
+	// names
+	Fields []SidecarField `json:"fields"`
+
+	// When set a data file is not uploaded until its sidecar file is present
+	Required bool `json:"required"`
+
+	// When set the sidecar file is uploaded after the data file with a link to the data file's data_store_ref
+	Upload bool `json:"upload"`
+
+	// The data type given to the uploaded sidecar file, the target data type is used when not set
+	DataType string `json:"datatype"`
+
+	// The data format given to the uploaded sidecar file, the sidecar format is used when not set
+	DataFormat string `json:"dataformat"`
+}
+
+// SidecarField configuration used to describe a value in a sidecar file that is to be added to the metadata
+type SidecarField struct {
+	// The path to the value in the sidecar, with elements separated by "/" and XML attributes prefixed with "@",
+	// e.g. "flight/tail" or "Flight/@number"
+	Field string `json:"field"`
+
+	// the name of the metadata tag given the value
+	Tag string `json:"tag"`
+}
+
+// ExtractorConfig configuration used to describe how metadata is extracted from the content of a file, the extractor is
+// either an external program that writes a JSON object of metadata values to its standard output or a Go function
+// registered with RegisterExtractor
+type ExtractorConfig struct {
+	// The program run for each file, the full path of the file is added as the last argument
+	Command string `json:"command"`
+
+	// Arguments given to the program before the file path
+	Args []string `json:"args"`
+
+	// The name of an extractor registered with RegisterExtractor, used instead of a program
+	Name string `json:"name"`
+
+	// The number of seconds the extractor is allowed to run for, 60 by default
+	Timeout int `json:"timeout"`
+
+	// What happens when the extractor fails, "hold" (the default) to not upload the file until a later attempt
+	// succeeds or "upload" to upload the file without the extracted values
+	OnFailure string `json:"onfailure"`
+}
+
+// DispositionConfig configuration used to describe what is done with a file once it has been uploaded
+type DispositionConfig struct {
+	// The action taken, one of "move", "rename", "delete" or "receipt" which leaves the file where it is with its receipt
+	Action string `json:"action"`
+
+	// move: the directory files are moved to, their path relative to the target location is kept
+	ArchiveDir string `json:"archivedir"`
+
+	// rename: the suffix added to the file name, ".uploaded" by default
+	Suffix string `json:"suffix"`
+}
+
+// ReceiptConfig configuration used to describe the receipt files written for uploaded files
+type ReceiptConfig struct {
+	// The suffix added to the name of the uploaded file to give the name of its receipt, ".tcreceipt.json" by default
+	Suffix string `json:"suffix"`
+}
+
+// HookConfig configuration used to describe a command run when something happens to a target or one of its files.
+// Before the command is run the arguments that are only $file, $storageref, $tenant, $target, $event, $error or $batch
+// are replaced with the details of the event and ${tag} with the value of the metadata tag. The script given to a shell
+// with -c or /c is not replaced, it reads the same details from the environment variables TC_FILE, TC_STORAGEREF,
+// TC_TENANT, TC_TARGET, TC_EVENT, TC_ERROR, TC_BATCH and TC_META_<TAG>
+type HookConfig struct {
+	// The event that runs the hook, one of "start", "success", "failure", "partial", "skipped", "cyclecomplete" or
+	// "abandoned"
+	Event string `json:"event"`
+
+	// The command to run, its arguments are separated by spaces and can be quoted
+	Command string `json:"command"`
+
+	// The number of seconds the command is allowed to run for, 60 by default
+	Timeout int `json:"timeout"`
+
+	// When set the hook is run once at the end of each search cycle rather than for each file, the details of all the
+	// files that had the event are written as a JSON array to the file given by $batch
+	Batch bool `json:"batch"`
+}
+
+// MetricsConfig configuration used to describe the HTTP endpoint that serves the metrics of the client in the
+// Prometheus text format
+type MetricsConfig struct {
+	// The address the endpoint listens on, such as "127.0.0.1:9180"
+	Address string `json:"address"`
+
+	// The path the metrics are served on, "/metrics" by default
+	Path string `json:"path"`
+}
+
+// AdminConfig configuration used to describe the local admin API, which lists the targets and uploads and can pause,
+// resume, search, cancel and release files while the client runs
+type AdminConfig struct {
+	// A loopback address such as "127.0.0.1:9181", or "unix:" followed by the path of a Unix socket only the user
+	// running the client can use
+	Address string `json:"address"`
+
+	// The bearer token each request must carry in its Authorization header
+	Token string `json:"token"`
+}
+
+// HealthConfig configuration used to describe the endpoints container orchestrators and load balancers use to tell
+// whether the client is alive and ready, and when its health is reported as stalled or degraded
+type HealthConfig struct {
+	// The address the endpoints listen on, such as "0.0.0.0:9182". They are not served when not set, though the
+	// health of the client is still checked for the systemd watchdog
+	Address string `json:"address"`
+
+	// The seconds a search or upload can go without progress before the client is no longer live, 900 by default
+	StallAfter int `json:"stallafter"`
+
+	// The seconds without a successful upload while files are waiting before the client is degraded, 3600 by default
+	DegradedAfter int `json:"degradedafter"`
+}
+
+// WebhookConfig configuration used to describe an HTTP endpoint that is sent a JSON payload when an upload succeeds,
+// fails, is partly completed or is abandoned and when the search of a target completes. Payloads wait in the outbox of
+// the state file until they are delivered, so none are lost while the endpoint cannot be reached
+type WebhookConfig struct {
+	// The URL the payload is posted to
+	URL string `json:"url"`
+
+	// The events sent, any of "Success", "Failed", "Partial", "Abandoned" and "SearchComplete", all of them when not set
+	Events []string `json:"events"`
+
+	// The names of the targets whose events are sent, those of every target when not set
+	Targets []string `json:"targets"`
+
+	// When set the payload is signed with HMAC-SHA256 using this secret, the signature is sent in the
+	// X-Link-Signature header as sha256=<hex digest>
+	Secret string `json:"secret"`
+
+	// Extra headers sent with each payload, such as an authorization header
+	Headers map[string]string `json:"headers"`
+
+	// The number of seconds to wait for the endpoint to respond, 10 by default
+	Timeout int `json:"timeout"`
+
+	// The number of failed attempts after which a payload is given up, 0 (the default) keeps trying
+	MaxAttempts int `json:"maxattempts"`
+}
+
+// TagTransform configuration used to describe how the value of an extracted metadata tag is changed before upload
+type TagTransform struct {
+	// the name of the metadata tag whose value is transformed
+	Tag string `json:"tag"`
+
+	// The steps applied to the value, in order
+	Steps []TransformStep `json:"steps"`
+
+	// Other metadata tags, such as data_start_date, that are also given the transformed value
+	MapTo []string `json:"mapto"`
+}
+
+// TransformStep configuration used to describe a single change to a metadata value
+type TransformStep struct {
+	// The type of step, one of "date", "upper", "lower", "trim", "replace" or "lookup"
+	Type string `json:"type"`
+
+	// date: the layout of the value written using Go's reference time Mon Jan 2 15:04:05 -0700 MST 2006,
+	// e.g. 20060102-150405
+	Layout string `json:"layout"`
+
+	// date: the IANA name of the time zone of the value when the layout does not include one, UTC by default
+	Timezone string `json:"timezone"`
+
+	// trim: the characters removed from either end of the value, white space by default
+	Cutset string `json:"cutset"`
+
+	// replace: the regular expression to be replaced
+	Pattern string `json:"pattern"`
+
+	// replace: the replacement text, which can refer to groups in the pattern as $1 or ${name}
+	Replacement string `json:"replacement"`
+
+	// lookup: the table of values and their replacements
+	Table map[string]string `json:"table"`
+
+	// lookup: the value used when the value is not in the table, if empty the value is left unchanged
+	Default string `json:"default"`
+}
+
 // StaticMetaData that will accompany all uploads on associated target
 type StaticMetaData struct {
 	// the name of the metadata tag
@@ -183,6 +665,12 @@ func (linkClient *linkClient) loadConfigWithTargets() error {
 		linkClient.configuration.Targets = targets
 	}
 
+	if linkClient.configuration.StatusLog != nil && linkClient.statusRecorder != nil {
+		linkClient.statusRecorder.configure(*linkClient.configuration.StatusLog, linkClient.fileTransferRecorder.snapshot)
+	}
+	if linkClient.statusRecorder != nil {
+		linkClient.checkDedupPolicies()
+	}
 	return nil
 }
 
@@ -194,13 +682,74 @@ func (linkClient *linkClient) loadConfig(configURI string) error {
 	if err == nil {
 		err = json.Unmarshal(b, &config)
 		if err == nil {
-			linkClient.configuration = config
+			err = config.compile()
+			if err == nil {
+				linkClient.configuration = config
+			}
 		}
 	}
 
 	return err
 }
 
+// compile checks and prepares the regular expressions used in each target so configuration errors are found when the
+// configuration is loaded rather than when a file is found
+func (configuration *Configuration) compile() error {
+	err := validateDedupPolicy(configuration.DedupPolicy)
+	if err != nil {
+		return err
+	}
+	if configuration.StatusLog != nil {
+		switch strings.ToLower(configuration.StatusLog.Sync) {
+		case "", syncNever, syncAlways, syncInterval:
+		default:
+			return fmt.Errorf("unrecognised status log sync %q", configuration.StatusLog.Sync)
+		}
+		switch strings.ToLower(configuration.StatusLog.Format) {
+		case "", statusFormatCSV, statusFormatJSONLines:
+		default:
+			return fmt.Errorf("unrecognised status log format %q, use csv or jsonl", configuration.StatusLog.Format)
+		}
+		for _, sink := range configuration.StatusLog.Sinks {
+			err = sink.validate()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if configuration.MaxAttempts < unlimitedAttempts {
+		return fmt.Errorf("the maximum number of attempts cannot be less than -1")
+	}
+	if configuration.Health != nil {
+		err = configuration.Health.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if configuration.Admin != nil && configuration.Admin.Address != "" {
+		err = configuration.Admin.validate()
+		if err != nil {
+			return err
+		}
+	}
+	for index := range configuration.Webhooks {
+		err = configuration.Webhooks[index].validate()
+		if err != nil {
+			return err
+		}
+	}
+	for index := range configuration.Targets {
+		if configuration.Targets[index].MaxAttempts < unlimitedAttempts {
+			return fmt.Errorf("the maximum number of attempts of target %q cannot be less than -1", configuration.Targets[index].Name)
+		}
+		err = configuration.Targets[index].compile()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (configuration *Configuration) getConfigurationFromArgs(args []string) {
 
 	for _, arg := range args {
@@ -224,6 +773,28 @@ func (configuration *Configuration) getConfigurationFromArgs(args []string) {
 		if strings.HasPrefix(arg, "-u:") {
 			configuration.ClientID = arg[3:]
 		}
+		if strings.HasPrefix(arg, "-reason:") {
+			configuration.reason = arg[8:]
+		}
+		if strings.HasPrefix(arg, "-wait:") {
+			configuration.lockWait, _ = strconv.Atoi(arg[6:])
+		}
+		if arg == "-force" {
+			// checked against the command when the client starts, as it may be given before the command
+			configuration.force = true
+		}
+		if configuration.command == DeadLettersCommand || configuration.command == RequeueCommand ||
+			configuration.command == StatusCommand || configuration.command == ReportCommand ||
+			configuration.command == ForgetCommand {
+			if strings.HasPrefix(arg, "-format:") {
+				configuration.outputFormat = strings.ToLower(arg[8:])
+			}
+			configuration.selector.parseArg(arg)
+			continue
+		}
+		if configuration.command == SetConfigCommand {
+			configuration.edits.parseArg(arg)
+		}
 		if strings.HasPrefix(arg, "-t:") &&
 			(configuration.command == StartCommand ||
 				configuration.command == AutoCommand ||
@@ -231,16 +802,16 @@ func (configuration *Configuration) getConfigurationFromArgs(args []string) {
 				configuration.command == GetConfigCommand) {
 			configuration.Targets = append(configuration.Targets, Target{Name: arg[3:]})
 		}
-		if strings.HasPrefix(arg, "-tenant:") {
+		if strings.HasPrefix(arg, "-tenant:") && len(configuration.Targets) > 0 {
 			configuration.Targets[0].Tenant = arg[8:]
 		}
-		if strings.HasPrefix(arg, "-datatype:") {
+		if strings.HasPrefix(arg, "-datatype:") && len(configuration.Targets) > 0 {
 			configuration.Targets[0].DataType = arg[10:]
 		}
-		if strings.HasPrefix(arg, "-dataformat:") {
+		if strings.HasPrefix(arg, "-dataformat:") && len(configuration.Targets) > 0 {
 			configuration.Targets[0].DataFormat = arg[12:]
 		}
-		if strings.HasPrefix(arg, "-path:") {
+		if strings.HasPrefix(arg, "-path:") && len(configuration.Targets) > 0 {
 			configuration.Targets[0].Location = arg[6:]
 		}
 		if strings.HasPrefix(arg, "-e:") {
@@ -269,6 +269,27 @@ func TestGetLocations(tests *testing.T) {
 
 }
 
+func TestLoadConfigRejectsInvalidExpressions(tests *testing.T) {
+	invalid := []string{
+		`{"clientid": "testID", "targets": [{"name": "bad", "match": "*.zip"}]}`,
+		`{"clientid": "testID", "targets": [{"name": "bad", "pathpattern": "(?P<TailNo>[^_]"}]}`,
+		`{"clientid": "testID", "targets": [{"name": "bad", "pathencodedmetadatatags": [{"tag": "ESN", "match": "(\\d{6}"}]}]}`,
+	}
+	defer RemoveTestConfigFile()
+	for _, config := range invalid {
+		if WriteTestConfigurationFile(config) != nil {
+			tests.Fatal("Could not create Test file")
+		}
+		client := linkClient{}
+		if client.loadConfig("link.testconf.json") == nil {
+			tests.Fatal("invalid expression accepted in " + config)
+		}
+		if client.configuration.ClientID != "" {
+			tests.Fatal("configuration with invalid expression was loaded")
+		}
+	}
+}
+
 func TestGetCommand(tests *testing.T) {
 	target := Target{OnSuccess: "Test $file this $storageref"}
 	command := target.getCommand("first", "second")
@@ -288,7 +309,7 @@ func testConfigSetUp() error {
 		 		"tenant": "abc",
 		 		"location": "c:/test/",
 		 		"recursive": true,
-		 		"match": "*.zip",
+		 		"match": ".*\\.zip$",
 		 		"datatype": "qar",
 		 		"dataformat": "arinc717"
 		 	},
@@ -298,7 +319,7 @@ func testConfigSetUp() error {
 		 		"tenant": "abc2",
 		 		"location": "c:/test2/",
 		 		"recursive": false,
-		 		"match": "*.zip",
+		 		"match": ".*\\.zip$",
 		 		"datatype": "EMU",
 		 		"dataformat": "FFD1b107"
 		 	}]
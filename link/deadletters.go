@@ -0,0 +1,304 @@
+package link
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The statuses recorded when a file is abandoned and when it is released to be tried again
+const (
+	abandonedStatus = "Abandoned"
+	requeuedStatus  = "Requeued"
+	dateLayout      = "2006-01-02"
+)
+
+// the number of failed attempts before a file is abandoned when none is configured, and the number configured to never
+// abandon a file
+const (
+	defaultMaxAttempts = 10
+	unlimitedAttempts  = -1
+)
+
+// failureRecord counts the failed attempts to upload a file, once the attempt budget is spent the file is abandoned and
+// not looked at again until it is requeued
+type failureRecord struct {
+	Path      string    `json:"path"`
+	Target    string    `json:"target"`
+	Attempts  int       `json:"attempts"`
+	Reason    string    `json:"reason"`
+	Time      time.Time `json:"time"`
+	Abandoned bool      `json:"abandoned"`
+}
+
+// deadLetter is an abandoned file and the key its upload is recorded under
+type deadLetter struct {
+	record  string
+	failure failureRecord
+}
+
+// commandSelector holds the command line arguments choosing the files and times a command looks at
+type commandSelector struct {
+	path    string
+	hash    string
+	pattern string
+	targets []string
+	tenants []string
+	status  []string
+	since   string
+	until   string
+	all     bool
+}
+
+// parseArg reads a command line argument choosing files or times
+func (selector *commandSelector) parseArg(arg string) {
+	switch {
+	case strings.HasPrefix(arg, "-path:"):
+		selector.path = arg[6:]
+	case strings.HasPrefix(arg, "-hash:"):
+		selector.hash = arg[6:]
+	case strings.HasPrefix(arg, "-pattern:"):
+		selector.pattern = arg[9:]
+	case strings.HasPrefix(arg, "-t:"):
+		selector.targets = append(selector.targets, arg[3:])
+	case strings.HasPrefix(arg, "-tenant:"):
+		selector.tenants = append(selector.tenants, arg[8:])
+	case strings.HasPrefix(arg, "-status:"):
+		selector.status = append(selector.status, arg[8:])
+	case strings.HasPrefix(arg, "-since:"):
+		selector.since = arg[7:]
+	case strings.HasPrefix(arg, "-until:"):
+		selector.until = arg[7:]
+	case arg == "-all":
+		selector.all = true
+	}
+}
+
+// maxAttempts gives the number of failed attempts before a file of the target is abandoned, 0 for no limit
+func (configuration *Configuration) maxAttempts(target *Target) int {
+	attempts := target.MaxAttempts
+	if attempts == 0 {
+		attempts = configuration.MaxAttempts
+	}
+	switch attempts {
+	case 0:
+		return defaultMaxAttempts
+	case unlimitedAttempts:
+		return 0
+	}
+	return attempts
+}
+
+// recordFailure counts a failed attempt to upload the file, the file is abandoned when the budget is spent. The error
+// is that of writing the state store
+func (recorder *fileTransferRecorder) recordFailure(record string, path string, target string, reason string, budget int) (failureRecord, error) {
+	failure, _ := recorder.store.failure(record)
+	failure.Path = path
+	failure.Target = target
+	failure.Reason = reason
+	failure.Time = time.Now().UTC()
+	failure.Attempts++
+	failure.Abandoned = budget > 0 && failure.Attempts >= budget
+	return failure, recorder.store.putFailure(record, failure)
+}
+
+// clearFailure forgets the failed attempts of a file once it has been uploaded
+func (recorder *fileTransferRecorder) clearFailure(record string) error {
+	if _, exists := recorder.store.failure(record); exists {
+		return recorder.store.deleteFailure(record)
+	}
+	return nil
+}
+
+// isAbandoned returns true when the file has spent its attempt budget and has not been requeued
+func (recorder *fileTransferRecorder) isAbandoned(record string) bool {
+	if recorder.store == nil {
+		return false
+	}
+	failure, exists := recorder.store.failure(record)
+	return exists && failure.Abandoned
+}
+
+// deadLetters gives the abandoned files the selector matches, oldest first
+func (recorder *fileTransferRecorder) deadLetters(matches fileMatch) ([]deadLetter, error) {
+	var letters []deadLetter
+	err := recorder.store.forEachFailure(func(record string, failure failureRecord) error {
+		if failure.Abandoned && matches(failure.Path, failure.Target, failure.Time) {
+			letters = append(letters, deadLetter{record: record, failure: failure})
+		}
+		return nil
+	})
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].failure.Time.Before(letters[j].failure.Time)
+	})
+	return letters, err
+}
+
+// recordFailure counts a failed attempt to upload the found file and records the file being abandoned when that spends
+// its attempt budget. Attempts cut short by the client stopping or the file going away are not counted
+func (linkClient *linkClient) recordFailure(foundFile foundFile, uid string, err error) {
+	if linkClient.currentContext.Err() != nil || os.IsNotExist(err) {
+		return
+	}
+	budget := linkClient.configuration.maxAttempts(foundFile.target)
+	failure, storeErr := linkClient.fileTransferRecorder.recordFailure(uid, foundFile.uri, foundFile.target.Name, err.Error(), budget)
+	linkClient.recordStateError(uid, storeErr)
+	if !failure.Abandoned {
+		return
+	}
+	data, _ := json.Marshal(failure)
+	linkClient.statusRecorder.recordStatus(systemName, fileUploadOpp, abandonedStatus, uid, string(data))
+	linkClient.fileEvent(eventAbandoned, foundFile, uid, err)
+}
+
+// fileMatch decides whether a file found by the target at the time given is chosen
+type fileMatch func(path string, target string, when time.Time) bool
+
+// matcher gives the function that decides whether a file is chosen by the selector, a file with no time is not chosen
+// when a time range is given
+func (selector commandSelector) matcher() (fileMatch, error) {
+	since, until, err := selector.times()
+	if err != nil {
+		return nil, err
+	}
+	if selector.pattern != "" {
+		if _, err := filepath.Match(selector.pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", selector.pattern, err)
+		}
+	}
+	targets := make(map[string]struct{})
+	for _, target := range selector.targets {
+		targets[target] = struct{}{}
+	}
+
+	return func(path string, target string, when time.Time) bool {
+		if selector.path != "" && filepath.Clean(selector.path) != filepath.Clean(path) {
+			return false
+		}
+		if selector.pattern != "" {
+			fullMatch, _ := filepath.Match(selector.pattern, path)
+			nameMatch, _ := filepath.Match(selector.pattern, filepath.Base(path))
+			if !fullMatch && !nameMatch {
+				return false
+			}
+		}
+		if len(targets) > 0 {
+			if _, exists := targets[target]; !exists {
+				return false
+			}
+		}
+		if (!since.IsZero() || !until.IsZero()) && when.IsZero() {
+			return false
+		}
+		return inTimeRange(when, since, until)
+	}, nil
+}
+
+// isEmpty returns true when nothing has been chosen, requeueing needs something to be chosen so that every abandoned
+// file is not released by mistake
+func (selector commandSelector) isEmpty() bool {
+	return !selector.all && selector.path == "" && selector.pattern == "" && len(selector.targets) == 0 &&
+		selector.since == "" && selector.until == ""
+}
+
+// times gives the since and until times chosen, either is zero when it was not given
+func (selector commandSelector) times() (time.Time, time.Time, error) {
+	since, err := parseSelectorTime(selector.since)
+	if err != nil {
+		return since, since, fmt.Errorf("invalid since time %q, use %s or %s", selector.since, time.RFC3339, dateLayout)
+	}
+	until, err := parseSelectorTime(selector.until)
+	if err != nil {
+		return since, until, fmt.Errorf("invalid until time %q, use %s or %s", selector.until, time.RFC3339, dateLayout)
+	}
+	return since, until, nil
+}
+
+// parseSelectorTime reads a time given as RFC3339 or as a date, which is taken as the start of that day in UTC
+func parseSelectorTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, nil
+	}
+	return time.Parse(dateLayout, value)
+}
+
+// listDeadLetters reports the abandoned files chosen by the command line arguments
+func (linkClient *linkClient) listDeadLetters() string {
+	matches, err := linkClient.configuration.selector.matcher()
+	if err != nil {
+		linkClient.exitCode = 1
+		return err.Error()
+	}
+	letters, err := linkClient.fileTransferRecorder.deadLetters(matches)
+	if err != nil {
+		linkClient.exitCode = 1
+		return err.Error()
+	}
+	if len(letters) == 0 {
+		return "there are no abandoned files\n"
+	}
+
+	var buffer bytes.Buffer
+	writer := tabwriter.NewWriter(&buffer, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ABANDONED\tATTEMPTS\tTARGET\tPATH\tREASON")
+	for _, letter := range letters {
+		failure := letter.failure
+		fmt.Fprintf(writer, "%s\t%d\t%s\t%s\t%s\n", failure.Time.Format(time.RFC3339), failure.Attempts, failure.Target,
+			failure.Path, strings.Replace(truncate(failure.Reason, maxHookOutputLength), "\n", " ", -1))
+	}
+	writer.Flush()
+	return buffer.String()
+}
+
+// requeue releases the abandoned files chosen by the command line arguments, they are tried again with a new attempt
+// budget the next time they are found
+func (linkClient *linkClient) requeue() string {
+	if linkClient.configuration.selector.isEmpty() {
+		linkClient.exitCode = 1
+		return "choose the files to requeue with -path, -pattern, -t, -since or -until, or use -all to requeue every abandoned file"
+	}
+	matches, err := linkClient.configuration.selector.matcher()
+	if err != nil {
+		linkClient.exitCode = 1
+		return err.Error()
+	}
+	letters, err := linkClient.fileTransferRecorder.deadLetters(matches)
+	if err != nil {
+		linkClient.exitCode = 1
+		return err.Error()
+	}
+
+	var buffer bytes.Buffer
+	released := 0
+	for _, letter := range letters {
+		err := linkClient.requeueLetter(letter)
+		if err != nil {
+			linkClient.exitCode = 1
+			buffer.WriteString("ERROR: " + letter.failure.Path + ": " + err.Error() + "\n")
+			continue
+		}
+		buffer.WriteString("requeued " + letter.failure.Path + "\n")
+		released++
+	}
+	buffer.WriteString(fmt.Sprintf("%d abandoned files requeued\n", released))
+	return buffer.String()
+}
+
+// requeueLetter releases the abandoned file so that it is tried again with a new attempt budget the next time it is found
+func (linkClient *linkClient) requeueLetter(letter deadLetter) error {
+	err := linkClient.fileTransferRecorder.store.deleteFailure(letter.record)
+	if err != nil {
+		return err
+	}
+	linkClient.statusRecorder.recordStatus(systemName, fileUploadOpp, requeuedStatus, letter.record, letter.failure.Path)
+	return nil
+}
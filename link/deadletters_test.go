@@ -0,0 +1,149 @@
+package link
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultMaxAttempts(tests *testing.T) {
+	configuration := Configuration{}
+	target := Target{Name: "t1"}
+	if configuration.maxAttempts(&target) != defaultMaxAttempts {
+		tests.Fatal("files not abandoned by default")
+	}
+	configuration.MaxAttempts = unlimitedAttempts
+	if configuration.maxAttempts(&target) != 0 {
+		tests.Fatal("global -1 does not remove the limit")
+	}
+	target.MaxAttempts = 3
+	if configuration.maxAttempts(&target) != 3 {
+		tests.Fatal("target attempts not used")
+	}
+	configuration = Configuration{MaxAttempts: 3, Targets: []Target{{Name: "t1", MaxAttempts: unlimitedAttempts}}}
+	if configuration.maxAttempts(&configuration.Targets[0]) != 0 {
+		tests.Fatal("target -1 does not remove the limit")
+	}
+	if configuration.compile() != nil {
+		tests.Fatal("-1 attempts rejected")
+	}
+	configuration.MaxAttempts = -2
+	if configuration.compile() == nil {
+		tests.Fatal("attempts below -1 accepted")
+	}
+}
+
+func TestFileAbandonedAfterMaxAttempts(tests *testing.T) {
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+	client := linkClient{currentContext: currentContext, statusRecorder: createStatusRecorder(currentContext), fileTransferRecorder: createFileTransferRecorder()}
+	client.configuration.MaxAttempts = 5
+	target := Target{Name: "t1", MaxAttempts: 2}
+	found := foundFile{uri: "/in/bad.zip", hash: "deadface", target: &target}
+
+	client.recordFailure(found, "uid1", errors.New("rejected"))
+	if client.fileTransferRecorder.isAbandoned("uid1") {
+		tests.Fatal("file abandoned before its attempts were spent")
+	}
+	client.recordFailure(found, "uid1", errors.New("rejected again"))
+	if !client.fileTransferRecorder.isAbandoned("uid1") {
+		tests.Fatal("file not abandoned after the target's maximum attempts")
+	}
+	letters, _ := client.fileTransferRecorder.deadLetters(func(string, string, time.Time) bool { return true })
+	if len(letters) != 1 || letters[0].failure.Attempts != 2 || letters[0].failure.Reason != "rejected again" {
+		tests.Fatal("abandoned file not listed as expected ", letters)
+	}
+
+	client.recordFailure(found, "uid2", errors.New("rejected"))
+	client.fileTransferRecorder.clearFailure("uid2")
+	if _, exists := client.fileTransferRecorder.store.failure("uid2"); exists {
+		tests.Fatal("failures kept after the file was uploaded")
+	}
+
+	cancelFunction()
+	client.recordFailure(found, "uid3", errors.New("stopping"))
+	if _, exists := client.fileTransferRecorder.store.failure("uid3"); exists {
+		tests.Fatal("attempt cut short by stopping counted")
+	}
+}
+
+func TestDeadLetterSelector(tests *testing.T) {
+	failure := failureRecord{Path: "/in/a/bad.zip", Target: "t1", Time: time.Date(2020, 3, 2, 10, 0, 0, 0, time.UTC), Abandoned: true}
+	selectors := []struct {
+		selector commandSelector
+		matches  bool
+	}{
+		{commandSelector{}, true},
+		{commandSelector{path: "/in/a/bad.zip"}, true},
+		{commandSelector{path: "/in/a/good.zip"}, false},
+		{commandSelector{pattern: "*.zip"}, true},
+		{commandSelector{pattern: "/in/a/*"}, true},
+		{commandSelector{pattern: "*.txt"}, false},
+		{commandSelector{targets: []string{"t2", "t1"}}, true},
+		{commandSelector{targets: []string{"t2"}}, false},
+		{commandSelector{since: "2020-03-02"}, true},
+		{commandSelector{since: "2020-03-02T11:00:00Z"}, false},
+		{commandSelector{until: "2020-03-03"}, true},
+		{commandSelector{since: "2020-03-01", until: "2020-03-02T10:00:00Z"}, false},
+	}
+	for _, test := range selectors {
+		matches, err := test.selector.matcher()
+		if err != nil {
+			tests.Fatal(err)
+		}
+		if matches(failure.Path, failure.Target, failure.Time) != test.matches {
+			tests.Fatal("selector did not match as expected ", test.selector)
+		}
+	}
+
+	if _, err := (commandSelector{since: "yesterday"}).matcher(); err == nil {
+		tests.Fatal("invalid time accepted")
+	}
+	if _, err := (commandSelector{pattern: "["}).matcher(); err == nil {
+		tests.Fatal("invalid pattern accepted")
+	}
+}
+
+func TestRequeue(tests *testing.T) {
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+	client := linkClient{currentContext: currentContext, statusRecorder: createStatusRecorder(currentContext), fileTransferRecorder: createFileTransferRecorder()}
+	client.fileTransferRecorder.store.putFailure("uid1", failureRecord{Path: "/in/one.zip", Target: "t1", Abandoned: true})
+	client.fileTransferRecorder.store.putFailure("uid2", failureRecord{Path: "/in/two.zip", Target: "t2", Abandoned: true})
+
+	client.requeue()
+	if client.exitCode != 1 || !client.fileTransferRecorder.isAbandoned("uid1") {
+		tests.Fatal("files requeued without being chosen")
+	}
+
+	client.exitCode = 0
+	client.configuration.getConfigurationFromArgs([]string{"-c:Requeue", "-u:client", "-t:t2"})
+	result := client.requeue()
+	if client.exitCode != 0 || !strings.Contains(result, "requeued /in/two.zip") {
+		tests.Fatal("chosen file not requeued ", result)
+	}
+	if client.fileTransferRecorder.isAbandoned("uid2") || !client.fileTransferRecorder.isAbandoned("uid1") {
+		tests.Fatal("requeue released the wrong files")
+	}
+	client.configuration.selector = commandSelector{}
+	if !strings.Contains(client.listDeadLetters(), "/in/one.zip") {
+		tests.Fatal("remaining abandoned file not listed")
+	}
+}
+
+func TestAbandonedFilesRebuilt(tests *testing.T) {
+	recorder := createFileTransferRecorder()
+	recorder.store.putFailure("uid1", failureRecord{Path: "/in/one.zip", Attempts: 3, Abandoned: true})
+	recorder.store.putFailure("uid2", failureRecord{Path: "/in/two.zip", Attempts: 1})
+
+	var entries []StatusRecordEntry
+	recorder.snapshot(func(entry StatusRecordEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if len(entries) != 1 || entries[0].Status != abandonedStatus || entries[0].ContextID != "uid1" {
+		tests.Fatal("snapshot does not hold just the abandoned file ", entries)
+	}
+}
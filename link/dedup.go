@@ -0,0 +1,81 @@
+package link
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Deduplication policies deciding when two found files are the same upload
+const (
+	dedupPathHash = "pathhash"
+	dedupHash     = "hash"
+	dedupPath     = "path"
+)
+
+func validateDedupPolicy(policy string) error {
+	switch strings.ToLower(policy) {
+	case "", dedupPathHash, dedupHash, dedupPath:
+		return nil
+	}
+	return fmt.Errorf("unrecognised deduplication policy %q", policy)
+}
+
+// dedupPolicy gives the deduplication policy of the target, the global policy is used when the target has none
+func (configuration *Configuration) dedupPolicy(target *Target) string {
+	policy := target.DedupPolicy
+	if policy == "" {
+		policy = configuration.DedupPolicy
+	}
+	if policy == "" {
+		return dedupPathHash
+	}
+	return strings.ToLower(policy)
+}
+
+// uid gives the key used to record the upload of a found file, files with the same key are only uploaded once
+func (configuration *Configuration) uid(foundFile foundFile) string {
+	switch configuration.dedupPolicy(foundFile.target) {
+	case dedupHash:
+		return foundFile.hash + "~tenant:" + foundFile.target.Tenant
+	case dedupPath:
+		return "~" + foundFile.uri
+	}
+	return foundFile.hash + "~" + foundFile.uri
+}
+
+// checkDedupPolicies records a warning for each target whose deduplication policy is not the one its uploads were
+// recorded with. Uploads are recorded under a key made by the policy, so after a change the files the target already
+// uploaded are treated as new and uploaded again, and their failed and abandoned records no longer apply
+func (linkClient *linkClient) checkDedupPolicies() {
+	store := linkClient.fileTransferRecorder.store
+	if store == nil {
+		return
+	}
+	policies := store.dedupPolicies()
+	changed := false
+	for index := range linkClient.configuration.Targets {
+		target := &linkClient.configuration.Targets[index]
+		policy := linkClient.configuration.dedupPolicy(target)
+		recorded, exists := policies[target.Name]
+		if exists && recorded != policy {
+			linkClient.statusRecorder.recordStatus(systemName, operationLoadConfig, warningStatus, "",
+				fmt.Sprintf("the deduplication policy of target %v changed from %v to %v, the files it already uploaded will be uploaded again",
+					target.Name, recorded, policy))
+		}
+		if recorded != policy {
+			policies[target.Name] = policy
+			changed = true
+		}
+	}
+	if changed {
+		linkClient.recordStateError("", store.putDedupPolicies(policies))
+	}
+}
+
+// skippedComments gives the comments recorded when a found file is not uploaded, pointing to the upload it duplicates
+func skippedComments(foundFile foundFile) string {
+	if foundFile.progress.Complete && foundFile.progress.Reference != "" {
+		return foundFile.uri + " duplicate of " + foundFile.progress.Reference
+	}
+	return foundFile.uri
+}
@@ -0,0 +1,107 @@
+package link
+
+import (
+	"context"
+	"github.com/GeneralElectric/TrueConnect-Link/trueconnect"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedupPolicies(tests *testing.T) {
+	configuration := Configuration{}
+	target := Target{Tenant: "tenant1"}
+	first := foundFile{uri: "/in/a/file.zip", hash: "deadface", target: &target}
+	copied := foundFile{uri: "/in/b/file.zip", hash: "deadface", target: &target}
+	changed := foundFile{uri: "/in/a/file.zip", hash: "beefcafe", target: &target}
+
+	if configuration.uid(first) == configuration.uid(copied) || configuration.uid(first) == configuration.uid(changed) {
+		tests.Fatal("default policy must use the path and the hash")
+	}
+
+	configuration.DedupPolicy = "hash"
+	if configuration.uid(first) != configuration.uid(copied) || configuration.uid(first) == configuration.uid(changed) {
+		tests.Fatal("hash policy must only use the hash")
+	}
+	otherTenant := Target{Tenant: "tenant2"}
+	if configuration.uid(first) == configuration.uid(foundFile{uri: "/in/a/file.zip", hash: "deadface", target: &otherTenant}) {
+		tests.Fatal("hash policy must keep tenants apart")
+	}
+
+	target.DedupPolicy = "Path"
+	if configuration.uid(first) == configuration.uid(copied) || configuration.uid(first) != configuration.uid(changed) {
+		tests.Fatal("target path policy must override the global policy")
+	}
+}
+
+func TestDuplicateRecorded(tests *testing.T) {
+	configuration := Configuration{DedupPolicy: "hash"}
+	target := Target{Tenant: "tenant1"}
+	recorder := createFileTransferRecorder()
+	first := foundFile{uri: "/in/a/file.zip", hash: "deadface", target: &target}
+	copied := foundFile{uri: "/in/b/file.zip", hash: "deadface", target: &target}
+
+	if _, isOk, _ := recorder.startRecord(configuration.uid(first), first.progress); !isOk {
+		tests.Fatal("could not start the first upload")
+	}
+	recorder.stopRecord(configuration.uid(first), trueconnect.UploadProgress{Complete: true, Reference: "ref1"})
+
+	var isOk bool
+	copied.progress, isOk, _ = recorder.startRecord(configuration.uid(copied), copied.progress)
+	if isOk {
+		tests.Fatal("copy of an uploaded file started")
+	}
+	if skippedComments(copied) != "/in/b/file.zip duplicate of ref1" {
+		tests.Fatal("duplicate does not point to the original upload ", skippedComments(copied))
+	}
+}
+
+func TestInvalidDedupPolicyRejected(tests *testing.T) {
+	configuration := Configuration{DedupPolicy: "name"}
+	if configuration.compile() == nil {
+		tests.Fatal("invalid global policy accepted")
+	}
+	configuration = Configuration{Targets: []Target{{Name: "test", DedupPolicy: "name"}}}
+	if configuration.compile() == nil {
+		tests.Fatal("invalid target policy accepted")
+	}
+}
+
+func TestDedupPolicyChangeRecorded(tests *testing.T) {
+	defer os.Remove("TestDedupPolicyChangeRecorded.csv")
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	recorder, err := createFileStatusRecorder(currentContext, "TestDedupPolicyChangeRecorded.csv")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	recorder.configure(StatusLogConfig{Sync: "always"}, nil)
+	client := linkClient{currentContext: currentContext, statusRecorder: recorder, fileTransferRecorder: createFileTransferRecorder()}
+	client.configuration.Targets = []Target{{Name: "first"}, {Name: "second", DedupPolicy: "hash"}}
+
+	client.checkDedupPolicies()
+	if policies := client.fileTransferRecorder.store.dedupPolicies(); policies["first"] != dedupPathHash || policies["second"] != dedupHash {
+		tests.Fatal("policies not stored ", policies)
+	}
+	client.configuration.DedupPolicy = "path"
+	client.checkDedupPolicies()
+	if policies := client.fileTransferRecorder.store.dedupPolicies(); policies["first"] != dedupPath || policies["second"] != dedupHash {
+		tests.Fatal("changed policy not stored ", policies)
+	}
+	cancelFunction()
+	time.Sleep(time.Millisecond * 200)
+
+	var warnings []StatusRecordEntry
+	_, err = readStatusLog("TestDedupPolicyChangeRecorded.csv", func(entry StatusRecordEntry) bool {
+		if entry.Operation == operationLoadConfig && entry.Status == warningStatus {
+			warnings = append(warnings, entry)
+		}
+		return true
+	})
+	if err != nil {
+		tests.Fatal(err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Comments, "target first changed from pathhash to path") {
+		tests.Fatal("policy change not recorded once ", warnings)
+	}
+}
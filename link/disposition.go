@@ -0,0 +1,165 @@
+package link
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Disposition actions and the operation used to record them
+const (
+	dispositionMove      = "move"
+	dispositionRename    = "rename"
+	dispositionDelete    = "delete"
+	dispositionReceipt   = "receipt"
+	dispositionOperation = "FileDisposition"
+	defaultRenameSuffix  = ".uploaded"
+)
+
+func (disposition *DispositionConfig) validate() error {
+	switch strings.ToLower(disposition.Action) {
+	case dispositionMove:
+		if disposition.ArchiveDir == "" {
+			return fmt.Errorf("the move disposition needs an archive directory")
+		}
+		return nil
+	case dispositionRename, dispositionDelete, dispositionReceipt:
+		return nil
+	}
+	return fmt.Errorf("unrecognised disposition action %q", disposition.Action)
+}
+
+func (disposition *DispositionConfig) suffix() string {
+	if disposition.Suffix == "" {
+		return defaultRenameSuffix
+	}
+	return disposition.Suffix
+}
+
+// excludedSuffix gives the suffix of the files left behind by the disposition that must not be uploaded
+func (disposition *DispositionConfig) excludedSuffix() string {
+	if strings.ToLower(disposition.Action) == dispositionRename {
+		return disposition.suffix()
+	}
+	return ""
+}
+
+// isArchive returns true when the directory is the archive directory files are moved to
+func (disposition *DispositionConfig) isArchive(directory string) bool {
+	if strings.ToLower(disposition.Action) != dispositionMove {
+		return false
+	}
+	archive, err := filepath.Abs(disposition.ArchiveDir)
+	if err != nil {
+		return false
+	}
+	current, err := filepath.Abs(directory)
+	return err == nil && archive == current
+}
+
+// dispose carries out the target disposition of an uploaded file, every step can be repeated so a disposition
+// interrupted by a crash is completed the next time the file is found
+func (linkClient *linkClient) dispose(foundFile foundFile, uid string) {
+	disposition := foundFile.target.Disposition
+	action := strings.ToLower(disposition.Action)
+	if action == dispositionReceipt {
+		// the file stays where it is, its disposition is done once its receipt has been written
+		if !foundFile.target.receiptMissing(foundFile.uri) {
+			return
+		}
+		if linkClient.writeReceipt(foundFile, uid) != nil {
+			return
+		}
+	}
+
+	linkClient.statusRecorder.recordStatus(systemName, dispositionOperation, startedStatus, uid, action+": "+foundFile.uri)
+	destination, err := foundFile.target.disposeFile(foundFile)
+	if err != nil {
+		linkClient.statusRecorder.recordStatus(systemName, dispositionOperation, failedStatus, uid, err.Error())
+		return
+	}
+	linkClient.statusRecorder.recordStatus(systemName, dispositionOperation, uploadSuccess, uid, destination)
+}
+
+// disposeFile carries out the disposition on the file and then its sidecar, giving the resulting path where there is
+// one. The sidecar is dealt with last so a file that still needs its sidecar is never left without it
+func (target *Target) disposeFile(foundFile foundFile) (string, error) {
+	disposition := target.Disposition
+	var destination string
+	var sidecarDestination string
+	var err error
+	switch strings.ToLower(disposition.Action) {
+	case dispositionMove:
+		destination = filepath.Join(disposition.ArchiveDir, filepath.FromSlash(target.relativePath(foundFile.uri)))
+		sidecarDestination = filepath.Join(filepath.Dir(destination), filepath.Base(foundFile.sidecar))
+		err = moveFile(foundFile.uri, destination)
+		if err == nil && foundFile.sidecar != "" {
+			err = moveFile(foundFile.sidecar, sidecarDestination)
+		}
+	case dispositionRename:
+		destination = foundFile.uri + disposition.suffix()
+		err = renameFile(foundFile.uri, destination)
+		if err == nil && foundFile.sidecar != "" {
+			err = renameFile(foundFile.sidecar, foundFile.sidecar+disposition.suffix())
+		}
+	case dispositionDelete:
+		err = removeFile(foundFile.uri)
+		if err == nil && foundFile.sidecar != "" {
+			err = removeFile(foundFile.sidecar)
+		}
+	case dispositionReceipt:
+		// the file is left where it is with the receipt written before it was disposed of
+		destination = target.receiptPath(foundFile.uri)
+	default:
+		err = fmt.Errorf("unrecognised disposition action %q", disposition.Action)
+	}
+	return destination, err
+}
+
+// moveFile moves the file to the destination, copying it when the destination is on another volume. The source is
+// only removed once the destination is complete and on disk
+func moveFile(source string, destination string) error {
+	if _, err := os.Stat(source); os.IsNotExist(err) {
+		if _, err := os.Stat(destination); err == nil {
+			// already moved
+			return nil
+		}
+	}
+
+	err := os.MkdirAll(filepath.Dir(destination), 0775)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(source, destination)
+	if err == nil {
+		return nil
+	}
+
+	// the rename fails when the destination is on another volume
+	err = copyFileDurably(source, destination)
+	if err != nil {
+		return err
+	}
+	return os.Remove(source)
+}
+
+func renameFile(source string, destination string) error {
+	err := os.Rename(source, destination)
+	if os.IsNotExist(err) {
+		if _, statErr := os.Stat(destination); statErr == nil {
+			// already renamed
+			return nil
+		}
+	}
+	return err
+}
+
+func removeFile(fileName string) error {
+	err := os.Remove(fileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
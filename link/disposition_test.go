@@ -0,0 +1,118 @@
+package link
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/GeneralElectric/TrueConnect-Link/trueconnect"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMoveDispositionKeepsRelativePath(tests *testing.T) {
+	testfile, err := CreateTestFile("./TestMoveDisposition/in/sub/testfile1.abc")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	defer os.RemoveAll("./TestMoveDisposition")
+
+	archive, _ := filepath.Abs("./TestMoveDisposition/archive")
+	location, _ := filepath.Abs("./TestMoveDisposition/in")
+	target := Target{Location: location, Disposition: &DispositionConfig{Action: "move", ArchiveDir: archive}}
+	destination, err := target.disposeFile(foundFile{uri: testfile, target: &target})
+	if err != nil {
+		tests.Fatal(err)
+	}
+	if destination != filepath.Join(archive, "sub", "testfile1.abc") {
+		tests.Fatal("unexpected destination " + destination)
+	}
+	if _, err := os.Stat(destination); err != nil {
+		tests.Fatal("file not moved to archive")
+	}
+	if _, err := os.Stat(testfile); !os.IsNotExist(err) {
+		tests.Fatal("file not removed after move")
+	}
+
+	// repeating an interrupted disposition must succeed
+	if _, err = target.disposeFile(foundFile{uri: testfile, target: &target}); err != nil {
+		tests.Fatal(err)
+	}
+}
+
+func TestRenameAndDeleteDisposition(tests *testing.T) {
+	testfile, err := CreateTestFile("./TestRenameAndDeleteDisposition/testfile1.abc")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	defer os.RemoveAll("./TestRenameAndDeleteDisposition")
+
+	target := Target{Disposition: &DispositionConfig{Action: "rename", Suffix: ".done"}}
+	if _, err = target.disposeFile(foundFile{uri: testfile, target: &target}); err != nil {
+		tests.Fatal(err)
+	}
+	if _, err := os.Stat(testfile + ".done"); err != nil {
+		tests.Fatal("file not renamed")
+	}
+	if _, err = target.disposeFile(foundFile{uri: testfile, target: &target}); err != nil {
+		tests.Fatal(err)
+	}
+
+	target = Target{Disposition: &DispositionConfig{Action: "delete"}}
+	if _, err = target.disposeFile(foundFile{uri: testfile + ".done", target: &target}); err != nil {
+		tests.Fatal(err)
+	}
+	if _, err := os.Stat(testfile + ".done"); !os.IsNotExist(err) {
+		tests.Fatal("file not deleted")
+	}
+	if _, err = target.disposeFile(foundFile{uri: testfile + ".done", target: &target}); err != nil {
+		tests.Fatal(err)
+	}
+}
+
+func TestReceiptDisposition(tests *testing.T) {
+	testfile, err := CreateTestFile("./TestReceiptDisposition/testfile1.abc")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	defer os.RemoveAll("./TestReceiptDisposition")
+
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+	client := linkClient{currentContext: currentContext, statusRecorder: createStatusRecorder(currentContext)}
+	target := Target{Disposition: &DispositionConfig{Action: "receipt"}}
+	client.dispose(foundFile{uri: testfile, hash: "deadface", target: &target, progress: trueconnect.UploadProgress{Reference: "ref1", Complete: true}}, "uid")
+
+	data, err := ioutil.ReadFile(testfile + defaultReceiptSuffix)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	var receipt uploadReceipt
+	if err = json.Unmarshal(data, &receipt); err != nil {
+		tests.Fatal(err)
+	}
+	if receipt.DataStoreRef != "ref1" || receipt.Hashes[sha256Hash] != "deadface" || time.Since(receipt.Uploaded) > time.Minute {
+		tests.Fatal("receipt content not as expected ", receipt)
+	}
+
+	if err = target.compile(); err != nil {
+		tests.Fatal(err)
+	}
+	if target.accepts(testfile+defaultReceiptSuffix, testFileInfo{size: 10}, time.Now()) {
+		tests.Fatal("receipt accepted for upload")
+	}
+}
+
+func TestInvalidDispositionsRejected(tests *testing.T) {
+	invalid := []DispositionConfig{
+		{},
+		{Action: "move"},
+		{Action: "shred"},
+	}
+	for _, disposition := range invalid {
+		if disposition.validate() == nil {
+			tests.Fatal("invalid disposition accepted ", disposition)
+		}
+	}
+}
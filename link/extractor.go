@@ -0,0 +1,142 @@
+package link
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Extractor failure handling and the operation used to record extractions
+const (
+	extractorHold           = "hold"
+	extractorUpload         = "upload"
+	extractionOperation     = "MetadataExtraction"
+	heldStatus              = "Held"
+	defaultExtractorTimeout = 60
+)
+
+// Extractor is a function that reads metadata values from the content of the file at filePath, it must return when the
+// context is done
+type Extractor func(ctx context.Context, filePath string) (map[string]string, error)
+
+var (
+	extractors      = make(map[string]Extractor)
+	extractorsMutex = &sync.Mutex{}
+)
+
+// RegisterExtractor makes an extractor available to targets configured with its name, it should be called before the
+// client is started
+func RegisterExtractor(name string, extractor Extractor) {
+	extractorsMutex.Lock()
+	defer extractorsMutex.Unlock()
+	extractors[name] = extractor
+}
+
+func registeredExtractor(name string) (Extractor, bool) {
+	extractorsMutex.Lock()
+	defer extractorsMutex.Unlock()
+	extractor, exists := extractors[name]
+	return extractor, exists
+}
+
+func (config *ExtractorConfig) validate() error {
+	if (config.Command == "") == (config.Name == "") {
+		return fmt.Errorf("an extractor needs either a command or a name")
+	}
+	if config.Name != "" {
+		if _, exists := registeredExtractor(config.Name); !exists {
+			return fmt.Errorf("no extractor registered with the name %q", config.Name)
+		}
+	}
+	switch strings.ToLower(config.OnFailure) {
+	case "", extractorHold, extractorUpload:
+		return nil
+	}
+	return fmt.Errorf("unrecognised extractor failure action %q", config.OnFailure)
+}
+
+func (config *ExtractorConfig) holdOnFailure() bool {
+	return strings.ToLower(config.OnFailure) != extractorUpload
+}
+
+// extract runs the extractor for the file and gives the metadata values it found
+func (config *ExtractorConfig) extract(ctx context.Context, filePath string) (map[string]string, error) {
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultExtractorTimeout
+	}
+	timeoutContext, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	if config.Name != "" {
+		extractor, exists := registeredExtractor(config.Name)
+		if !exists {
+			return nil, fmt.Errorf("no extractor registered with the name %q", config.Name)
+		}
+		return extractor(timeoutContext, filePath)
+	}
+
+	var stdout, stderr bytes.Buffer
+	args := append(append([]string{}, config.Args...), filePath)
+	cmd := exec.CommandContext(timeoutContext, config.Command, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if timeoutContext.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("extractor timed out after %d seconds", timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var output map[string]interface{}
+	decoder := json.NewDecoder(&stdout)
+	decoder.UseNumber()
+	err = decoder.Decode(&output)
+	if err != nil {
+		return nil, fmt.Errorf("extractor output is not a JSON object: %v", err)
+	}
+
+	values := make(map[string]string)
+	for key, value := range output {
+		if text, isScalar := jsonScalar(value); isScalar {
+			values[key] = text
+		} else if value != nil {
+			encoded, _ := json.Marshal(value)
+			values[key] = string(encoded)
+		}
+	}
+	return values, nil
+}
+
+// extractMetadata runs the extractor of the found file's target and adds the values it finds to those extracted for the
+// file, false is returned when the extractor failed and the file should be held back
+func (linkClient *linkClient) extractMetadata(foundFile *foundFile, uid string) bool {
+	if foundFile.contentExtracted {
+		return true
+	}
+	extractor := foundFile.target.Extractor
+	values, err := extractor.extract(linkClient.currentContext, foundFile.uri)
+	if err != nil {
+		linkClient.statusRecorder.recordStatus(systemName, extractionOperation, failedStatus, uid, err.Error())
+		return !extractor.holdOnFailure()
+	}
+
+	if dropped := dropReserved(values); len(dropped) > 0 {
+		linkClient.statusRecorder.recordStatus(systemName, extractionOperation, warningStatus, uid,
+			foundFile.uri+": ignored reserved metadata "+strings.Join(dropped, ", "))
+	}
+	if foundFile.extracted == nil {
+		foundFile.extracted = make(map[string]string)
+	}
+	for tag, value := range values {
+		foundFile.extracted[tag] = value
+	}
+	foundFile.contentExtracted = true
+	return true
+}
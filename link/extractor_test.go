@@ -0,0 +1,134 @@
+package link
+
+import (
+	"context"
+	"fmt"
+	"github.com/GeneralElectric/TrueConnect-Link/trueconnect"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestRegisteredExtractor(tests *testing.T) {
+	RegisterExtractor("TestRegisteredExtractor", func(ctx context.Context, filePath string) (map[string]string, error) {
+		return map[string]string{"ESN": "956123", "path": filePath}, nil
+	})
+
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+	client := linkClient{currentContext: currentContext, statusRecorder: createStatusRecorder(currentContext)}
+	target := Target{Extractor: &ExtractorConfig{Name: "TestRegisteredExtractor"}}
+	if target.compile() != nil {
+		tests.Fatal("registered extractor not accepted")
+	}
+
+	found := foundFile{uri: "/data/file.FFD", target: &target}
+	if !client.extractMetadata(&found, "uid") {
+		tests.Fatal("extractor failed")
+	}
+	metadata := found.getMetadata()
+	if metadata["ESN"].Value != "956123" || metadata["path"].Value != "/data/file.FFD" {
+		tests.Fatal("extracted values not added to metadata")
+	}
+}
+
+func TestExtractorCannotOverrideReservedMetadata(tests *testing.T) {
+	defer os.Remove("TestExtractorCannotOverrideReservedMetadata.csv")
+	RegisterExtractor("TestExtractorCannotOverrideReservedMetadata", func(ctx context.Context, filePath string) (map[string]string, error) {
+		return map[string]string{"tenant_id": "forged", "sha_256": "forged", "ESN": "956123"}, nil
+	})
+
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	recorder, err := createFileStatusRecorder(currentContext, "TestExtractorCannotOverrideReservedMetadata.csv")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	recorder.configure(StatusLogConfig{Sync: "always"}, nil)
+	client := linkClient{currentContext: currentContext, statusRecorder: recorder}
+	target := Target{Tenant: "tenant1", Extractor: &ExtractorConfig{Name: "TestExtractorCannotOverrideReservedMetadata"}}
+	found := foundFile{uri: "/data/file.FFD", hash: "deadface", target: &target}
+	if !client.extractMetadata(&found, "uid") {
+		tests.Fatal("extractor failed")
+	}
+	metadata := found.getMetadata()
+	if metadata[trueconnect.TenantID] != (trueconnect.MetadataValue{Value: "tenant1", Immutable: true}) ||
+		metadata[sha256Hash] != (trueconnect.MetadataValue{Value: "deadface", Immutable: true}) || metadata["ESN"].Value != "956123" {
+		tests.Fatal("extractor overrode reserved metadata ", metadata)
+	}
+	cancelFunction()
+	time.Sleep(time.Millisecond * 200)
+
+	var warnings []StatusRecordEntry
+	_, err = readStatusLog("TestExtractorCannotOverrideReservedMetadata.csv", func(entry StatusRecordEntry) bool {
+		if entry.Operation == extractionOperation && entry.Status == warningStatus {
+			warnings = append(warnings, entry)
+		}
+		return true
+	})
+	if err != nil {
+		tests.Fatal(err)
+	}
+	if len(warnings) != 1 || warnings[0].Comments != "/data/file.FFD: ignored reserved metadata sha_256, tenant_id" {
+		tests.Fatal("dropped metadata not recorded ", warnings)
+	}
+}
+
+func TestFailedExtractorHoldsFile(tests *testing.T) {
+	RegisterExtractor("TestFailedExtractorHoldsFile", func(ctx context.Context, filePath string) (map[string]string, error) {
+		return nil, fmt.Errorf("cannot parse")
+	})
+
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+	client := linkClient{currentContext: currentContext, statusRecorder: createStatusRecorder(currentContext)}
+
+	found := foundFile{uri: "/data/file.FFD", target: &Target{Extractor: &ExtractorConfig{Name: "TestFailedExtractorHoldsFile"}}}
+	if client.extractMetadata(&found, "uid") {
+		tests.Fatal("file not held after extractor failed")
+	}
+
+	found = foundFile{uri: "/data/file.FFD", target: &Target{Extractor: &ExtractorConfig{Name: "TestFailedExtractorHoldsFile", OnFailure: "upload"}}}
+	if !client.extractMetadata(&found, "uid") {
+		tests.Fatal("file held after extractor failed when configured to upload")
+	}
+}
+
+func TestCommandExtractor(tests *testing.T) {
+	if runtime.GOOS == "windows" {
+		tests.Skip("unix test")
+	}
+
+	extractor := ExtractorConfig{Command: "sh", Args: []string{"-c", `echo "{\"file\": \"$0\", \"phases\": [1, 2]}"`}}
+	values, err := extractor.extract(context.Background(), "/data/file.FFD")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	if values["file"] != "/data/file.FFD" || values["phases"] != "[1,2]" {
+		tests.Fatal("command output not read ", values)
+	}
+
+	extractor = ExtractorConfig{Command: "sh", Args: []string{"-c", "exec sleep 5"}, Timeout: 1}
+	if _, err = extractor.extract(context.Background(), "/data/file.FFD"); err == nil {
+		tests.Fatal("extractor did not time out")
+	}
+
+	extractor = ExtractorConfig{Command: "sh", Args: []string{"-c", "echo not json"}}
+	if _, err = extractor.extract(context.Background(), "/data/file.FFD"); err == nil {
+		tests.Fatal("invalid extractor output accepted")
+	}
+}
+
+func TestInvalidExtractorsRejected(tests *testing.T) {
+	invalid := []ExtractorConfig{
+		{},
+		{Command: "parse", Name: "parser"},
+		{Name: "TestInvalidExtractorsRejected"},
+		{Command: "parse", OnFailure: "retry"},
+	}
+	for _, extractor := range invalid {
+		if extractor.validate() == nil {
+			tests.Fatal("invalid extractor accepted ", extractor)
+		}
+	}
+}
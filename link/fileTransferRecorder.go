@@ -1,113 +1,203 @@
 package link
 
 import (
-	"encoding/csv"
 	"encoding/json"
 	"github.com/GeneralElectric/TrueConnect-Link/trueconnect"
-	"io"
 	"os"
 	"sync"
 )
 
+// fileTransferRecorder keeps the uploads currently in progress, the progress of all other uploads is held in its state
+// store
 type fileTransferRecorder struct {
-	records                 map[string]liveUploadProgress
+	store                   stateStore
+	inProgress              map[string]trueconnect.UploadProgress
 	fileTransferRecordMutex *sync.Mutex
+	// the records of the status log that could not be read when the state was migrated from it
+	skippedRecords []int
 }
 
-type liveUploadProgress struct {
-	progress   *trueconnect.UploadProgress
-	inProgress bool
+func createFileTransferRecorder() fileTransferRecorder {
+	return createFileTransferRecorderWithStore(newMemoryStateStore())
 }
 
-func createFileTransferRecorder() fileTransferRecorder {
+func createFileTransferRecorderWithStore(store stateStore) fileTransferRecorder {
 	recorder := fileTransferRecorder{}
 	recorder.fileTransferRecordMutex = &sync.Mutex{}
-	recorder.records = make(map[string]liveUploadProgress)
+	recorder.inProgress = make(map[string]trueconnect.UploadProgress)
+	recorder.store = store
 	return recorder
 }
 
-func (recorder *fileTransferRecorder) buildFromStatusEntry(statusFileName string) error {
-	records := make(map[string]liveUploadProgress)
-	statusFile, err := os.Open(statusFileName)
+// openFileTransferRecorder opens the state file, on first use the state is migrated from the status log
+func openFileTransferRecorder(stateFileName string, statusFileName string) (fileTransferRecorder, error) {
+	store, err := openBoltStateStore(stateFileName)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return err
+		return fileTransferRecorder{}, err
 	}
-
-	defer statusFile.Close()
-	csvReader := csv.NewReader(statusFile)
-	for {
-		var line []string
-		line, err = csvReader.Read()
+	recorder := createFileTransferRecorderWithStore(store)
+	if !store.migrated() {
+		recorder.skippedRecords, err = recorder.replayStatusLog(statusFileName)
 		if err != nil {
-			if err != io.EOF {
-				return err
-			}
-			break
+			store.close()
+			return fileTransferRecorder{}, err
 		}
+	}
+	return recorder, nil
+}
 
-		statusEntry := StatusRecordEntryFromLine(line)
+func (recorder *fileTransferRecorder) close() error {
+	if recorder.store == nil {
+		return nil
+	}
+	return recorder.store.close()
+}
+
+// buildFromStatusEntry replays the status log into the state store
+func (recorder *fileTransferRecorder) buildFromStatusEntry(statusFileName string) error {
+	_, err := recorder.replayStatusLog(statusFileName)
+	return err
+}
+
+// replayStatusLog replays the status log into the state store, the numbers of the records that could not be read are
+// returned
+func (recorder *fileTransferRecorder) replayStatusLog(statusFileName string) ([]int, error) {
+	records := make(map[string]trueconnect.UploadProgress)
+	versions := make(map[string]fileVersion)
+	failures := make(map[string]failureRecord)
+	badRecords, err := readStatusLog(statusFileName, func(statusEntry StatusRecordEntry) bool {
 		if statusEntry.Operation == fileUploadOpp {
 			if statusEntry.Status == uploadSuccess {
-				records[statusEntry.ContextID] = liveUploadProgress{progress: &trueconnect.UploadProgress{Complete: true}}
+				records[statusEntry.ContextID] = trueconnect.UploadProgress{Complete: true, Reference: statusEntry.Comments}
 			}
 			if statusEntry.Status == partialStatus {
 				var progress trueconnect.UploadProgress
-				err := json.Unmarshal([]byte(statusEntry.Comments), &progress)
-				if err != nil {
-					return nil
+				if json.Unmarshal([]byte(statusEntry.Comments), &progress) != nil {
+					return false
+				}
+				records[statusEntry.ContextID] = progress
+			}
+			if statusEntry.Status == abandonedStatus {
+				var failure failureRecord
+				if json.Unmarshal([]byte(statusEntry.Comments), &failure) != nil {
+					return false
 				}
-				records[statusEntry.ContextID] = liveUploadProgress{progress: &progress}
+				failures[statusEntry.ContextID] = failure
+			}
+			if statusEntry.Status == requeuedStatus {
+				delete(failures, statusEntry.ContextID)
+			}
+		}
+		if statusEntry.Operation == forgetOperation && statusEntry.Status == forgottenStatus {
+			var audit auditEntry
+			if json.Unmarshal([]byte(statusEntry.Comments), &audit) != nil {
+				return false
+			}
+			delete(records, statusEntry.ContextID)
+			delete(failures, statusEntry.ContextID)
+			if version, exists := versions[audit.Path]; exists && version.Ref == audit.Ref {
+				delete(versions, audit.Path)
+			}
+		}
+		if statusEntry.Operation == versionOperation && statusEntry.Status == uploadSuccess {
+			var version fileVersion
+			if json.Unmarshal([]byte(statusEntry.Comments), &version) != nil {
+				return false
 			}
+			versions[version.Path] = version
 		}
+		return true
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
 	}
-	recorder.records = records
-	return nil
+	return badRecords, recorder.store.importState(records, versions, failures)
 }
 
-func (recorder *fileTransferRecorder) startRecord(record string, progress trueconnect.UploadProgress) (trueconnect.UploadProgress, bool) {
-	isOk := false
+// startRecord starts the upload of the record, false is returned when it is already uploaded or being uploaded. The
+// error is that of writing the state store
+func (recorder *fileTransferRecorder) startRecord(record string, progress trueconnect.UploadProgress) (trueconnect.UploadProgress, bool, error) {
 	recorder.fileTransferRecordMutex.Lock()
-	{
-		currentProg, exists := recorder.records[record]
-		if !exists {
-			recorder.records[record] = liveUploadProgress{progress: &progress, inProgress: !progress.Complete}
-			isOk = true
-		} else if !currentProg.inProgress && !currentProg.progress.Complete {
-			isOk = true
-			a := recorder.records[record]
-			a.inProgress = true
-			recorder.records[record] = a
+	defer recorder.fileTransferRecordMutex.Unlock()
+	if current, inProgress := recorder.inProgress[record]; inProgress {
+		return current, false, nil
+	}
+
+	current, exists := recorder.store.progress(record)
+	if !exists {
+		if progress.Complete {
+			// a file already known to be uploaded is recorded but not uploaded again
+			return progress, false, recorder.store.putProgress(record, progress)
 		}
+		recorder.inProgress[record] = progress
+		return progress, true, nil
 	}
-	recorder.fileTransferRecordMutex.Unlock()
-	return *recorder.records[record].progress, isOk
+	if current.Complete {
+		return current, false, nil
+	}
+	recorder.inProgress[record] = current
+	return current, true, nil
 }
 
-func (recorder *fileTransferRecorder) stopRecord(record string, progress trueconnect.UploadProgress) bool {
-	isIncommplete := false
+// stopRecord ends the upload of the record, keeping its progress in the state store. True is returned when the upload
+// is incomplete and can be resumed, the error is that of writing the state store
+func (recorder *fileTransferRecorder) stopRecord(record string, progress trueconnect.UploadProgress) (bool, error) {
 	recorder.fileTransferRecordMutex.Lock()
-	{
-		currentProg, exists := recorder.records[record]
-		if exists && currentProg.inProgress {
-			if progress.Reference == "" {
-				if currentProg.progress.Reference == "" {
-					delete(recorder.records, record)
-				}
-			} else {
-				if progress.Complete {
-					recorder.records[record] = liveUploadProgress{progress: &progress, inProgress: false}
-				} else if progress.FailedAttempts > 2 {
-					delete(recorder.records, record)
-				} else {
-					isIncommplete = true
-					recorder.records[record] = liveUploadProgress{progress: &progress, inProgress: false}
-				}
-			}
+	defer recorder.fileTransferRecordMutex.Unlock()
+	if _, inProgress := recorder.inProgress[record]; !inProgress {
+		return false, nil
+	}
+	delete(recorder.inProgress, record)
+
+	if progress.Reference == "" {
+		// nothing was uploaded, any previous progress is kept
+		return false, nil
+	}
+	if progress.Complete {
+		return false, recorder.store.putProgress(record, progress)
+	} else if progress.FailedAttempts > 2 {
+		return false, recorder.store.deleteProgress(record)
+	}
+	return true, recorder.store.putProgress(record, progress)
+}
+
+// cancelRecord ends a record that was started but where no upload was attempted, leaving any previous progress in place
+func (recorder *fileTransferRecorder) cancelRecord(record string) {
+	recorder.fileTransferRecordMutex.Lock()
+	defer recorder.fileTransferRecordMutex.Unlock()
+	delete(recorder.inProgress, record)
+}
+
+// snapshot writes status entries holding the state still needed to resume uploads and avoid duplicates, these are the
+// entries that rebuild the state when replayed
+func (recorder *fileTransferRecorder) snapshot(write func(StatusRecordEntry) error) error {
+	err := recorder.store.forEachProgress(func(record string, progress trueconnect.UploadProgress) error {
+		entry := StatusRecordEntry{Operation: fileUploadOpp, ContextID: record}
+		if progress.Complete {
+			entry.Status = uploadSuccess
+			entry.Comments = progress.Reference
+		} else {
+			progBytes, _ := json.Marshal(progress)
+			entry.Status = partialStatus
+			entry.Comments = string(progBytes)
 		}
+		return write(entry)
+	})
+	if err != nil {
+		return err
 	}
-	recorder.fileTransferRecordMutex.Unlock()
-	return isIncommplete
+	err = recorder.store.forEachVersion(func(version fileVersion) error {
+		versionBytes, _ := json.Marshal(version)
+		return write(StatusRecordEntry{Operation: versionOperation, Status: uploadSuccess, Comments: string(versionBytes)})
+	})
+	if err != nil {
+		return err
+	}
+	return recorder.store.forEachFailure(func(record string, failure failureRecord) error {
+		if !failure.Abandoned {
+			return nil
+		}
+		failureBytes, _ := json.Marshal(failure)
+		return write(StatusRecordEntry{Operation: fileUploadOpp, Status: abandonedStatus, ContextID: record, Comments: string(failureBytes)})
+	})
 }
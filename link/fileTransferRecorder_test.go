@@ -3,7 +3,10 @@ package link
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/GeneralElectric/TrueConnect-Link/trueconnect"
+	"io/ioutil"
+	"os"
 	"reflect"
 	"testing"
 	"time"
@@ -12,13 +15,13 @@ import (
 func TestNotDuplicateRecord(tests *testing.T) {
 	recorder := createFileTransferRecorder()
 	first := trueconnect.UploadProgress{Complete: false, Reference: "abc", Part: 9, FailedAttempts: 0}
-	p, isOk := recorder.startRecord("abc123", first)
+	p, isOk, _ := recorder.startRecord("abc123", first)
 	if !isOk || !reflect.DeepEqual(first, p) {
 		tests.Fatal("Could Not create file transfer record")
 	}
 
 	second := trueconnect.UploadProgress{Complete: false, Reference: "abc", Part: 9, FailedAttempts: 0}
-	_, isOk = recorder.startRecord("abc123", second)
+	_, isOk, _ = recorder.startRecord("abc123", second)
 	if isOk {
 		tests.Fatal("Did not prevent duplicate")
 	}
@@ -27,13 +30,13 @@ func TestNotDuplicateRecord(tests *testing.T) {
 func TestCompleteNotReturnPartialRecord(tests *testing.T) {
 	recorder := createFileTransferRecorder()
 	first := trueconnect.UploadProgress{Complete: false, Reference: "abc", Part: 9, FailedAttempts: 0}
-	p, isOk := recorder.startRecord("abc123", first)
+	p, isOk, _ := recorder.startRecord("abc123", first)
 	if !isOk || !reflect.DeepEqual(first, p) {
 		tests.Fatal("Could Not create file transfer record")
 	}
 
 	second := trueconnect.UploadProgress{Complete: true, Reference: "abc", Part: 9, FailedAttempts: 0}
-	isPartial := recorder.stopRecord("abc123", second)
+	isPartial, _ := recorder.stopRecord("abc123", second)
 	if isPartial {
 		tests.Fatal("Stop with complete progress returned partial")
 	}
@@ -42,13 +45,13 @@ func TestCompleteNotReturnPartialRecord(tests *testing.T) {
 func TestIncompleteReturnsPartialRecord(tests *testing.T) {
 	recorder := createFileTransferRecorder()
 	first := trueconnect.UploadProgress{Complete: false, Reference: "abc", Part: 9, FailedAttempts: 0}
-	p, isOk := recorder.startRecord("abc123", first)
+	p, isOk, _ := recorder.startRecord("abc123", first)
 	if !isOk || !reflect.DeepEqual(first, p) {
 		tests.Fatal("Could Not create file transfer record")
 	}
 
 	second := trueconnect.UploadProgress{Complete: false, Reference: "abc", Part: 9, FailedAttempts: 0}
-	isPartial := recorder.stopRecord("abc123", second)
+	isPartial, _ := recorder.stopRecord("abc123", second)
 	if !isPartial {
 		tests.Fatal("Stop with incomplete progress returned non-partial")
 	}
@@ -57,18 +60,18 @@ func TestIncompleteReturnsPartialRecord(tests *testing.T) {
 func TestNotRedoCompletedRecord(tests *testing.T) {
 	recorder := createFileTransferRecorder()
 	first := trueconnect.UploadProgress{Complete: false, Reference: "abc", Part: 9, FailedAttempts: 0}
-	p, isOk := recorder.startRecord("abc123", first)
+	p, isOk, _ := recorder.startRecord("abc123", first)
 	if !isOk || !reflect.DeepEqual(first, p) {
 		tests.Fatal("Could Not create file transfer record")
 	}
 
 	second := trueconnect.UploadProgress{Complete: true, Reference: "abc", Part: 9, FailedAttempts: 0}
-	isPartial := recorder.stopRecord("abc123", second)
+	isPartial, _ := recorder.stopRecord("abc123", second)
 	if isPartial {
 		tests.Fatal("Stop with complete progress returned partial")
 	}
 
-	p, isOk = recorder.startRecord("abc123", first)
+	p, isOk, _ = recorder.startRecord("abc123", first)
 	if isOk {
 		tests.Fatal("allowed start on completeed upload")
 	}
@@ -77,18 +80,18 @@ func TestNotRedoCompletedRecord(tests *testing.T) {
 func TestResumeIncompletedRecord(tests *testing.T) {
 	recorder := createFileTransferRecorder()
 	first := trueconnect.UploadProgress{Complete: false, Reference: "abc", Part: 9, FailedAttempts: 0}
-	p, isOk := recorder.startRecord("abc123", first)
+	p, isOk, _ := recorder.startRecord("abc123", first)
 	if !isOk || !reflect.DeepEqual(first, p) {
 		tests.Fatal("Could Not create file transfer record")
 	}
 
 	second := trueconnect.UploadProgress{Complete: false, Reference: "abc", Part: 9, FailedAttempts: 0}
-	isPartial := recorder.stopRecord("abc123", second)
+	isPartial, _ := recorder.stopRecord("abc123", second)
 	if !isPartial {
 		tests.Fatal("Stop with incomplete progress returned non-partial")
 	}
 
-	p, isOk = recorder.startRecord("abc123", first)
+	p, isOk, _ = recorder.startRecord("abc123", first)
 	if !isOk {
 		tests.Fatal("allowed start on completeed upload")
 	}
@@ -101,18 +104,18 @@ func TestResumeIncompletedRecord(tests *testing.T) {
 func TestCompleteOverridesRetriesRecord(tests *testing.T) {
 	recorder := createFileTransferRecorder()
 	first := trueconnect.UploadProgress{Complete: false, Reference: "abc", Part: 9, FailedAttempts: 0}
-	p, isOk := recorder.startRecord("abc123", first)
+	p, isOk, _ := recorder.startRecord("abc123", first)
 	if !isOk || !reflect.DeepEqual(first, p) {
 		tests.Fatal("Could Not create file transfer record")
 	}
 
 	second := trueconnect.UploadProgress{Complete: true, Reference: "abc", Part: 9, FailedAttempts: 8}
-	isPartial := recorder.stopRecord("abc123", second)
+	isPartial, _ := recorder.stopRecord("abc123", second)
 	if isPartial {
 		tests.Fatal("Stop with complete progress returned partial")
 	}
 
-	p, isOk = recorder.startRecord("abc123", first)
+	p, isOk, _ = recorder.startRecord("abc123", first)
 	if isOk {
 		tests.Fatal("allowed start on completeed upload")
 	}
@@ -121,18 +124,18 @@ func TestCompleteOverridesRetriesRecord(tests *testing.T) {
 func TestExceededRetriesTriggersStartOver(tests *testing.T) {
 	recorder := createFileTransferRecorder()
 	first := trueconnect.UploadProgress{Complete: false, Reference: "abc", Part: 9, FailedAttempts: 0}
-	p, isOk := recorder.startRecord("abc123", first)
+	p, isOk, _ := recorder.startRecord("abc123", first)
 	if !isOk || !reflect.DeepEqual(first, p) {
 		tests.Fatal("Could Not create file transfer record")
 	}
 
 	second := trueconnect.UploadProgress{Complete: false, Reference: "abc", Part: 9, FailedAttempts: 3}
-	isPartial := recorder.stopRecord("abc123", second)
+	isPartial, _ := recorder.stopRecord("abc123", second)
 	if isPartial {
 		tests.Fatal("Stop too many retries returned partial")
 	}
 
-	p, isOk = recorder.startRecord("abc123", first)
+	p, isOk, _ = recorder.startRecord("abc123", first)
 	if !isOk && reflect.DeepEqual(p, first) {
 		tests.Fatal("Didn't start over on over tried")
 	}
@@ -155,6 +158,8 @@ func TestBuildFromLog(tests *testing.T) {
 	progBytes, _ := json.Marshal(progress)
 	client.statusRecorder.recordStatus(systemName, fileUploadOpp, partialStatus, uid3, string(progBytes))
 	client.statusRecorder.recordStatus(systemName, fileUploadOpp, uploadSuccess, uid1, "testref")
+	version, _ := json.Marshal(fileVersion{Path: "C/:test/test.file", Hash: "deadface123", Ref: "testref", Version: 3, Size: 10})
+	client.statusRecorder.recordStatus(systemName, versionOperation, uploadSuccess, uid1, string(version))
 	cancelFunction()
 	time.Sleep(time.Second * 1)
 
@@ -163,15 +168,114 @@ func TestBuildFromLog(tests *testing.T) {
 	if err != nil {
 		tests.Fatal(err.Error())
 	}
-	if _, isOk := client.fileTransferRecorder.startRecord(uid1, trueconnect.UploadProgress{}); isOk {
+	if _, isOk, _ := client.fileTransferRecorder.startRecord(uid1, trueconnect.UploadProgress{}); isOk {
 		tests.Fatal("Failed to prevent duplicate record")
 	}
 
-	if _, isOk := client.fileTransferRecorder.startRecord(uid2, trueconnect.UploadProgress{}); !isOk {
+	if _, isOk, _ := client.fileTransferRecorder.startRecord(uid2, trueconnect.UploadProgress{}); !isOk {
 		tests.Fatal("Failed to allow record")
 	}
 
-	if p, isOk := client.fileTransferRecorder.startRecord(uid3, trueconnect.UploadProgress{}); !isOk && reflect.DeepEqual(p, progress) {
+	if p, isOk, _ := client.fileTransferRecorder.startRecord(uid3, trueconnect.UploadProgress{}); !isOk && reflect.DeepEqual(p, progress) {
 		tests.Fatal("Failed to resume")
 	}
+
+	if last, exists := client.fileTransferRecorder.lastVersion("C/:test/test.file"); !exists || last.Version != 3 || last.Ref != "testref" {
+		tests.Fatal("Failed to rebuild file versions")
+	}
+}
+
+func TestCancelRecordKeepsProgress(tests *testing.T) {
+	recorder := createFileTransferRecorder()
+	first := trueconnect.UploadProgress{Complete: false, Reference: "abc", Part: 9, FailedAttempts: 0}
+	recorder.startRecord("abc123", first)
+	recorder.stopRecord("abc123", first)
+
+	_, isOk, _ := recorder.startRecord("abc123", trueconnect.UploadProgress{})
+	if !isOk {
+		tests.Fatal("could not resume record")
+	}
+	recorder.cancelRecord("abc123")
+
+	p, isOk, _ := recorder.startRecord("abc123", trueconnect.UploadProgress{})
+	if !isOk || !reflect.DeepEqual(p, first) {
+		tests.Fatal("cancel did not keep previous progress")
+	}
+}
+
+func TestCancelNewRecord(tests *testing.T) {
+	recorder := createFileTransferRecorder()
+	recorder.startRecord("abc123", trueconnect.UploadProgress{})
+	recorder.cancelRecord("abc123")
+	if _, exists := recorder.inProgress["abc123"]; exists {
+		tests.Fatal("cancel did not end new record")
+	}
+	if _, exists := recorder.store.progress("abc123"); exists {
+		tests.Fatal("cancel did not remove new record")
+	}
+}
+
+func TestBuildFromDamagedLog(tests *testing.T) {
+	defer os.Remove("TestBuildFromDamagedLog.recordStatus")
+	damaged := "2018-01-02T15:04:05Z,TrueConnect-Link,FileUpload,Success,abc~/in/a.zip,ref1\n" +
+		"2018-01-02T15:04:06Z,TrueConnect-Link,FileUpload,Partial,abc~/in/b.zip,{not json\n" +
+		"2018-01-02T15:04:07Z,TrueConnect-Link,FileUpload,Success,abc~/in/c.zip,ref3\n"
+	if err := ioutil.WriteFile("TestBuildFromDamagedLog.recordStatus", []byte(damaged), 0600); err != nil {
+		tests.Fatal(err)
+	}
+
+	recorder := createFileTransferRecorder()
+	badRecords, err := recorder.replayStatusLog("TestBuildFromDamagedLog.recordStatus")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	if len(badRecords) != 1 || badRecords[0] != 2 {
+		tests.Fatal("damaged partial record not reported ", badRecords)
+	}
+	for _, record := range []string{"abc~/in/a.zip", "abc~/in/c.zip"} {
+		if _, isOk, _ := recorder.startRecord(record, trueconnect.UploadProgress{}); isOk {
+			tests.Fatal("record lost after a damaged partial record ", record)
+		}
+	}
+}
+
+func TestStateStoreErrorsRecorded(tests *testing.T) {
+	defer os.Remove("TestStateStoreErrorsRecorded.state")
+	defer os.Remove("TestStateStoreErrorsRecorded.csv")
+	store, err := openBoltStateStore("TestStateStoreErrorsRecorded.state")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	store.close()
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	statusRecorder, err := createFileStatusRecorder(currentContext, "TestStateStoreErrorsRecorded.csv")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	statusRecorder.configure(StatusLogConfig{Sync: "always"}, nil)
+	client := linkClient{currentContext: currentContext, statusRecorder: statusRecorder, fileTransferRecorder: createFileTransferRecorder()}
+	client.fileTransferRecorder.store = store
+
+	// a successful upload that cannot be kept is reported rather than lost
+	if _, isOk, err := client.fileTransferRecorder.startRecord("uid1", trueconnect.UploadProgress{}); !isOk || err != nil {
+		tests.Fatal("record not started ", err)
+	}
+	if _, err := client.fileTransferRecorder.stopRecord("uid1", trueconnect.UploadProgress{Complete: true, Reference: "ref1"}); err == nil {
+		tests.Fatal("success not kept without an error")
+	}
+	target := Target{Name: "t1"}
+	client.recordFailure(foundFile{uri: "/in/a.zip", target: &target}, "uid2", fmt.Errorf("rejected"))
+	cancelFunction()
+	time.Sleep(time.Millisecond * 200)
+
+	var failed []string
+	readStatusLog("TestStateStoreErrorsRecorded.csv", func(entry StatusRecordEntry) bool {
+		if entry.Operation == stateStoreOperation && entry.Status == failedStatus {
+			failed = append(failed, entry.ContextID)
+		}
+		return true
+	})
+	if len(failed) != 1 || failed[0] != "uid2" {
+		tests.Fatal("failed attempt that could not be counted not recorded ", failed)
+	}
 }
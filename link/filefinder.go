@@ -7,7 +7,6 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"regexp"
 	"time"
 )
 
@@ -18,6 +17,16 @@ type foundFile struct {
 	hash       string
 	target     *Target
 	progress   trueconnect.UploadProgress
+	// metadata values found for the file other than those in its path
+	extracted map[string]string
+	// the path of the sidecar file read for this file
+	sidecar string
+	// the failed attempts to upload the sidecar after the file was uploaded
+	sidecarAttempts int
+	// set once the target extractor has read the metadata held in the file content
+	contentExtracted bool
+	// the version uploaded from the same path that this file replaces
+	previous *fileVersion
 }
 
 const (
@@ -25,10 +34,19 @@ const (
 )
 
 func (linkClient *linkClient) findFiles(target Target, foundFiles *chan foundFile) error {
+	if target.compiled == nil {
+		err := target.compile()
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
 	err := filepath.Walk(target.Location, func(root string, info os.FileInfo, err error) error {
 		if linkClient.isStopping {
 			return io.EOF
 		}
+		linkClient.control.searchProgressed(target.Name)
 		if err == nil {
 			if info.IsDir() {
 				if target.Location == root {
@@ -37,20 +55,43 @@ func (linkClient *linkClient) findFiles(target Target, foundFiles *chan foundFil
 				if target.Recursive == false {
 					return filepath.SkipDir
 				}
+				if target.MaxDepth > 0 && target.depth(root) > target.MaxDepth {
+					return filepath.SkipDir
+				}
+				if target.Disposition != nil && target.Disposition.isArchive(root) {
+					return filepath.SkipDir
+				}
+				return nil
 			}
 
-			matched := false
-
-			matched, err = regexp.MatchString(target.Match, root)
-			if matched && (err == nil) {
-				hash, err := computeSHA256Hash(root)
+			if target.accepts(root, info, now) {
+				found := foundFile{uri: root, size: info.Size(), target: &target, modifyTime: info.ModTime()}
+				if target.Sidecar != nil && !linkClient.readSidecar(&found) {
+					return nil
+				}
+				found.hash, err = computeSHA256Hash(root)
 				if err != nil {
 					return err
 				}
+				if target.receipt() != nil {
+					linkClient.recogniseReceipt(&found)
+				}
+				if !linkClient.configuration.force && linkClient.fileTransferRecorder.isAbandoned(linkClient.configuration.uid(found)) {
+					// abandoned files are left alone until they are requeued
+					return nil
+				}
+				linkClient.metrics.add(metricDiscovered, target.Name, 1)
+				linkClient.metrics.queued(1)
+				record := linkClient.configuration.uid(found)
+				linkClient.control.enqueue(record, found, nil)
 				select {
-				case *foundFiles <- foundFile{uri: root, size: info.Size(), target: &target, modifyTime: info.ModTime(), hash: hash}:
+				case *foundFiles <- found:
+					linkClient.metrics.queued(-1)
+					linkClient.control.dequeue(record)
 					break
 				case <-linkClient.currentContext.Done():
+					linkClient.metrics.queued(-1)
+					linkClient.control.dequeue(record)
 					return fmt.Errorf(errTerminating)
 				}
 			}
@@ -62,8 +103,18 @@ func (linkClient *linkClient) findFiles(target Target, foundFiles *chan foundFil
 	return err
 }
 
+// getMetadata gives the metadata uploaded with the found file, the errors transforming its values are recorded when it
+// is uploaded
 func (foundFile *foundFile) getMetadata() map[string]trueconnect.MetadataValue {
+	meta, _ := foundFile.metadata()
+	return meta
+}
+
+// metadata gives the metadata uploaded with the found file and the errors for the values that could not be
+// transformed, which are uploaded as they were found
+func (foundFile *foundFile) metadata() (map[string]trueconnect.MetadataValue, []error) {
 	var meta map[string]trueconnect.MetadataValue
+	var errs []error
 	if foundFile != nil && foundFile.uri != "" {
 		meta = make(map[string]trueconnect.MetadataValue)
 		meta[trueconnect.TenantID] = trueconnect.MetadataValue{Value: foundFile.target.Tenant, Immutable: true}
@@ -75,12 +126,20 @@ func (foundFile *foundFile) getMetadata() map[string]trueconnect.MetadataValue {
 		meta[fileSize] = trueconnect.MetadataValue{Value: fmt.Sprintf("%v", foundFile.size), Immutable: true}
 		meta[lastModifiedDate] = trueconnect.MetadataValue{Value: foundFile.modifyTime.Format(time.RFC3339), Immutable: true}
 		meta[sha256Hash] = trueconnect.MetadataValue{Value: foundFile.hash, Immutable: true}
-		for _, Lookup := range foundFile.target.PathEncodedMetaDataTags {
-			regularExpression := regexp.MustCompile(Lookup.Match)
-			matchedPatterns := regularExpression.FindStringSubmatch(foundFile.uri)
-			if matchedPatterns != nil && len(matchedPatterns) > 1 {
-				meta[Lookup.Tag] = trueconnect.MetadataValue{Value: matchedPatterns[1], Immutable: false}
+		if foundFile.previous != nil {
+			meta[supersedesTag] = trueconnect.MetadataValue{Value: foundFile.previous.Ref, Immutable: true}
+			meta[versionTag] = trueconnect.MetadataValue{Value: fmt.Sprintf("%v", foundFile.previous.Version+1), Immutable: true}
+		}
+		extracted := foundFile.target.pathEncodedMetadata(foundFile.uri)
+		for tag, value := range foundFile.extracted {
+			extracted[tag] = value
+		}
+		errs = foundFile.target.transformMetadata(extracted)
+		for tag, value := range extracted {
+			if _, reserved := reservedMetadata[tag]; reserved {
+				continue
 			}
+			meta[tag] = trueconnect.MetadataValue{Value: value, Immutable: false}
 		}
 
 		for _, staticTag := range foundFile.target.StaticTags {
@@ -88,7 +147,7 @@ func (foundFile *foundFile) getMetadata() map[string]trueconnect.MetadataValue {
 		}
 	}
 
-	return meta
+	return meta, errs
 }
 
 func computeSHA256Hash(filePath string) (string, error) {
@@ -96,6 +155,7 @@ func computeSHA256Hash(filePath string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	defer file.Close()
 	hash := sha256.New()
 	_, err = io.Copy(hash, file)
 	if err != nil {
@@ -319,7 +319,9 @@ func CreateTestFile(createFileName string) (string, error) {
 		if err == nil {
 			file, err := os.Create(fileName)
 			if err == nil {
-				err = file.Close()
+				// empty files are excluded from upload by default so give them some content
+				_, err = file.WriteString(createFileName)
+				file.Close()
 			}
 		}
 	}
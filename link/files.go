@@ -0,0 +1,83 @@
+package link
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// temporary files are given this prefix so that they match the temporary file patterns and are never uploaded
+const tempFilePrefix = ".~"
+
+// writeFileAtomically writes the data to a temporary file in the same directory which is synced to disk before it is
+// renamed over the named file, so the named file holds either its previous content or all of the new content
+func writeFileAtomically(fileName string, data []byte, perm os.FileMode) error {
+	tempFile, err := ioutil.TempFile(filepath.Dir(fileName), tempFilePrefix+filepath.Base(fileName)+".")
+	if err != nil {
+		return err
+	}
+	tempName := tempFile.Name()
+
+	_, err = tempFile.Write(data)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	closeErr := tempFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tempName, perm)
+	}
+	if err == nil {
+		err = os.Rename(tempName, fileName)
+	}
+	if err != nil {
+		os.Remove(tempName)
+	}
+	return err
+}
+
+// copyFileDurably copies the source file to a temporary file next to the destination which is synced to disk before
+// it is renamed to the destination
+func copyFileDurably(source string, destination string) error {
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	info, err := sourceFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(destination), tempFilePrefix+filepath.Base(destination)+".")
+	if err != nil {
+		return err
+	}
+	tempName := tempFile.Name()
+
+	_, err = io.Copy(tempFile, sourceFile)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	closeErr := tempFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tempName, info.Mode())
+	}
+	if err == nil {
+		err = os.Chtimes(tempName, info.ModTime(), info.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tempName, destination)
+	}
+	if err != nil {
+		os.Remove(tempName)
+	}
+	return err
+}
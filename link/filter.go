@@ -0,0 +1,271 @@
+package link
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Pattern types and scopes used in FilePattern
+const (
+	patternRegex     = "regex"
+	patternGlob      = "glob"
+	scopeName        = "name"
+	scopePath        = "path"
+	scopeFullPath    = "fullpath"
+	errPatternType   = "unrecognised pattern type %q"
+	errPatternScope  = "unrecognised pattern scope %q"
+	errInvalidTarget = "target %s: %v"
+	errInvalidTag    = "target %s, tag %s: %v"
+)
+
+// files that are still being written or are left over from an interrupted copy are excluded by default
+var temporaryFilePatterns = []string{"*.part", "*.partial", "*.tmp", "*.temp", "*.crdownload", "~$*", ".~*"}
+
+type compiledTarget struct {
+	match       *regexp.Regexp
+	include     []fileMatcher
+	exclude     []fileMatcher
+	pathPattern *regexp.Regexp
+	pathTags    []compiledTag
+	transforms  []compiledTransform
+}
+
+type compiledTag struct {
+	tag   string
+	regex *regexp.Regexp
+}
+
+type fileMatcher struct {
+	regex *regexp.Regexp
+	glob  string
+	scope string
+}
+
+// compile builds the regular expressions and globs of the target so they are only parsed once, an error is returned if
+// any of them are invalid
+func (target *Target) compile() error {
+	compiled := &compiledTarget{}
+	var err error
+	if target.Match != "" {
+		compiled.match, err = regexp.Compile(target.Match)
+		if err != nil {
+			return fmt.Errorf(errInvalidTarget, target.Name, err)
+		}
+	}
+
+	compiled.include, err = compilePatterns(target.Include)
+	if err != nil {
+		return fmt.Errorf(errInvalidTarget, target.Name, err)
+	}
+
+	compiled.exclude, err = compilePatterns(target.Exclude)
+	if err != nil {
+		return fmt.Errorf(errInvalidTarget, target.Name, err)
+	}
+
+	if target.PathPattern != "" {
+		compiled.pathPattern, err = regexp.Compile(target.PathPattern)
+		if err != nil {
+			return fmt.Errorf(errInvalidTarget, target.Name, err)
+		}
+	}
+
+	for _, lookup := range target.PathEncodedMetaDataTags {
+		regex, err := regexp.Compile(lookup.Match)
+		if err != nil {
+			return fmt.Errorf(errInvalidTag, target.Name, lookup.Tag, err)
+		}
+		compiled.pathTags = append(compiled.pathTags, compiledTag{tag: lookup.Tag, regex: regex})
+	}
+
+	if target.Sidecar != nil {
+		err = target.Sidecar.validate()
+		if err != nil {
+			return fmt.Errorf(errInvalidTarget, target.Name, err)
+		}
+	}
+
+	if target.Extractor != nil {
+		err = target.Extractor.validate()
+		if err != nil {
+			return fmt.Errorf(errInvalidTarget, target.Name, err)
+		}
+	}
+
+	err = validateDedupPolicy(target.DedupPolicy)
+	if err != nil {
+		return fmt.Errorf(errInvalidTarget, target.Name, err)
+	}
+
+	err = validateOnChange(target.OnChange)
+	if err != nil {
+		return fmt.Errorf(errInvalidTarget, target.Name, err)
+	}
+
+	for _, hook := range target.Hooks {
+		err = hook.validate()
+		if err != nil {
+			return fmt.Errorf(errInvalidTarget, target.Name, err)
+		}
+	}
+
+	for _, transform := range target.Transforms {
+		compiledTransform, err := compileTransform(transform)
+		if err != nil {
+			return fmt.Errorf(errInvalidTag, target.Name, transform.Tag, err)
+		}
+		compiled.transforms = append(compiled.transforms, compiledTransform)
+	}
+
+	if target.Disposition != nil {
+		err = target.Disposition.validate()
+		if err != nil {
+			return fmt.Errorf(errInvalidTarget, target.Name, err)
+		}
+		// files that have already been dealt with must not be found again
+		if suffix := target.Disposition.excludedSuffix(); suffix != "" {
+			compiled.exclude = append(compiled.exclude, fileMatcher{glob: "*" + suffix, scope: scopeName})
+		}
+	}
+
+	if receipt := target.receipt(); receipt != nil {
+		compiled.exclude = append(compiled.exclude, fileMatcher{glob: "*" + receipt.suffix(), scope: scopeName})
+	}
+
+	if !target.IncludeTemporary {
+		for _, pattern := range temporaryFilePatterns {
+			compiled.exclude = append(compiled.exclude, fileMatcher{glob: pattern, scope: scopeName})
+		}
+	}
+
+	target.compiled = compiled
+	return nil
+}
+
+func compilePatterns(patterns []FilePattern) ([]fileMatcher, error) {
+	var matchers []fileMatcher
+	for _, pattern := range patterns {
+		matcher, err := compilePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, matcher)
+	}
+	return matchers, nil
+}
+
+func compilePattern(pattern FilePattern) (fileMatcher, error) {
+	matcher := fileMatcher{scope: strings.ToLower(pattern.Scope)}
+	switch matcher.scope {
+	case "":
+		matcher.scope = scopeName
+	case scopeName, scopePath, scopeFullPath:
+	default:
+		return matcher, fmt.Errorf(errPatternScope, pattern.Scope)
+	}
+
+	switch strings.ToLower(pattern.Type) {
+	case "", patternRegex:
+		regex, err := regexp.Compile(pattern.Pattern)
+		if err != nil {
+			return matcher, err
+		}
+		matcher.regex = regex
+	case patternGlob:
+		// check the glob is well formed before it is used
+		if _, err := filepath.Match(pattern.Pattern, ""); err != nil {
+			return matcher, fmt.Errorf("%v: %q", err, pattern.Pattern)
+		}
+		matcher.glob = pattern.Pattern
+	default:
+		return matcher, fmt.Errorf(errPatternType, pattern.Type)
+	}
+	return matcher, nil
+}
+
+func (matcher fileMatcher) matches(fullPath string, relativePath string) bool {
+	subject := filepath.Base(fullPath)
+	switch matcher.scope {
+	case scopePath:
+		subject = relativePath
+	case scopeFullPath:
+		subject = filepath.ToSlash(fullPath)
+	}
+
+	if matcher.regex != nil {
+		return matcher.regex.MatchString(subject)
+	}
+	matched, _ := filepath.Match(matcher.glob, subject)
+	return matched
+}
+
+// accepts returns true when the file found at fullPath satisfies all the filters of the target
+func (target *Target) accepts(fullPath string, info os.FileInfo, now time.Time) bool {
+	compiled := target.compiled
+	if compiled.match != nil && !compiled.match.MatchString(fullPath) {
+		return false
+	}
+
+	size := info.Size()
+	if size == 0 && !target.IncludeEmpty {
+		return false
+	}
+	if size < target.MinSize || (target.MaxSize > 0 && size > target.MaxSize) {
+		return false
+	}
+
+	age := now.Sub(info.ModTime())
+	if age < time.Duration(target.MinAge)*time.Second {
+		return false
+	}
+	if target.MaxAge > 0 && age > time.Duration(target.MaxAge)*time.Second {
+		return false
+	}
+
+	relativePath := target.relativePath(fullPath)
+	if len(compiled.include) > 0 {
+		included := false
+		for _, matcher := range compiled.include {
+			if matcher.matches(fullPath, relativePath) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+
+	for _, matcher := range compiled.exclude {
+		if matcher.matches(fullPath, relativePath) {
+			return false
+		}
+	}
+
+	// sidecars are read and uploaded with their data file, not as data files themselves
+	if target.Sidecar != nil && target.Sidecar.isSidecar(fullPath) {
+		return false
+	}
+
+	return true
+}
+
+// relativePath gives the path of the file relative to the target location using forward slashes, when the location
+// is the file itself this is the file name
+func (target *Target) relativePath(fullPath string) string {
+	relativePath, err := filepath.Rel(target.Location, fullPath)
+	if err != nil || relativePath == "." {
+		return filepath.Base(fullPath)
+	}
+	return filepath.ToSlash(relativePath)
+}
+
+// depth gives the number of directory levels the directory is below the target location
+func (target *Target) depth(directory string) int {
+	relativePath := target.relativePath(directory)
+	return strings.Count(relativePath, "/") + 1
+}
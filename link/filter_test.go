@@ -0,0 +1,168 @@
+package link
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIncludeExcludePatterns(tests *testing.T) {
+	target := Target{
+		Location: "/data",
+		Include: []FilePattern{
+			{Pattern: "*.FFD", Type: "glob"},
+			{Pattern: `^2017/.*\.zip$`, Scope: "path"},
+		},
+		Exclude: []FilePattern{
+			{Pattern: "TEST*", Type: "glob"},
+		},
+	}
+	if err := target.compile(); err != nil {
+		tests.Fatal(err)
+	}
+
+	cases := map[string]bool{
+		"/data/A320-1-FFD.FFD":      true,
+		"/data/sub/A320-1-FFD.FFD":  true,
+		"/data/TEST-FFD.FFD":        false,
+		"/data/2017/flight.zip":     true,
+		"/data/2016/flight.zip":     false,
+		"/data/flight.zip":          false,
+		"/data/A320-1-FFD.FFD.part": false,
+	}
+	for path, expected := range cases {
+		if target.accepts(path, testFileInfo{size: 10}, time.Now()) != expected {
+			tests.Fatal("unexpected filter result for ", path)
+		}
+	}
+}
+
+func TestSizeAndAgeFilters(tests *testing.T) {
+	target := Target{
+		Location: "/data",
+		MinSize:  5,
+		MaxSize:  100,
+		MinAge:   60,
+		MaxAge:   3600,
+	}
+	if err := target.compile(); err != nil {
+		tests.Fatal(err)
+	}
+
+	now := time.Now()
+	if !target.accepts("/data/file", testFileInfo{size: 10, modTime: now.Add(-time.Minute * 5)}, now) {
+		tests.Fatal("rejected file within limits")
+	}
+	if target.accepts("/data/file", testFileInfo{size: 4, modTime: now.Add(-time.Minute * 5)}, now) {
+		tests.Fatal("accepted file smaller than minimum size")
+	}
+	if target.accepts("/data/file", testFileInfo{size: 101, modTime: now.Add(-time.Minute * 5)}, now) {
+		tests.Fatal("accepted file larger than maximum size")
+	}
+	if target.accepts("/data/file", testFileInfo{size: 10, modTime: now.Add(-time.Second * 5)}, now) {
+		tests.Fatal("accepted file younger than minimum age")
+	}
+	if target.accepts("/data/file", testFileInfo{size: 10, modTime: now.Add(-time.Hour * 2)}, now) {
+		tests.Fatal("accepted file older than maximum age")
+	}
+}
+
+func TestEmptyAndTemporaryExcludedByDefault(tests *testing.T) {
+	target := Target{Location: "/data"}
+	if err := target.compile(); err != nil {
+		tests.Fatal(err)
+	}
+	if target.accepts("/data/file.abc", testFileInfo{size: 0}, time.Now()) {
+		tests.Fatal("accepted empty file")
+	}
+	if target.accepts("/data/file.abc.part", testFileInfo{size: 10}, time.Now()) {
+		tests.Fatal("accepted temporary file")
+	}
+
+	target = Target{Location: "/data", IncludeEmpty: true, IncludeTemporary: true}
+	if err := target.compile(); err != nil {
+		tests.Fatal(err)
+	}
+	if !target.accepts("/data/file.abc", testFileInfo{size: 0}, time.Now()) {
+		tests.Fatal("rejected empty file when included")
+	}
+	if !target.accepts("/data/file.abc.part", testFileInfo{size: 10}, time.Now()) {
+		tests.Fatal("rejected temporary file when included")
+	}
+}
+
+func TestInvalidPatternsRejected(tests *testing.T) {
+	invalid := []Target{
+		{Include: []FilePattern{{Pattern: "(unclosed"}}},
+		{Exclude: []FilePattern{{Pattern: "[", Type: "glob"}}},
+		{Include: []FilePattern{{Pattern: "*.abc", Type: "wildcard"}}},
+		{Include: []FilePattern{{Pattern: "*.abc", Type: "glob", Scope: "parent"}}},
+	}
+	for _, target := range invalid {
+		if target.compile() == nil {
+			tests.Fatal("invalid pattern accepted ", target.Include, target.Exclude)
+		}
+	}
+}
+
+func TestMaxDepth(tests *testing.T) {
+	testfile1, err := CreateTestFile("./TestMaxDepth/testfile1.abc")
+	if err != nil {
+		tests.Fatal(err.Error())
+	}
+	defer os.RemoveAll("./TestMaxDepth")
+
+	testfile2, err := CreateTestFile("./TestMaxDepth/level1/testfile2.abc")
+	if err != nil {
+		tests.Fatal(err.Error())
+	}
+
+	_, err = CreateTestFile("./TestMaxDepth/level1/level2/testfile3.abc")
+	if err != nil {
+		tests.Fatal(err.Error())
+	}
+
+	target := Target{
+		Location:  filepath.Dir(testfile1),
+		Recursive: true,
+		MaxDepth:  1,
+	}
+
+	foundFiles := make(chan foundFile, 10)
+	client := linkClient{}
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+	client.currentContext = currentContext
+	err = client.findFiles(target, &foundFiles)
+	if err != nil && err != io.EOF {
+		tests.Fatal("Unexpected err return from findfiles: " + err.Error())
+	}
+	close(foundFiles)
+
+	expected := map[string]bool{testfile1: true, testfile2: true}
+	counter := 0
+	for foundFile := range foundFiles {
+		if !expected[foundFile.uri] {
+			tests.Fatal("Found: " + foundFile.uri + " beyond the maximum depth")
+		}
+		counter++
+	}
+	if counter != len(expected) {
+		tests.Fatal("not all expected files were found")
+	}
+}
+
+type testFileInfo struct {
+	size    int64
+	modTime time.Time
+}
+
+func (info testFileInfo) Name() string       { return "test" }
+func (info testFileInfo) Size() int64        { return info.size }
+func (info testFileInfo) Mode() os.FileMode  { return 0600 }
+func (info testFileInfo) ModTime() time.Time { return info.modTime }
+func (info testFileInfo) IsDir() bool        { return false }
+func (info testFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,191 @@
+package link
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/GeneralElectric/TrueConnect-Link/trueconnect"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+)
+
+// The operations and statuses recorded when uploads are forgotten and when an upload is forced
+const (
+	forgetOperation       = "Forget"
+	forgottenStatus       = "Forgotten"
+	forcedUploadOperation = "ForcedUpload"
+	forcedStatus          = "Forced"
+)
+
+// auditEntry explains who removed an upload from the state and why, it is recorded as the comments of the status entry
+type auditEntry struct {
+	Path   string `json:"path"`
+	Ref    string `json:"ref,omitempty"`
+	By     string `json:"by"`
+	Host   string `json:"host"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// stateRecord is an upload held in the state store with the details of it found in the status log
+type stateRecord struct {
+	record   string
+	path     string
+	hash     string
+	target   string
+	uploaded time.Time
+	progress trueconnect.UploadProgress
+}
+
+// operator gives the name of the user running the client for the audit entries
+func operator() string {
+	if current, err := user.Current(); err == nil && current.Username != "" {
+		return current.Username
+	}
+	for _, name := range []string{"USER", "USERNAME"} {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return "unknown"
+}
+
+func (linkClient *linkClient) newAuditEntry(path string, ref string) string {
+	host, _ := os.Hostname()
+	data, _ := json.Marshal(auditEntry{Path: path, Ref: ref, By: operator(), Host: host, Reason: linkClient.configuration.reason})
+	return string(data)
+}
+
+// recordHash gives the hash of the content in the key an upload is recorded under
+func recordHash(record string) string {
+	if index := strings.Index(record, "~"); index >= 0 {
+		return record[:index]
+	}
+	return ""
+}
+
+// stateRecords gives the uploads held in the state store, the status log gives the path of each and when it was
+// uploaded and the configured targets tell which target found it
+func (linkClient *linkClient) stateRecords(configured []Target) ([]stateRecord, error) {
+	builder := newStatusBuilder(nil, time.Time{}, time.Time{})
+	uploaded := make(map[string]time.Time)
+	err := readStatusHistory(linkClient.configuration.ClientID+".recordStatus", time.Time{}, func(entry StatusRecordEntry) {
+		builder.add(entry)
+		if entry.System == systemName && entry.Operation == fileUploadOpp && entry.Status == uploadSuccess {
+			uploaded[entry.ContextID] = entry.Time
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var records []stateRecord
+	err = linkClient.fileTransferRecorder.store.forEachProgress(func(record string, progress trueconnect.UploadProgress) error {
+		path := builder.fileOf(record, "")
+		target := otherTarget
+		if index := locateTarget(configured, path); index >= 0 {
+			target = configured[index].Name
+		}
+		hash := recordHash(record)
+		if version, exists := linkClient.fileTransferRecorder.store.version(path); hash == "" && exists && version.Ref == progress.Reference {
+			// an upload recorded under its path alone, the path dedup policy, has the hash of its version
+			hash = version.Hash
+		}
+		records = append(records, stateRecord{record: record, path: path, hash: hash, target: target,
+			uploaded: uploaded[record], progress: progress})
+		return nil
+	})
+	return records, err
+}
+
+// forget removes the uploads chosen by the command line arguments from the state so that their files are uploaded again
+// the next time they are found. Each is recorded in the status log with who forgot it
+func (linkClient *linkClient) forget() string {
+	selector := linkClient.configuration.selector
+	if selector.isEmpty() && selector.hash == "" {
+		linkClient.exitCode = 1
+		return "choose the uploads to forget with -path, -hash, -pattern, -t, -since or -until, or use -all to forget every upload"
+	}
+	matches, err := selector.matcher()
+	if err != nil {
+		linkClient.exitCode = 1
+		return err.Error()
+	}
+	configured, err := readConfiguredTargets(linkClient.configuration.ClientID + ".json")
+	if err != nil {
+		linkClient.statusRecorder.recordStatus(systemName, operationLoadConfig, failedStatus, "",
+			"uploads are not matched to targets: "+err.Error())
+	}
+	records, err := linkClient.stateRecords(configured)
+	if err != nil {
+		linkClient.exitCode = 1
+		return err.Error()
+	}
+
+	var buffer bytes.Buffer
+	forgotten := 0
+	for _, record := range records {
+		if selector.hash != "" && !strings.EqualFold(selector.hash, record.hash) {
+			continue
+		}
+		if !matches(record.path, record.target, record.uploaded) {
+			continue
+		}
+		err := linkClient.forgetRecord(record, configured)
+		if err != nil {
+			linkClient.exitCode = 1
+			buffer.WriteString("ERROR: " + record.path + ": " + err.Error() + "\n")
+			continue
+		}
+		linkClient.statusRecorder.recordStatus(systemName, forgetOperation, forgottenStatus, record.record,
+			linkClient.newAuditEntry(record.path, record.progress.Reference))
+		buffer.WriteString("forgot " + record.path + " " + record.progress.Reference + "\n")
+		forgotten++
+	}
+	buffer.WriteString(fmt.Sprintf("%d uploads forgotten\n", forgotten))
+	return buffer.String()
+}
+
+// forgetRecord removes an upload from the state along with the version and receipt recorded for it
+func (linkClient *linkClient) forgetRecord(record stateRecord, configured []Target) error {
+	store := linkClient.fileTransferRecorder.store
+	err := store.deleteProgress(record.record)
+	if err == nil {
+		err = store.deleteFailure(record.record)
+	}
+	if version, exists := store.version(record.path); err == nil && exists && version.Ref == record.progress.Reference {
+		err = store.deleteVersion(record.path)
+	}
+	if err != nil {
+		return err
+	}
+
+	index := locateTarget(configured, record.path)
+	if index < 0 || configured[index].receipt() == nil {
+		return nil
+	}
+	receiptPath := configured[index].receiptPath(record.path)
+	data, err := ioutil.ReadFile(receiptPath)
+	if err != nil {
+		return nil
+	}
+	var receipt uploadReceipt
+	if json.Unmarshal(data, &receipt) == nil && receipt.DataStoreRef == record.progress.Reference {
+		return removeFile(receiptPath)
+	}
+	return nil
+}
+
+// forceUpload removes any record of the found file being uploaded so that it is uploaded again, the forced upload is
+// recorded in the status log with who forced it
+func (linkClient *linkClient) forceUpload(foundFile *foundFile, uid string) {
+	store := linkClient.fileTransferRecorder.store
+	previous, _ := store.progress(uid)
+	store.deleteProgress(uid)
+	store.deleteFailure(uid)
+	foundFile.progress = trueconnect.UploadProgress{}
+	linkClient.statusRecorder.recordStatus(systemName, forcedUploadOperation, forcedStatus, uid,
+		linkClient.newAuditEntry(foundFile.uri, previous.Reference))
+}
@@ -0,0 +1,151 @@
+package link
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/GeneralElectric/TrueConnect-Link/trueconnect"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForget(tests *testing.T) {
+	dir, err := ioutil.TempDir("", "forget")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	clientID := filepath.Join(dir, "client")
+	location := filepath.Join(dir, "in")
+	config, _ := json.Marshal(Configuration{Targets: []Target{{Name: "flights", Location: location, Receipt: &ReceiptConfig{}}}})
+	if err = ioutil.WriteFile(clientID+".json", config, 0600); err != nil {
+		tests.Fatal(err)
+	}
+	wrong := filepath.Join(location, "wrong.zip")
+	right := filepath.Join(location, "right.zip")
+	keyedByPath := filepath.Join(location, "path.zip")
+	if err = os.MkdirAll(location, 0700); err != nil {
+		tests.Fatal(err)
+	}
+	receipt, _ := json.Marshal(uploadReceipt{DataStoreRef: "ref1"})
+	if err = ioutil.WriteFile(wrong+defaultReceiptSuffix, receipt, 0600); err != nil {
+		tests.Fatal(err)
+	}
+
+	statusFile, err := os.Create(clientID + ".recordStatus")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	csvWriter := csv.NewWriter(statusFile)
+	for _, entry := range []StatusRecordEntry{
+		{Time: time.Date(2020, 3, 2, 10, 0, 0, 0, time.UTC), System: systemName, Operation: fileUploadOpp, Status: uploadSuccess, ContextID: "aaa~" + wrong, Comments: "ref1"},
+		{Time: time.Date(2020, 3, 1, 10, 0, 0, 0, time.UTC), System: systemName, Operation: fileUploadOpp, Status: uploadSuccess, ContextID: "bbb~" + right, Comments: "ref2"},
+		{Time: time.Date(2020, 3, 1, 10, 0, 0, 0, time.UTC), System: systemName, Operation: fileUploadOpp, Status: uploadSuccess, ContextID: "~" + keyedByPath, Comments: "ref3"},
+	} {
+		csvWriter.Write(entry.StatusRecordToLine())
+	}
+	csvWriter.Flush()
+	statusFile.Close()
+
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+	client := linkClient{currentContext: currentContext, statusRecorder: createStatusRecorder(currentContext), fileTransferRecorder: createFileTransferRecorder()}
+	store := client.fileTransferRecorder.store
+	store.putProgress("aaa~"+wrong, trueconnect.UploadProgress{Complete: true, Reference: "ref1"})
+	store.putProgress("bbb~"+right, trueconnect.UploadProgress{Complete: true, Reference: "ref2"})
+	store.putVersion(fileVersion{Path: wrong, Hash: "aaa", Ref: "ref1", Version: 1})
+	store.putProgress("~"+keyedByPath, trueconnect.UploadProgress{Complete: true, Reference: "ref3"})
+	store.putVersion(fileVersion{Path: keyedByPath, Hash: "ccc", Ref: "ref3", Version: 1})
+
+	client.configuration.getConfigurationFromArgs([]string{"-c:Forget", "-u:" + clientID})
+	client.forget()
+	if client.exitCode != 1 {
+		tests.Fatal("uploads forgotten without being chosen")
+	}
+
+	client.exitCode = 0
+	client.configuration.getConfigurationFromArgs([]string{"-c:Forget", "-u:" + clientID, "-t:flights", "-since:2020-03-02", "-reason:wrong tenant"})
+	result := client.forget()
+	if client.exitCode != 0 || !strings.Contains(result, "1 uploads forgotten") {
+		tests.Fatal("chosen upload not forgotten ", result)
+	}
+	if _, exists := store.progress("aaa~" + wrong); exists {
+		tests.Fatal("upload still recorded in the state")
+	}
+	if _, exists := store.version(wrong); exists {
+		tests.Fatal("version of the forgotten upload kept")
+	}
+	if _, err := os.Stat(wrong + defaultReceiptSuffix); !os.IsNotExist(err) {
+		tests.Fatal("receipt of the forgotten upload kept")
+	}
+	if _, exists := store.progress("bbb~" + right); !exists {
+		tests.Fatal("upload outside the time range forgotten")
+	}
+
+	client.configuration.selector = commandSelector{hash: "BBB"}
+	if result = client.forget(); !strings.Contains(result, "forgot "+right) {
+		tests.Fatal("upload not forgotten by hash ", result)
+	}
+	// an upload recorded under its path alone is found by the hash of its version
+	client.configuration.selector = commandSelector{hash: "CCC"}
+	if result = client.forget(); !strings.Contains(result, "forgot "+keyedByPath) {
+		tests.Fatal("upload recorded by path not forgotten by hash ", result)
+	}
+}
+
+func TestForgottenUploadsReplayed(tests *testing.T) {
+	defer os.Remove("TestForgottenUploadsReplayed.recordStatus")
+	statusFile, err := os.Create("TestForgottenUploadsReplayed.recordStatus")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	audit, _ := json.Marshal(auditEntry{Path: "/in/file.zip", Ref: "ref1", By: "someone"})
+	csvWriter := csv.NewWriter(statusFile)
+	for _, entry := range []StatusRecordEntry{
+		{Time: time.Now(), System: systemName, Operation: fileUploadOpp, Status: uploadSuccess, ContextID: "abc~/in/file.zip", Comments: "ref1"},
+		{Time: time.Now(), System: systemName, Operation: versionOperation, Status: uploadSuccess, ContextID: "abc~/in/file.zip", Comments: `{"path":"/in/file.zip","ref":"ref1"}`},
+		{Time: time.Now(), System: systemName, Operation: forgetOperation, Status: forgottenStatus, ContextID: "abc~/in/file.zip", Comments: string(audit)},
+	} {
+		csvWriter.Write(entry.StatusRecordToLine())
+	}
+	csvWriter.Flush()
+	statusFile.Close()
+
+	recorder := createFileTransferRecorder()
+	if err = recorder.buildFromStatusEntry("TestForgottenUploadsReplayed.recordStatus"); err != nil {
+		tests.Fatal(err)
+	}
+	if _, exists := recorder.store.progress("abc~/in/file.zip"); exists {
+		tests.Fatal("forgotten upload rebuilt from the status log")
+	}
+	if _, exists := recorder.lastVersion("/in/file.zip"); exists {
+		tests.Fatal("version of the forgotten upload rebuilt from the status log")
+	}
+}
+
+func TestForceUpload(tests *testing.T) {
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+	client := linkClient{currentContext: currentContext, statusRecorder: createStatusRecorder(currentContext), fileTransferRecorder: createFileTransferRecorder()}
+	client.configuration.getConfigurationFromArgs([]string{"-force", "-c:Upload", "-path:/in/file.zip", "-reason:wrong tenant"})
+	if !client.configuration.force || client.configuration.reason != "wrong tenant" {
+		tests.Fatal("force arguments not read")
+	}
+	client.fileTransferRecorder.store.putProgress("abc~/in/file.zip", trueconnect.UploadProgress{Complete: true, Reference: "ref1"})
+
+	found := foundFile{uri: "/in/file.zip", progress: trueconnect.UploadProgress{Complete: true, Reference: "ref1"}}
+	client.forceUpload(&found, "abc~/in/file.zip")
+	if _, isOk, _ := client.fileTransferRecorder.startRecord("abc~/in/file.zip", found.progress); !isOk {
+		tests.Fatal("forced upload still treated as uploaded")
+	}
+
+	other := linkClient{currentContext: currentContext, statusRecorder: createStatusRecorder(currentContext)}
+	other.configuration.getConfigurationFromArgs([]string{"-c:Auto", "-u:TestForceUpload", "-force"})
+	if output := other.Start(); other.exitCode != 1 || !strings.Contains(output, "-force") {
+		tests.Fatal("-force accepted without the Upload command ", output)
+	}
+}
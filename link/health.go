@@ -0,0 +1,374 @@
+package link
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The operation recorded when the health of the client changes, the health it can be in, how often it is checked and
+// how long the endpoint being reachable is trusted for before it is checked again
+const (
+	healthOperation       = "Health"
+	healthOK              = "ok"
+	healthDegraded        = "degraded"
+	healthUnready         = "unready"
+	healthStalled         = "stalled"
+	defaultStallAfter     = 900
+	defaultDegradedAfter  = 3600
+	healthCheckInterval   = 30 * time.Second
+	endpointCheckInterval = 30 * time.Second
+	endpointCheckTimeout  = 5 * time.Second
+	endpointStatusPath    = "/api/v1/status"
+)
+
+// the status recorded in the status log as the client moves into each health
+var healthStatuses = map[string]string{
+	healthOK:       recoveredStatus,
+	healthDegraded: "Degraded",
+	healthUnready:  "Unready",
+	healthStalled:  "Stalled",
+}
+
+// healthReport is the response of the health endpoints, each check is "ok" or describes what is wrong
+type healthReport struct {
+	Status   string            `json:"status"`
+	Live     bool              `json:"live"`
+	Ready    bool              `json:"ready"`
+	Degraded bool              `json:"degraded"`
+	Checks   map[string]string `json:"checks"`
+}
+
+// healthMonitor keeps what the readiness of the client depends on and what has been told to systemd and the status log
+// about the health of the client
+type healthMonitor struct {
+	mutex           sync.Mutex
+	started         time.Time
+	authChecked     bool
+	authErr         error
+	endpointErr     error
+	endpointChecked time.Time
+	// set while a request checking the endpoint is made
+	endpointChecking bool
+	checkEndpoint    func(endpoint string) error
+	status           string
+	notifiedReady    bool
+	listener         net.Listener
+	done             chan struct{}
+}
+
+func newHealthMonitor() *healthMonitor {
+	return &healthMonitor{started: time.Now(), status: healthOK, checkEndpoint: endpointReachable}
+}
+
+func (config *HealthConfig) validate() error {
+	if config.StallAfter < 0 || config.DegradedAfter < 0 {
+		return fmt.Errorf("the stall and degraded times of the health checks cannot be negative")
+	}
+	if config.Address != "" {
+		if _, _, err := net.SplitHostPort(config.Address); err != nil {
+			return fmt.Errorf("invalid health address %q: %v", config.Address, err)
+		}
+	}
+	return nil
+}
+
+// healthTimes gives how long searches and uploads can go without progress and how long without a successful upload
+// before the client is degraded
+func (configuration *Configuration) healthTimes() (time.Duration, time.Duration) {
+	stallAfter, degradedAfter := defaultStallAfter, defaultDegradedAfter
+	if configuration.Health != nil {
+		if configuration.Health.StallAfter > 0 {
+			stallAfter = configuration.Health.StallAfter
+		}
+		if configuration.Health.DegradedAfter > 0 {
+			degradedAfter = configuration.Health.DegradedAfter
+		}
+	}
+	return time.Duration(stallAfter) * time.Second, time.Duration(degradedAfter) * time.Second
+}
+
+// authenticated records whether the client authenticated with the token URL
+func (health *healthMonitor) authenticated(err error) {
+	if health == nil {
+		return
+	}
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	health.authChecked = true
+	health.authErr = err
+}
+
+// endpoint checks the TrueConnect endpoint can be reached, the result is kept for endpointCheckInterval so frequent
+// probes do not each make a request. The request is made without holding the mutex, probes made while it is in
+// progress are given the last result
+func (health *healthMonitor) endpoint(address string) error {
+	health.mutex.Lock()
+	due := !health.endpointChecking && (health.endpointChecked.IsZero() || time.Since(health.endpointChecked) > endpointCheckInterval)
+	if !due {
+		defer health.mutex.Unlock()
+		if health.endpointChecked.IsZero() {
+			return fmt.Errorf("the endpoint is being checked")
+		}
+		return health.endpointErr
+	}
+	health.endpointChecking = true
+	health.mutex.Unlock()
+
+	err := health.checkEndpoint(address)
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	health.endpointChecking = false
+	health.endpointErr = err
+	health.endpointChecked = time.Now()
+	return err
+}
+
+// endpointReachable returns an error when the endpoint does not respond, any response shows it can be reached
+func endpointReachable(endpoint string) error {
+	if endpoint == "" {
+		return fmt.Errorf("no endpoint is configured")
+	}
+	client := http.Client{Timeout: endpointCheckTimeout}
+	response, err := client.Get(strings.TrimSuffix(endpoint, "/") + endpointStatusPath)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+	return nil
+}
+
+// checkHealth gives the health of the client. It is ready once the configuration is loaded, it has authenticated and
+// the endpoint can be reached, it is live while no search or upload has stalled and it is degraded when files are
+// waiting but none has been uploaded for a while
+func (linkClient *linkClient) checkHealth() healthReport {
+	health := linkClient.health
+	report := healthReport{Live: true, Ready: true, Checks: make(map[string]string)}
+	check := func(name string, problem string, failed *bool) {
+		if problem == "" {
+			report.Checks[name] = healthOK
+			return
+		}
+		report.Checks[name] = problem
+		*failed = true
+	}
+	notReady := false
+	check("configuration", "", &notReady)
+	health.mutex.Lock()
+	authChecked, authErr := health.authChecked, health.authErr
+	health.mutex.Unlock()
+	switch {
+	case !authChecked:
+		check("authentication", "not yet authenticated", &notReady)
+	case authErr != nil:
+		check("authentication", authErr.Error(), &notReady)
+	default:
+		check("authentication", "", &notReady)
+	}
+	if err := health.endpoint(linkClient.configuration.Endpoint); err != nil {
+		check("endpoint", err.Error(), &notReady)
+	} else {
+		check("endpoint", "", &notReady)
+	}
+	if linkClient.isStopping {
+		check("stopping", "the client is stopping", &notReady)
+	}
+	report.Ready = !notReady
+
+	stallAfter, degradedAfter := linkClient.configuration.healthTimes()
+	stalled := false
+	if descriptions := linkClient.control.stalled(stallAfter); len(descriptions) > 0 {
+		check("progress", strings.Join(descriptions, ", ")+" made no progress for "+stallAfter.String(), &stalled)
+	} else {
+		check("progress", "", &stalled)
+	}
+	report.Live = !stalled
+
+	since, uploaded := linkClient.metrics.sinceLastSuccess()
+	if !uploaded {
+		since = time.Since(health.started)
+	}
+	if pending := linkClient.control.pending(); pending > 0 && since > degradedAfter {
+		check("uploads", fmt.Sprintf("%d files waiting and none uploaded for %s", pending, since/time.Second*time.Second), &report.Degraded)
+	} else {
+		check("uploads", "", &report.Degraded)
+	}
+
+	switch {
+	case !report.Live:
+		report.Status = healthStalled
+	case !report.Ready:
+		report.Status = healthUnready
+	case report.Degraded:
+		report.Status = healthDegraded
+	default:
+		report.Status = healthOK
+	}
+	return report
+}
+
+// problems lists the checks that failed for the status log
+func (report healthReport) problems() string {
+	var problems []string
+	for name, result := range report.Checks {
+		if result != healthOK {
+			problems = append(problems, name+": "+result)
+		}
+	}
+	sort.Strings(problems)
+	return strings.Join(problems, "; ")
+}
+
+// monitorHealth starts the health endpoints when they are configured and checks the health of the client until
+// stopHealth is called, telling systemd when the client is ready and that it is alive when the watchdog is enabled
+func (linkClient *linkClient) monitorHealth() {
+	health := linkClient.health
+	if health == nil {
+		return
+	}
+	health.done = make(chan struct{})
+	config := linkClient.configuration.Health
+	if config != nil && config.Address != "" {
+		linkClient.serveHealth(config.Address)
+	}
+	interval := healthCheckInterval
+	watchdog := watchdogInterval()
+	if watchdog > 0 && watchdog < interval {
+		interval = watchdog
+	}
+	done := health.done
+	go func() {
+		for {
+			linkClient.reportHealth(watchdog > 0)
+			select {
+			case <-done:
+				return
+			case <-linkClient.currentContext.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
+
+// reportHealth checks the health of the client, recording when it changes and keeping systemd told
+func (linkClient *linkClient) reportHealth(watchdog bool) {
+	health := linkClient.health
+	report := linkClient.checkHealth()
+	health.mutex.Lock()
+	changed := report.Status != health.status
+	health.status = report.Status
+	notifyReady := report.Ready && !health.notifiedReady
+	if notifyReady {
+		health.notifiedReady = true
+	}
+	health.mutex.Unlock()
+
+	if changed {
+		linkClient.statusRecorder.recordStatus(systemName, healthOperation, healthStatuses[report.Status], "", report.problems())
+	}
+	var state []string
+	if notifyReady {
+		state = append(state, "READY=1")
+	}
+	if changed || notifyReady {
+		state = append(state, "STATUS="+report.Status)
+	}
+	if watchdog && report.Live {
+		state = append(state, "WATCHDOG=1")
+	}
+	if len(state) > 0 {
+		systemdNotify(strings.Join(state, "\n"))
+	}
+}
+
+// serveHealth serves /livez, /readyz and /healthz, each responds 200 when the client is live, ready or healthy and 503
+// when it is not with the report as JSON
+func (linkClient *linkClient) serveHealth(address string) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		linkClient.statusRecorder.recordStatus(systemName, healthOperation, failedStatus, "", err.Error())
+		return
+	}
+	linkClient.health.listener = listener
+	go http.Serve(listener, linkClient.healthHandler())
+	linkClient.statusRecorder.recordStatus(systemName, healthOperation, startedStatus, "", "http://"+listener.Addr().String())
+}
+
+func (linkClient *linkClient) healthHandler() http.Handler {
+	mux := http.NewServeMux()
+	respond := func(passed func(healthReport) bool) http.HandlerFunc {
+		return func(writer http.ResponseWriter, request *http.Request) {
+			report := linkClient.checkHealth()
+			writer.Header().Set("Content-Type", "application/json")
+			if passed(report) {
+				writer.WriteHeader(http.StatusOK)
+			} else {
+				writer.WriteHeader(http.StatusServiceUnavailable)
+			}
+			json.NewEncoder(writer).Encode(report)
+		}
+	}
+	mux.HandleFunc("/livez", respond(func(report healthReport) bool { return report.Live }))
+	mux.HandleFunc("/readyz", respond(func(report healthReport) bool { return report.Ready }))
+	mux.HandleFunc("/healthz", respond(func(report healthReport) bool { return report.Status == healthOK }))
+	return mux
+}
+
+// stopHealth stops checking the health of the client and tells systemd it is stopping, it is safe to call when the
+// health was not monitored
+func (linkClient *linkClient) stopHealth() {
+	health := linkClient.health
+	if health == nil || health.done == nil {
+		return
+	}
+	close(health.done)
+	health.done = nil
+	if health.listener != nil {
+		health.listener.Close()
+		health.listener = nil
+	}
+	systemdNotify("STOPPING=1")
+}
+
+// systemdNotify sends the state to systemd when it started the client with a notify socket
+func systemdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		// an abstract socket
+		socket = "\x00" + socket[1:]
+	}
+	connection, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+	_, err = connection.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval gives how often systemd must be told the client is alive, half the watchdog timeout it set, or 0
+// when the watchdog is not enabled for this process
+func watchdogInterval() time.Duration {
+	microseconds, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || microseconds <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(microseconds) * time.Microsecond / 2
+}
@@ -0,0 +1,237 @@
+package link
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthChecks(tests *testing.T) {
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+	client := linkClient{currentContext: currentContext, statusRecorder: createStatusRecorder(currentContext),
+		metrics: newClientMetrics(), control: newServiceControl(), health: newHealthMonitor()}
+	client.configuration.Health = &HealthConfig{StallAfter: 1, DegradedAfter: 1}
+	var endpointErr error
+	client.health.checkEndpoint = func(string) error { return endpointErr }
+
+	report := client.checkHealth()
+	if report.Ready || report.Status != healthUnready || report.Checks["authentication"] == healthOK {
+		tests.Fatal("ready before authenticating ", report)
+	}
+	client.health.authenticated(nil)
+	if report = client.checkHealth(); !report.Ready || !report.Live || report.Status != healthOK {
+		tests.Fatal("not ready once authenticated ", report)
+	}
+
+	// the result of checking the endpoint is kept for a while
+	endpointErr = errors.New("connection refused")
+	if report = client.checkHealth(); !report.Ready {
+		tests.Fatal("endpoint checked again before it was due ", report)
+	}
+	client.health.endpointChecked = time.Now().Add(-2 * endpointCheckInterval)
+	if report = client.checkHealth(); report.Ready || report.Checks["endpoint"] != "connection refused" {
+		tests.Fatal("unreachable endpoint not reported ", report)
+	}
+	endpointErr = nil
+	client.health.endpointChecked = time.Time{}
+
+	// a file waiting while nothing is uploaded degrades the client, an upload sending nothing stalls it
+	target := Target{Name: "t1"}
+	client.control.addTarget(&target)
+	client.control.enqueue("uid1", foundFile{uri: "/in/a.zip", target: &target}, nil)
+	client.health.started = time.Now().Add(-2 * time.Second)
+	if report = client.checkHealth(); !report.Degraded || !report.Live || report.Status != healthDegraded {
+		tests.Fatal("degradation not reported ", report)
+	}
+	client.metrics.uploaded("t1", time.Second)
+	if report = client.checkHealth(); report.Degraded {
+		tests.Fatal("degraded after a recent upload ", report)
+	}
+
+	client.control.dequeue("uid1")
+	_, finished := client.control.startUpload(currentContext, "uid1", foundFile{uri: "/in/a.zip", target: &target})
+	atomic.StoreInt64(&client.control.uploads["uid1"].progressed, time.Now().Add(-2*time.Second).UnixNano())
+	report = client.checkHealth()
+	if report.Live || report.Status != healthStalled || !strings.Contains(report.Checks["progress"], "/in/a.zip") {
+		tests.Fatal("stalled upload not reported ", report)
+	}
+	finished()
+
+	// a search is only stalled when it is not waiting for a worker to take what it found
+	client.control.searchStarted("t1")
+	client.control.targets["t1"].progressed = time.Now().Add(-2 * time.Second)
+	client.control.enqueue("uid2", foundFile{uri: "/in/b.zip", target: &target}, nil)
+	if report = client.checkHealth(); !report.Live {
+		tests.Fatal("search waiting for a worker reported as stalled ", report)
+	}
+	client.control.dequeue("uid2")
+	if report = client.checkHealth(); report.Live {
+		tests.Fatal("stalled search not reported ", report)
+	}
+	retryAt := time.Now().Add(time.Minute)
+	client.control.enqueue("uid3", foundFile{uri: "/in/c.zip", target: &target}, &retryAt)
+	if report = client.checkHealth(); report.Live {
+		tests.Fatal("stalled search hidden by a file waiting to be tried again ", report)
+	}
+	client.control.dequeue("uid3")
+	client.control.searchFinished("t1", nil)
+
+	// a worker stuck outside of an upload, such as in its OnSuccess command, stalls the client
+	client.control.workerBusy(0, "uid4", "/in/d.zip")
+	if report = client.checkHealth(); !report.Live {
+		tests.Fatal("busy worker reported as stalled ", report)
+	}
+	client.control.workers[0].progressed = time.Now().Add(-2 * time.Second)
+	report = client.checkHealth()
+	if report.Live || !strings.Contains(report.Checks["progress"], "the worker handling /in/d.zip") {
+		tests.Fatal("stalled worker not reported ", report)
+	}
+	client.control.workerIdle(0)
+	if report = client.checkHealth(); !report.Live {
+		tests.Fatal("idle worker reported as stalled ", report)
+	}
+}
+
+func TestHealthEndpointCheckUnlocked(tests *testing.T) {
+	health := newHealthMonitor()
+	checking := make(chan struct{})
+	release := make(chan struct{})
+	health.checkEndpoint = func(string) error {
+		close(checking)
+		<-release
+		return nil
+	}
+	checked := make(chan error)
+	go func() {
+		checked <- health.endpoint("https://example.com")
+	}()
+	<-checking
+	// probes made while the endpoint is checked are not held up by the request
+	authenticated := make(chan struct{})
+	go func() {
+		health.authenticated(nil)
+		close(authenticated)
+	}()
+	select {
+	case <-authenticated:
+	case <-time.After(time.Second):
+		tests.Fatal("the health was locked while the endpoint was checked")
+	}
+	if health.endpoint("https://example.com") == nil {
+		tests.Fatal("endpoint reported reachable before it was checked")
+	}
+	close(release)
+	if err := <-checked; err != nil || health.endpoint("https://example.com") != nil {
+		tests.Fatal("endpoint check not kept ", err)
+	}
+}
+
+func TestHealthEndpoints(tests *testing.T) {
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+	client := linkClient{currentContext: currentContext, statusRecorder: createStatusRecorder(currentContext),
+		metrics: newClientMetrics(), control: newServiceControl(), health: newHealthMonitor()}
+	client.health.checkEndpoint = func(string) error { return nil }
+	server := httptest.NewServer(client.healthHandler())
+	defer server.Close()
+
+	codes := func() (int, int) {
+		live, err := http.Get(server.URL + "/livez")
+		if err != nil {
+			tests.Fatal(err)
+		}
+		live.Body.Close()
+		ready, err := http.Get(server.URL + "/readyz")
+		if err != nil {
+			tests.Fatal(err)
+		}
+		defer ready.Body.Close()
+		var report healthReport
+		json.NewDecoder(ready.Body).Decode(&report)
+		if report.Checks["endpoint"] != healthOK {
+			tests.Fatal("report not given ", report)
+		}
+		return live.StatusCode, ready.StatusCode
+	}
+	if live, ready := codes(); live != http.StatusOK || ready != http.StatusServiceUnavailable {
+		tests.Fatal("wrong responses before authenticating ", live, ready)
+	}
+	client.health.authenticated(nil)
+	if live, ready := codes(); live != http.StatusOK || ready != http.StatusOK {
+		tests.Fatal("wrong responses once authenticated ", live, ready)
+	}
+}
+
+func TestSystemdNotify(tests *testing.T) {
+	if runtime.GOOS == "windows" {
+		tests.Skip("local datagram sockets are not available")
+	}
+	directory, err := ioutil.TempDir("", "TestSystemdNotify")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	address := filepath.Join(directory, "notify")
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: address, Net: "unixgram"})
+	if err != nil {
+		tests.Fatal(err)
+	}
+	defer listener.Close()
+	os.Setenv("NOTIFY_SOCKET", address)
+	os.Setenv("WATCHDOG_USEC", "10000000")
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	defer os.Unsetenv("WATCHDOG_USEC")
+
+	if watchdogInterval() != 5*time.Second {
+		tests.Fatal("wrong watchdog interval ", watchdogInterval())
+	}
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+	client := linkClient{currentContext: currentContext, statusRecorder: createStatusRecorder(currentContext),
+		metrics: newClientMetrics(), control: newServiceControl(), health: newHealthMonitor()}
+	client.health.checkEndpoint = func(string) error { return nil }
+	client.health.authenticated(nil)
+	client.reportHealth(true)
+
+	buffer := make([]byte, 1024)
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	size, err := listener.Read(buffer)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	if message := string(buffer[:size]); message != "READY=1\nSTATUS=ok\nWATCHDOG=1" {
+		tests.Fatal("wrong notification ", message)
+	}
+	client.reportHealth(true)
+	size, err = listener.Read(buffer)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	if message := string(buffer[:size]); message != "WATCHDOG=1" {
+		tests.Fatal("wrong notification ", message)
+	}
+}
+
+func TestValidateHealth(tests *testing.T) {
+	for _, config := range []HealthConfig{{StallAfter: -1}, {Address: "9182"}} {
+		if config.validate() == nil {
+			tests.Fatal("invalid health configuration accepted ", config)
+		}
+	}
+	config := HealthConfig{Address: "0.0.0.0:9182", DegradedAfter: 600}
+	if err := config.validate(); err != nil {
+		tests.Fatal(err)
+	}
+}
@@ -0,0 +1,307 @@
+package link
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hook events and the operation used to record hooks being run
+const (
+	eventStart          = "start"
+	eventSuccess        = "success"
+	eventFailure        = "failure"
+	eventPartial        = "partial"
+	eventSkipped        = "skipped"
+	eventCycleComplete  = "cyclecomplete"
+	eventAbandoned      = "abandoned"
+	hookOperation       = "Hook"
+	defaultHookTimeout  = 60
+	maxHookOutputLength = 2000
+)
+
+var nonAlphanumeric = regexp.MustCompile(`[^A-Za-z0-9]`)
+
+// an argument that is only a template, $name or ${name}
+var wholeTemplate = regexp.MustCompile(`^\$(?:(\w+)|\{([^}]+)\})$`)
+
+// shells and the arguments after which they take a script, the script is never expanded as the values in it would be
+// run by the shell
+var (
+	shells           = map[string]bool{"sh": true, "bash": true, "dash": true, "zsh": true, "ksh": true, "cmd": true, "powershell": true, "pwsh": true}
+	shellScriptFlags = map[string]bool{"-c": true, "/c": true, "/k": true, "-command": true}
+)
+
+// linkEvent describes something that happened to a file or target, it is what hooks are told about
+type linkEvent struct {
+	Event      string            `json:"event"`
+	Time       time.Time         `json:"time"`
+	Target     string            `json:"target"`
+	Tenant     string            `json:"tenant"`
+	File       string            `json:"file,omitempty"`
+	StorageRef string            `json:"storageref,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+}
+
+// hookBatches holds the events of batch hooks waiting for the end of the search cycle
+type hookBatches struct {
+	events map[string][]linkEvent
+	mutex  sync.Mutex
+}
+
+func (hook *HookConfig) validate() error {
+	if hook.Command == "" {
+		return fmt.Errorf("a hook needs a command")
+	}
+	switch strings.ToLower(hook.Event) {
+	case eventStart, eventSuccess, eventFailure, eventPartial, eventSkipped, eventCycleComplete, eventAbandoned:
+		return nil
+	}
+	return fmt.Errorf("unrecognised hook event %q", hook.Event)
+}
+
+func newFileEvent(event string, foundFile foundFile, err error) linkEvent {
+	fileEvent := linkEvent{
+		Event:      event,
+		Time:       time.Now().UTC(),
+		Target:     foundFile.target.Name,
+		Tenant:     foundFile.target.Tenant,
+		File:       foundFile.uri,
+		StorageRef: foundFile.progress.Reference,
+		Metadata:   make(map[string]string),
+	}
+	if err != nil {
+		fileEvent.Error = err.Error()
+	}
+	for key, value := range foundFile.getMetadata() {
+		fileEvent.Metadata[key] = value.Value
+	}
+	return fileEvent
+}
+
+func newTargetEvent(event string, target *Target) linkEvent {
+	return linkEvent{
+		Event:  event,
+		Time:   time.Now().UTC(),
+		Target: target.Name,
+		Tenant: target.Tenant,
+	}
+}
+
+// fileEvent runs the hooks of the found file's target for the event and queues it for the webhooks, batch hooks are held
+// until the end of the cycle
+func (linkClient *linkClient) fileEvent(event string, foundFile foundFile, uid string, err error) {
+	if len(foundFile.target.Hooks) == 0 && !linkClient.webhooks.wants(event, foundFile.target.Name) {
+		return
+	}
+	fileEvent := newFileEvent(event, foundFile, err)
+	linkClient.webhooks.queue(fileEvent, uid)
+	for index, hook := range foundFile.target.Hooks {
+		if strings.ToLower(hook.Event) != event {
+			continue
+		}
+		if hook.Batch {
+			linkClient.hookBatches.add(batchKey(foundFile.target, index), fileEvent)
+			continue
+		}
+		linkClient.runHook(hook, fileEvent, uid, "")
+	}
+}
+
+// targetEvent runs the hooks of the target for an event that is not about a single file and queues it for the webhooks,
+// at the end of a cycle any batched events are also run
+func (linkClient *linkClient) targetEvent(event string, target *Target) {
+	targetEvent := newTargetEvent(event, target)
+	linkClient.webhooks.queue(targetEvent, "")
+	for _, hook := range target.Hooks {
+		if strings.ToLower(hook.Event) == event {
+			linkClient.runHook(hook, targetEvent, "", "")
+		}
+	}
+	if event == eventCycleComplete {
+		linkClient.flushBatches(target)
+	}
+}
+
+// flushBatches runs each batch hook of the target once for all the events held since it was last run
+func (linkClient *linkClient) flushBatches(target *Target) {
+	for index, hook := range target.Hooks {
+		if !hook.Batch {
+			continue
+		}
+		events := linkClient.hookBatches.take(batchKey(target, index))
+		if len(events) == 0 {
+			continue
+		}
+
+		batchFile, err := ioutil.TempFile("", "tclink-batch-")
+		if err != nil {
+			linkClient.statusRecorder.recordStatus(systemName, hookOperation, failedStatus, "", err.Error())
+			continue
+		}
+		err = json.NewEncoder(batchFile).Encode(events)
+		batchFile.Close()
+		if err != nil {
+			linkClient.statusRecorder.recordStatus(systemName, hookOperation, failedStatus, "", err.Error())
+		} else {
+			linkClient.runHook(hook, newTargetEvent(strings.ToLower(hook.Event), target), "", batchFile.Name())
+		}
+		os.Remove(batchFile.Name())
+	}
+}
+
+func batchKey(target *Target, index int) string {
+	return fmt.Sprintf("%s/%d", target.Name, index)
+}
+
+func (batches *hookBatches) add(key string, event linkEvent) {
+	batches.mutex.Lock()
+	defer batches.mutex.Unlock()
+	if batches.events == nil {
+		batches.events = make(map[string][]linkEvent)
+	}
+	batches.events[key] = append(batches.events[key], event)
+}
+
+func (batches *hookBatches) take(key string) []linkEvent {
+	batches.mutex.Lock()
+	defer batches.mutex.Unlock()
+	events := batches.events[key]
+	delete(batches.events, key)
+	return events
+}
+
+// runHook runs the hook command for the event and records its result and output in the status log
+func (linkClient *linkClient) runHook(hook HookConfig, event linkEvent, uid string, batchFile string) {
+	timeout := hook.Timeout
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	output, err := runCommand(linkClient.currentContext, hook.Command, event, batchFile, time.Duration(timeout)*time.Second)
+	comments := event.Event + ": " + hook.Command
+	if len(output) > 0 {
+		comments += ": " + truncate(strings.TrimSpace(string(output)), maxHookOutputLength)
+	}
+	if err != nil {
+		linkClient.statusRecorder.recordStatus(systemName, hookOperation, failedStatus, uid, err.Error()+": "+comments)
+		return
+	}
+	linkClient.statusRecorder.recordStatus(systemName, hookOperation, uploadSuccess, uid, comments)
+}
+
+// runCommand replaces the arguments of the command that are templates with the event details and runs it with the
+// details also set as environment variables, its combined output is returned
+func runCommand(ctx context.Context, command string, event linkEvent, batchFile string, timeout time.Duration) ([]byte, error) {
+	values := eventValues(event, batchFile)
+	args := splitCommand(command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	shell := shells[strings.ToLower(strings.TrimSuffix(filepath.Base(args[0]), filepath.Ext(args[0])))]
+	for index := 1; index < len(args); index++ {
+		if shell && shellScriptFlags[strings.ToLower(args[index-1])] {
+			continue
+		}
+		args[index] = expandArgument(args[index], values)
+	}
+
+	timeoutContext, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(timeoutContext, args[0], args[1:]...)
+	cmd.Env = os.Environ()
+	for key, value := range event.Metadata {
+		cmd.Env = append(cmd.Env, "TC_META_"+strings.ToUpper(nonAlphanumeric.ReplaceAllString(key, "_"))+"="+value)
+	}
+	for _, key := range []string{"file", "storageref", "tenant", "target", "event", "error", "batch"} {
+		cmd.Env = append(cmd.Env, "TC_"+strings.ToUpper(key)+"="+values[key])
+	}
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+	if timeoutContext.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %v", timeout)
+	}
+	return output.Bytes(), err
+}
+
+func eventValues(event linkEvent, batchFile string) map[string]string {
+	values := make(map[string]string)
+	for key, value := range event.Metadata {
+		values[key] = value
+	}
+	values["file"] = event.File
+	values["storageref"] = event.StorageRef
+	values["tenant"] = event.Tenant
+	values["target"] = event.Target
+	values["event"] = event.Event
+	values["error"] = event.Error
+	values["batch"] = batchFile
+	return values
+}
+
+// expandArgument gives the value of an argument that is only $name or ${name}, so a value is always passed as a whole
+// argument and is never part of a larger string a program could run. Other arguments and names without a value are
+// left as they are
+func expandArgument(argument string, values map[string]string) string {
+	match := wholeTemplate.FindStringSubmatch(argument)
+	if match == nil {
+		return argument
+	}
+	if value, exists := values[match[1]+match[2]]; exists {
+		return value
+	}
+	return argument
+}
+
+// splitCommand splits a command line into its arguments at spaces outside of single or double quotes
+func splitCommand(command string) []string {
+	var args []string
+	var current bytes.Buffer
+	var quote rune
+	inArg := false
+	for _, character := range command {
+		switch {
+		case quote != 0:
+			if character == quote {
+				quote = 0
+			} else {
+				current.WriteRune(character)
+			}
+		case character == '"' || character == '\'':
+			quote = character
+			inArg = true
+		case character == ' ' || character == '\t':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(character)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args
+}
+
+func truncate(text string, length int) string {
+	if len(text) <= length {
+		return text
+	}
+	return text[:length] + "..."
+}
@@ -0,0 +1,165 @@
+package link
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestSplitCommand(tests *testing.T) {
+	args := splitCommand(`notify.sh  "$file" 'two words' --ref=$storageref`)
+	if len(args) != 4 || args[0] != "notify.sh" || args[1] != "$file" || args[2] != "two words" || args[3] != "--ref=$storageref" {
+		tests.Fatal("command not split ", args)
+	}
+	if len(splitCommand("  ")) != 0 {
+		tests.Fatal("blank command split into arguments")
+	}
+	if args = splitCommand(`run ""`); len(args) != 2 || args[1] != "" {
+		tests.Fatal("empty quoted argument lost ", args)
+	}
+}
+
+func TestExpandArgument(tests *testing.T) {
+	values := map[string]string{"file": "/data/a.zip", "ESN": "956123"}
+	cases := map[string]string{
+		"$file":       "/data/a.zip",
+		"${ESN}":      "956123",
+		"$unknown":    "$unknown",
+		"--ref=$file": "--ref=$file",
+		"$file $ESN":  "$file $ESN",
+	}
+	for argument, expected := range cases {
+		if expanded := expandArgument(argument, values); expanded != expected {
+			tests.Fatal(argument+" expanded to "+expanded+" expected ", expected)
+		}
+	}
+}
+
+func TestInvalidHooksRejected(tests *testing.T) {
+	invalid := []HookConfig{
+		{Event: "success"},
+		{Event: "uploaded", Command: "notify.sh"},
+	}
+	for _, hook := range invalid {
+		target := Target{Name: "test", Hooks: []HookConfig{hook}}
+		if target.compile() == nil {
+			tests.Fatal("invalid hook accepted ", hook)
+		}
+	}
+
+	target := Target{Name: "test", Hooks: []HookConfig{{Event: "CycleComplete", Command: "notify.sh"}}}
+	if err := target.compile(); err != nil {
+		tests.Fatal(err)
+	}
+}
+
+func TestFileHook(tests *testing.T) {
+	if runtime.GOOS == "windows" {
+		tests.Skip("unix test")
+	}
+
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "output")
+
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+	client := linkClient{currentContext: currentContext, statusRecorder: createStatusRecorder(currentContext)}
+	target := Target{Name: "hooked", Tenant: "tenant", Hooks: []HookConfig{
+		{Event: "success", Command: `sh -c 'echo "$0 $1 $TC_EVENT $TC_META_ESN" > ` + output + `' $file ${ESN}`},
+		{Event: "failure", Command: "sh -c 'echo failed > " + output + "'"},
+	}}
+	found := foundFile{uri: "/data/a.zip", target: &target, extracted: map[string]string{"ESN": "956123"}}
+
+	client.fileEvent(eventSuccess, found, "uid", nil)
+	content, err := ioutil.ReadFile(output)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	if strings.TrimSpace(string(content)) != "/data/a.zip 956123 success 956123" {
+		tests.Fatal("hook not run with the event details ", string(content))
+	}
+}
+
+func TestHostileFileNameNotRun(tests *testing.T) {
+	if runtime.GOOS == "windows" {
+		tests.Skip("unix test")
+	}
+
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "output")
+	injected := filepath.Join(dir, "injected")
+
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+	client := linkClient{currentContext: currentContext, statusRecorder: createStatusRecorder(currentContext)}
+	target := Target{Name: "hooked", Hooks: []HookConfig{
+		{Event: "success", Command: `sh -c 'echo "$0" > ` + output + `' $file`},
+		{Event: "success", Command: `sh -c "echo $file"`},
+		{Event: "success", Command: `sh -c $file`},
+	}}
+	hostile := "/data/a.zip; touch " + injected + " $(touch " + injected + ") `touch " + injected + "`"
+	client.fileEvent(eventSuccess, foundFile{uri: hostile, target: &target}, "uid", nil)
+
+	if _, err = os.Stat(injected); err == nil {
+		tests.Fatal("file name run by the shell")
+	}
+	content, err := ioutil.ReadFile(output)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	if strings.TrimSpace(string(content)) != hostile {
+		tests.Fatal("file name not passed as a whole argument ", string(content))
+	}
+}
+
+func TestBatchHook(tests *testing.T) {
+	if runtime.GOOS == "windows" {
+		tests.Skip("unix test")
+	}
+
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "output")
+
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+	client := linkClient{currentContext: currentContext, statusRecorder: createStatusRecorder(currentContext)}
+	target := Target{Name: "batched", Hooks: []HookConfig{
+		{Event: "skipped", Command: "sh -c 'cp $TC_BATCH " + output + "'", Batch: true},
+	}}
+
+	for index := 0; index < 3; index++ {
+		client.fileEvent(eventSkipped, foundFile{uri: fmt.Sprintf("/data/%d.zip", index), target: &target}, "uid", nil)
+	}
+	if _, err = os.Stat(output); err == nil {
+		tests.Fatal("batch hook run before the end of the cycle")
+	}
+
+	client.targetEvent(eventCycleComplete, &target)
+	content, err := ioutil.ReadFile(output)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	if strings.Count(string(content), `"event":"skipped"`) != 3 || !strings.Contains(string(content), "/data/2.zip") {
+		tests.Fatal("batch file does not hold the events ", string(content))
+	}
+	if len(client.hookBatches.take(batchKey(&target, 0))) != 0 {
+		tests.Fatal("batched events not cleared")
+	}
+}
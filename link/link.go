@@ -4,8 +4,10 @@ package link
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/GeneralElectric/TrueConnect-Link/trueconnect"
 	"io"
+	"net"
 	"os"
 	"os/exec"
 	"sync"
@@ -33,6 +35,9 @@ const (
 	statStopping                 = "Stopping"
 	partialStatus                = "Partial"
 	commandOperation             = "CommandOnUpload"
+	checkStateOperation          = "CheckState"
+	repairedStatus               = "Repaired"
+	uploadChunkSize              = 8000000
 )
 
 type linkClient struct {
@@ -43,6 +48,14 @@ type linkClient struct {
 	fileTransferRecorder fileTransferRecorder
 	statusRecorder       *statusRecorder
 	recorderCancel       context.CancelFunc
+	hookBatches          hookBatches
+	stateUnavailable     error
+	lock                 *clientLock
+	webhooks             *webhookSender
+	metrics              *clientMetrics
+	control              *serviceControl
+	adminListener        net.Listener
+	health               *healthMonitor
 }
 
 // ClientInterface is an interface that defines the publicly accessible methods of the true connect client
@@ -64,27 +77,60 @@ func NewClient(ctx context.Context, args []string) (ClientInterface, error) {
 
 // same as above just testable
 func newClientStruct(ctx context.Context, args []string) (*linkClient, error) {
-	client := &linkClient{}
+	client := &linkClient{metrics: newClientMetrics(), control: newServiceControl(), health: newHealthMonitor()}
 	client.currentContext = ctx
-	client.fileTransferRecorder = createFileTransferRecorder()
 	client.configuration.getConfigurationFromArgs(args)
 	fileName := client.configuration.ClientID + ".recordStatus"
-	err := client.fileTransferRecorder.buildFromStatusEntry(fileName)
-	if err != nil {
-		return nil, err
+	var err error
+	if commandLocks(client.configuration.command) {
+		wait := time.Duration(client.configuration.lockWait) * time.Second
+		if client.configuration.command == SetConfigCommand {
+			// the configuration is changed while no client is running rather than waiting for one to stop
+			wait = 0
+		}
+		client.lock, err = acquireClientLock(ctx, client.configuration.ClientID+".lock", client.configuration.command, wait)
+		if err != nil && client.configuration.command == StatusCommand {
+			// another client is running, the status is then read from the status log alone
+			client.stateUnavailable = err
+		} else if err != nil && client.configuration.command == SetConfigCommand {
+			return nil, fmt.Errorf("%v, stop it before changing the configuration", err)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	// the state file is opened by the check itself so that it can be repaired, changing the configuration only records
+	// the change in the status log
+	if client.lock != nil && client.configuration.command != CheckStateCommand && client.configuration.command != SetConfigCommand {
+		client.fileTransferRecorder, err = openFileTransferRecorder(client.configuration.ClientID+".state", fileName)
+		if err != nil {
+			client.lock.release()
+			return nil, err
+		}
 	}
 	var cancelableContext context.Context
 
 	cancelableContext, client.recorderCancel = context.WithCancel(context.Background())
 	client.statusRecorder, err = createFileStatusRecorder(cancelableContext, fileName)
 	if err != nil {
+		client.fileTransferRecorder.close()
+		client.lock.release()
 		return nil, err
 	}
+	if client.lock != nil && client.lock.stale != nil {
+		client.statusRecorder.recordStatus(systemName, lockOperation, recoveredStatus, "",
+			"took over the lock left by "+client.lock.stale.String()+" which did not stop cleanly")
+	}
+	if skipped := client.fileTransferRecorder.skippedRecords; len(skipped) > 0 {
+		client.statusRecorder.recordStatus(systemName, checkStateOperation, failedStatus, "",
+			fmt.Sprintf("%d records of the status log could not be read when building the state%s", len(skipped), recordNumbers(skipped)))
+	}
 	return client, nil
 }
 
 func (linkClient *linkClient) Dispose() {
 	linkClient.recorderCancel()
+	linkClient.fileTransferRecorder.close()
+	linkClient.lock.release()
 }
 
 // Start method will search the configured targets for files extracting the appropriate metadata before uploading them to
@@ -92,6 +138,12 @@ func (linkClient *linkClient) Dispose() {
 func (linkClient *linkClient) Start() string {
 	linkClient.isStopping = false
 	contextID := linkClient.statusRecorder.recordStatus(systemName, mainOperation, startingStatus, "", "")
+	if linkClient.configuration.force && linkClient.configuration.command != UploadCommand {
+		linkClient.statusRecorder.recordStatus(systemName, mainOperation, failedStatus, contextID, "-force can only be given with -c:Upload")
+		linkClient.isStopping = true
+		linkClient.exitCode = 1
+		return "-force can only be given with -c:Upload\n"
+	}
 	switch linkClient.configuration.command {
 	case UploadCommand:
 		// do nothing
@@ -101,6 +153,30 @@ func (linkClient *linkClient) Start() string {
 		return selfTest()
 	case HelpCommand:
 		return Usage
+	case CheckStateCommand:
+		linkClient.isStopping = true
+		return linkClient.checkState()
+	case DeadLettersCommand:
+		linkClient.isStopping = true
+		return linkClient.listDeadLetters()
+	case RequeueCommand:
+		linkClient.isStopping = true
+		return linkClient.requeue()
+	case StatusCommand:
+		linkClient.isStopping = true
+		return linkClient.status()
+	case ReportCommand:
+		linkClient.isStopping = true
+		return linkClient.report()
+	case ForgetCommand:
+		linkClient.isStopping = true
+		return linkClient.forget()
+	case GetConfigCommand:
+		linkClient.isStopping = true
+		return linkClient.getConfig()
+	case SetConfigCommand:
+		linkClient.isStopping = true
+		return linkClient.setConfig()
 	case StartCommand:
 		err := linkClient.loadConfigWithTargets()
 		if err != nil {
@@ -128,16 +204,29 @@ func (linkClient *linkClient) Start() string {
 		return Usage
 	}
 
+	linkClient.startWebhooks()
+	defer linkClient.webhooks.flush()
+	linkClient.serveMetrics()
+	defer linkClient.metrics.stopServing()
+	linkClient.serveAdmin()
+	defer linkClient.stopAdmin()
+
 	err := linkClient.authenticate()
+	linkClient.health.authenticated(err)
 	if err != nil {
 		linkClient.statusRecorder.recordStatus(systemName, oppTrueConnectAuthentication, failedStatus, contextID, err.Error())
 		linkClient.isStopping = true
 		linkClient.exitCode = 1
 		return err.Error()
 	}
+	linkClient.monitorHealth()
+	defer linkClient.stopHealth()
 
 	foundFiles := linkClient.processTargets(linkClient.configuration.Targets)
 	linkClient.doWork(foundFiles)
+	for index := range linkClient.configuration.Targets {
+		linkClient.flushBatches(&linkClient.configuration.Targets[index])
+	}
 	linkClient.statusRecorder.recordStatus(systemName, mainOperation, statStopping, contextID, "")
 	linkClient.isStopping = true
 	return ""
@@ -156,7 +245,7 @@ func (linkClient *linkClient) doWork(foundFiles *chan foundFile) {
 
 	for i := 0; i < linkClient.configuration.ConcurrentUploads; i++ {
 		waitGroup.Add(1)
-		go func(foundFiles *chan foundFile) {
+		go func(worker int, foundFiles *chan foundFile) {
 
 			for {
 				select {
@@ -168,53 +257,150 @@ func (linkClient *linkClient) doWork(foundFiles *chan foundFile) {
 						waitGroup.Done()
 						return
 					}
-					uid := foundFile.hash + "~" + foundFile.uri
-					foundFile.progress, isOk = linkClient.fileTransferRecorder.startRecord(uid, foundFile.progress)
-					if isOk {
-						linkClient.statusRecorder.recordStatus(systemName, fileUploadOpp, startedStatus, uid, foundFile.uri)
-						progress, err := linkClient.upload(foundFile)
+					// a file taken while uploads are paused waits for them to be resumed
+					if !linkClient.control.waitForUploads(linkClient.currentContext) {
+						waitGroup.Done()
+						return
+					}
+					linkClient.metrics.working(1)
+					linkClient.control.workerBusy(worker, "", foundFile.uri)
+					uid := linkClient.configuration.uid(foundFile)
+					linkClient.control.workerBusy(worker, uid, foundFile.uri)
+					if linkClient.configuration.force {
+						linkClient.forceUpload(&foundFile, uid)
+					}
+					var storeErr error
+					foundFile.progress, isOk, storeErr = linkClient.fileTransferRecorder.startRecord(uid, foundFile.progress)
+					linkClient.recordStateError(uid, storeErr)
+					if isOk && !linkClient.configuration.force && !linkClient.checkVersion(&foundFile, uid) {
+						linkClient.fileTransferRecorder.cancelRecord(uid)
+						linkClient.metrics.add(metricSkipped, foundFile.target.Name, 1)
+						linkClient.fileEvent(eventSkipped, foundFile, uid, nil)
+					} else if isOk && foundFile.target.Extractor != nil && !linkClient.extractMetadata(&foundFile, uid) {
+						linkClient.fileTransferRecorder.cancelRecord(uid)
+						linkClient.statusRecorder.recordDetailedStatus(systemName, fileUploadOpp, heldStatus, uid, foundFile.uri,
+							uploadDetails(foundFile, time.Time{}, nil))
+						linkClient.recordFailure(foundFile, uid, fmt.Errorf("held as the metadata extraction failed"))
+					} else if isOk {
+						started := time.Now()
+						linkClient.statusRecorder.recordDetailedStatus(systemName, fileUploadOpp, startedStatus, uid, foundFile.uri,
+							uploadDetails(foundFile, time.Time{}, nil))
+						if foundFile.progress.Reference != "" && foundFile.progress.Part > 0 {
+							linkClient.metrics.add(metricPartRetries, foundFile.target.Name, 1)
+						}
+						sentBefore := bytesUploaded(foundFile.progress, foundFile.size)
+						uploadContext, finished := linkClient.control.startUpload(linkClient.currentContext, uid, foundFile)
+						progress, err := linkClient.upload(uploadContext, foundFile)
+						cancelled := finished()
+						linkClient.control.workerBusy(worker, uid, foundFile.uri)
+						if err != nil && cancelled {
+							err = fmt.Errorf(errUploadCanceled)
+						}
 						foundFile.progress = progress
-						partial := linkClient.fileTransferRecorder.stopRecord(uid, foundFile.progress)
+						if sent := bytesUploaded(progress, foundFile.size) - sentBefore; sent > 0 {
+							linkClient.metrics.add(metricBytesSent, foundFile.target.Name, float64(sent))
+						}
+						partial, storeErr := linkClient.fileTransferRecorder.stopRecord(uid, foundFile.progress)
+						linkClient.recordStateError(uid, storeErr)
 						if err == nil {
-							linkClient.statusRecorder.recordStatus(systemName, fileUploadOpp, uploadSuccess, uid, foundFile.progress.Reference)
+							linkClient.statusRecorder.recordDetailedStatus(systemName, fileUploadOpp, uploadSuccess, uid,
+								foundFile.progress.Reference, uploadDetails(foundFile, started, nil))
+							linkClient.metrics.uploaded(foundFile.target.Name, time.Since(started))
+							linkClient.recordStateError(uid, linkClient.fileTransferRecorder.clearFailure(uid))
+							linkClient.recordVersion(foundFile, uid)
+							if foundFile.target.receipt() != nil {
+								linkClient.writeReceipt(foundFile, uid)
+							}
+							linkClient.fileEvent(eventSuccess, foundFile, uid, nil)
+							sidecarQueued := false
+							if foundFile.target.Sidecar != nil && foundFile.target.Sidecar.Upload && foundFile.sidecar != "" {
+								sidecarQueued = linkClient.retrySidecar(foundFile, uid, linkClient.uploadSidecar(foundFile))
+							}
 							if foundFile.target.OnSuccess != "" {
 								err := linkClient.ExecuteOnSuccess(foundFile)
 								if err != nil {
 									linkClient.statusRecorder.recordStatus(systemName, commandOperation, failedStatus, uid, err.Error())
 								}
 							}
+							// the file is disposed of once its sidecar has been uploaded
+							if foundFile.target.Disposition != nil && !sidecarQueued {
+								linkClient.dispose(foundFile, uid)
+							}
 						} else {
 							if linkClient.exitCode == 0 {
 								linkClient.exitCode = 2
 							}
 							if !partial || os.IsNotExist(err) {
-								linkClient.statusRecorder.recordStatus(systemName, fileUploadOpp, failedStatus, uid, err.Error())
+								linkClient.statusRecorder.recordDetailedStatus(systemName, fileUploadOpp, failedStatus, uid, err.Error(),
+									uploadDetails(foundFile, started, err))
+								linkClient.metrics.add(metricFailed, foundFile.target.Name, 1)
+								linkClient.fileEvent(eventFailure, foundFile, uid, err)
+								if !cancelled {
+									linkClient.recordFailure(foundFile, uid, err)
+								}
 							} else {
 								progBytes, _ := json.Marshal(progress)
-								linkClient.statusRecorder.recordStatus(systemName, fileUploadOpp, partialStatus, uid, string(progBytes))
-								if !linkClient.isStopping {
+								linkClient.statusRecorder.recordDetailedStatus(systemName, fileUploadOpp, partialStatus, uid,
+									string(progBytes), uploadDetails(foundFile, started, err))
+								linkClient.fileEvent(eventPartial, foundFile, uid, err)
+								if !linkClient.isStopping && !cancelled {
 									linkClient.retryIn(foundFile, 120, foundFiles)
 								}
 							}
 						}
 					} else {
-						linkClient.statusRecorder.recordStatus(systemName, fileUploadOpp, skippedStatus, uid, foundFile.uri)
+						linkClient.statusRecorder.recordStatus(systemName, fileUploadOpp, skippedStatus, uid, skippedComments(foundFile))
+						linkClient.metrics.add(metricSkipped, foundFile.target.Name, 1)
+						linkClient.fileEvent(eventSkipped, foundFile, uid, nil)
+						// an uploaded file is only found again when its disposition did not complete
+						if foundFile.progress.Complete && foundFile.target.receiptMissing(foundFile.uri) {
+							linkClient.writeReceipt(foundFile, uid)
+						}
+						if foundFile.progress.Complete && foundFile.target.Disposition != nil {
+							linkClient.dispose(foundFile, uid)
+						}
 					}
+					linkClient.control.workerIdle(worker)
+					linkClient.metrics.working(-1)
 				}
 			}
-		}(foundFiles)
+		}(i, foundFiles)
 	}
 	waitGroup.Wait()
 }
 
+// uploadDetails gives the typed details of an upload of the found file for the JSON Lines status log, the duration is
+// only given when the upload has started
+func uploadDetails(foundFile foundFile, started time.Time, err error) *StatusDetails {
+	details := &StatusDetails{Path: foundFile.uri, Size: foundFile.size, DataStoreRef: foundFile.progress.Reference}
+	if foundFile.target != nil {
+		details.Target = foundFile.target.Name
+		details.Tenant = foundFile.target.Tenant
+	}
+	if !started.IsZero() {
+		details.Duration = time.Since(started).Seconds()
+	}
+	if err != nil {
+		details.Error = err.Error()
+		details.ErrorCode = errorCode(err)
+	}
+	return details
+}
+
 func (linkClient *linkClient) retryIn(file foundFile, seconds int, foundFiles *chan foundFile) {
+	record := linkClient.configuration.uid(file)
+	retryAt := time.Now().UTC().Add(time.Duration(seconds) * time.Second)
+	linkClient.control.enqueue(record, file, &retryAt)
 	go func() {
+		defer linkClient.control.dequeue(record)
 		select {
 		case <-linkClient.currentContext.Done():
 			return
 		case <-time.After(time.Duration(seconds) * time.Second):
 		}
 		if !linkClient.isStopping {
+			linkClient.metrics.queued(1)
+			defer linkClient.metrics.queued(-1)
 			select {
 			case <-linkClient.currentContext.Done():
 				return
@@ -240,11 +426,20 @@ func (linkClient *linkClient) processTargets(targets []Target) *chan foundFile {
 			// run until either (all files founds are files are found and !linkClient.configuration.RunAsService ) or linkClient.isStopping
 			waitGroup.Add(1)
 			// we spin of a new thread for each target so small files don't have to wait for all the large files to upload before they start
+			linkClient.control.addTarget(&currentTarget)
 			go func() {
 				defer waitGroup.Done()
 				for {
+					if !linkClient.control.waitForTarget(linkClient.currentContext, currentTarget.Name) {
+						return
+					}
+					linkClient.targetEvent(eventStart, &currentTarget)
 					contextID := linkClient.statusRecorder.recordStatus(systemName, currentTarget.Name, searchingStatus, "", currentTarget.Location)
+					searchStarted := time.Now()
+					linkClient.control.searchStarted(currentTarget.Name)
 					err := linkClient.findFiles(currentTarget, foundFiles)
+					linkClient.control.searchFinished(currentTarget.Name, err)
+					linkClient.metrics.observe(metricScanDuration, currentTarget.Name, time.Since(searchStarted).Seconds())
 					if err != nil && err != io.EOF {
 						linkClient.exitCode = 1
 						if err.Error() != errTerminating {
@@ -253,6 +448,7 @@ func (linkClient *linkClient) processTargets(targets []Target) *chan foundFile {
 						return
 					}
 					linkClient.statusRecorder.recordStatus(systemName, currentTarget.Name, statSearchComplete, contextID, currentTarget.Location)
+					linkClient.targetEvent(eventCycleComplete, &currentTarget)
 					if !linkClient.configuration.RunAsService || linkClient.isStopping {
 						return
 					}
@@ -260,6 +456,7 @@ func (linkClient *linkClient) processTargets(targets []Target) *chan foundFile {
 					select {
 					case <-linkClient.currentContext.Done():
 						return
+					case <-linkClient.control.scanRequested(currentTarget.Name):
 					case <-time.After(time.Duration(currentTarget.PollInterval) * time.Second):
 					}
 				}
@@ -274,6 +471,7 @@ func (linkClient *linkClient) processTargets(targets []Target) *chan foundFile {
 
 func (linkClient *linkClient) authenticate() error {
 
+	linkClient.metrics.authenticated()
 	_, err := getScopes(
 		linkClient.configuration.TokenURL,
 		linkClient.configuration.ClientID,
@@ -285,19 +483,30 @@ func (linkClient *linkClient) authenticate() error {
 	return nil
 }
 
-func (linkClient *linkClient) upload(foundFile foundFile) (trueconnect.UploadProgress, error) {
+func (linkClient *linkClient) upload(ctx context.Context, foundFile foundFile) (trueconnect.UploadProgress, error) {
 
-	meta := foundFile.getMetadata()
+	meta := linkClient.uploadMetadata(foundFile)
 
-	tcwrapper := trueconnect.CreateWrapper(linkClient.configuration.TokenURL, linkClient.configuration.ClientID, linkClient.configuration.Secret, linkClient.configuration.Endpoint, 8000000)
+	tcwrapper := trueconnect.CreateWrapper(linkClient.configuration.TokenURL, linkClient.configuration.ClientID, linkClient.configuration.Secret, linkClient.configuration.Endpoint, uploadChunkSize)
 
-	progress, err := tcwrapper.PostToTC(linkClient.currentContext, foundFile.progress, foundFile.uri, meta)
+	progress, err := tcwrapper.PostToTC(ctx, foundFile.progress, foundFile.uri, meta)
 	if err != nil {
 		progress.FailedAttempts++
 	}
 	return progress, err
 }
 
+// uploadMetadata gives the metadata to upload with the found file, recording a warning for each value that could not
+// be transformed and is uploaded as it was found
+func (linkClient *linkClient) uploadMetadata(foundFile foundFile) map[string]trueconnect.MetadataValue {
+	meta, errs := foundFile.metadata()
+	for _, err := range errs {
+		linkClient.statusRecorder.recordStatus(systemName, fileUploadOpp, warningStatus, linkClient.configuration.uid(foundFile),
+			foundFile.uri+": "+err.Error())
+	}
+	return meta
+}
+
 func (linkClient *linkClient) ExecuteOnSuccess(foundFile foundFile) error {
 
 	cmd := exec.Command(foundFile.target.OnSuccess, foundFile.uri, foundFile.progress.Reference)
@@ -39,6 +39,8 @@ func TestNewClient(tests *testing.T) {
 		"-e:http://www.somesite.com/tc?action=upload",
 		"-tokurl:https://some.real.long.url.that.looks.meaningless/stuff",
 	}
+	defer os.Remove("User1.state")
+	defer os.Remove("User1.lock")
 	currentContext, cancelFunction := context.WithCancel(context.Background())
 	client, err := newClientStruct(currentContext, args)
 	cancelFunction()
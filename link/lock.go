@@ -0,0 +1,133 @@
+package link
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// The operation and status recorded when a lock left by a client that did not stop cleanly is taken over, and how often
+// a client waiting for the lock tries again
+const (
+	lockOperation     = "ClientLock"
+	recoveredStatus   = "Recovered"
+	lockRetryInterval = 500 * time.Millisecond
+)
+
+// lockHolder is written to the lock file by the client holding it, so a second client can say which process is running.
+// The file is emptied when the client stops, one that is not empty when the lock is taken was left by a client that
+// did not stop cleanly
+type lockHolder struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Command string    `json:"command"`
+	Started time.Time `json:"started"`
+}
+
+// clientLock is an exclusive lock on the lock file of a client ID, held from when the client starts until it is disposed
+// of so that only one client uses the state and status log of the client ID. The operating system releases the lock
+// when the process ends however it ends
+type clientLock struct {
+	file *os.File
+	// the holder recorded in the lock file when it was taken, set when the previous client did not stop cleanly
+	stale *lockHolder
+}
+
+func (holder lockHolder) String() string {
+	return fmt.Sprintf("process %d on %s running %s since %s", holder.PID, holder.Host, holder.Command, holder.Started.Format(time.RFC3339))
+}
+
+// acquireClientLock takes the lock on the lock file, waiting up to wait for a client already holding it to stop
+func acquireClientLock(ctx context.Context, fileName string, command string, wait time.Duration) (*clientLock, error) {
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		locked, err := lockFile(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("could not lock %s: %v", fileName, err)
+		}
+		if locked {
+			break
+		}
+		if !time.Now().Before(deadline) {
+			file.Close()
+			message := "another client is already running with this client ID"
+			if holder, exists := readLockHolder(fileName); exists {
+				message = "another client is already running with this client ID as " + holder.String()
+			}
+			return nil, fmt.Errorf("%s, the lock file is %s", message, fileName)
+		}
+		select {
+		case <-ctx.Done():
+			file.Close()
+			return nil, fmt.Errorf("stopped waiting for the lock on %s", fileName)
+		case <-time.After(lockRetryInterval):
+		}
+	}
+
+	lock := &clientLock{file: file}
+	if holder, exists := readLockHolder(fileName); exists {
+		lock.stale = &holder
+	}
+	host, _ := os.Hostname()
+	data, _ := json.Marshal(lockHolder{PID: os.Getpid(), Host: host, Command: command, Started: time.Now().UTC()})
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt(data, 0)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		lock.release()
+		return nil, fmt.Errorf("could not write %s: %v", fileName, err)
+	}
+	return lock, nil
+}
+
+func readLockHolder(fileName string) (lockHolder, bool) {
+	var holder lockHolder
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil || len(strings.TrimSpace(string(data))) == 0 {
+		return holder, false
+	}
+	// a file that cannot be read was still left behind by a client that did not stop cleanly
+	json.Unmarshal(data, &holder)
+	return holder, true
+}
+
+// release empties the lock file, marking a clean stop, and releases the lock. It is safe to call on a nil lock
+func (lock *clientLock) release() error {
+	if lock == nil || lock.file == nil {
+		return nil
+	}
+	lock.file.Truncate(0)
+	lock.file.Sync()
+	err := unlockFile(lock.file)
+	closeErr := lock.file.Close()
+	lock.file = nil
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// commandLocks returns true when the command uses the state of the client ID and so must be the only client using it.
+// SetConfig only writes to the status log, but that is written, rotated and compacted by a running client. Commands
+// not listed, including any that are not recognised, do not lock
+func commandLocks(command string) bool {
+	switch command {
+	case UploadCommand, StartCommand, AutoCommand, CheckStateCommand, DeadLettersCommand, RequeueCommand, StatusCommand,
+		ForgetCommand, SetConfigCommand:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package link
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientLock(tests *testing.T) {
+	dir, err := ioutil.TempDir("", "lock")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "client.lock")
+
+	first, err := acquireClientLock(context.Background(), fileName, AutoCommand, 0)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	if first.stale != nil {
+		tests.Fatal("new lock file treated as stale")
+	}
+	_, err = acquireClientLock(context.Background(), fileName, AutoCommand, 0)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("process %d", os.Getpid())) {
+		tests.Fatal("second lock not refused with the holder ", err)
+	}
+
+	go func() {
+		time.Sleep(time.Second)
+		first.release()
+	}()
+	second, err := acquireClientLock(context.Background(), fileName, StartCommand, 5*time.Second)
+	if err != nil {
+		tests.Fatal("lock not taken after waiting ", err)
+	}
+	if second.stale != nil {
+		tests.Fatal("lock released cleanly treated as stale")
+	}
+	second.release()
+	if data, _ := ioutil.ReadFile(fileName); len(data) != 0 {
+		tests.Fatal("lock file not emptied when released")
+	}
+}
+
+func TestStaleClientLock(tests *testing.T) {
+	dir, err := ioutil.TempDir("", "lock")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "client.lock")
+	// left by a client that crashed
+	data, _ := json.Marshal(lockHolder{PID: 99999, Host: "crashed", Command: AutoCommand})
+	if err = ioutil.WriteFile(fileName, data, 0600); err != nil {
+		tests.Fatal(err)
+	}
+
+	lock, err := acquireClientLock(context.Background(), fileName, AutoCommand, 0)
+	if err != nil {
+		tests.Fatal("stale lock not taken over ", err)
+	}
+	defer lock.release()
+	if lock.stale == nil || lock.stale.PID != 99999 {
+		tests.Fatal("stale lock not detected")
+	}
+	if holder, _ := readLockHolder(fileName); holder.PID != os.Getpid() {
+		tests.Fatal("lock file does not name the new holder ", holder)
+	}
+}
+
+func TestCommandLocks(tests *testing.T) {
+	for _, command := range []string{UploadCommand, AutoCommand, ForgetCommand, SetConfigCommand} {
+		if !commandLocks(command) {
+			tests.Fatal(command, " does not lock")
+		}
+	}
+	for _, command := range []string{HelpCommand, ReportCommand, GetConfigCommand, "Unknown", ""} {
+		if commandLocks(command) {
+			tests.Fatal(command, " locks")
+		}
+	}
+}
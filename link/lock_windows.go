@@ -0,0 +1,48 @@
+//go:build windows
+// +build windows
+
+package link
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Flags and errors of LockFileEx, the lock is taken on a byte range past the end of the file so that the process
+// holding it does not stop others reading who holds it
+const (
+	lockfileFailImmediately               = 0x1
+	lockfileExclusiveLock                 = 0x2
+	lockOffsetHigh                        = 0x1
+	errorLockViolation      syscall.Errno = 33
+)
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+// lockFile takes an exclusive lock on the file without waiting, false is returned when another process holds it
+func lockFile(file *os.File) (bool, error) {
+	overlapped := syscall.Overlapped{OffsetHigh: lockOffsetHigh}
+	result, _, err := procLockFileEx.Call(file.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0,
+		uintptr(unsafe.Pointer(&overlapped)))
+	if result != 0 {
+		return true, nil
+	}
+	if err == errorLockViolation || err == syscall.ERROR_IO_PENDING {
+		return false, nil
+	}
+	return false, err
+}
+
+func unlockFile(file *os.File) error {
+	overlapped := syscall.Overlapped{OffsetHigh: lockOffsetHigh}
+	result, _, err := procUnlockFileEx.Call(file.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if result == 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package link
+
+// pathEncodedMetadata gives the values of the metadata tags found in the file path, the named groups of the target
+// path pattern are applied first so that individually configured tags take precedence
+func (target *Target) pathEncodedMetadata(filePath string) map[string]string {
+	values := make(map[string]string)
+	if target.compiled == nil && target.compile() != nil {
+		return values
+	}
+
+	if pattern := target.compiled.pathPattern; pattern != nil {
+		indexes := pattern.FindStringSubmatchIndex(filePath)
+		if indexes != nil {
+			for group, name := range pattern.SubexpNames() {
+				// groups that are unnamed or did not take part in the match are ignored
+				if name == "" || indexes[2*group] < 0 {
+					continue
+				}
+				values[name] = filePath[indexes[2*group]:indexes[2*group+1]]
+			}
+		}
+	}
+
+	for _, lookup := range target.compiled.pathTags {
+		matchedPatterns := lookup.regex.FindStringSubmatch(filePath)
+		if len(matchedPatterns) > 1 {
+			values[lookup.tag] = matchedPatterns[1]
+		}
+	}
+
+	return values
+}
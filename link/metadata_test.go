@@ -0,0 +1,75 @@
+package link
+
+import (
+	"testing"
+)
+
+func TestPathPatternNamedGroups(tests *testing.T) {
+	target := Target{
+		PathPattern: `(?P<TailNo>[^_/]{1,7})_*-(?P<EngPos>.{3})-FFD-(?P<FlightDate>\d{8}-\d{6})(-(?P<Optional>X))?\.FFD$`,
+		PathEncodedMetaDataTags: []PathEncodedMetaDataTag{
+			{Tag: "EngPos", Match: `-(\d)..-FFD`},
+		},
+	}
+
+	values := target.pathEncodedMetadata("/data/F-GZCA_-1L_-FFD-20170412-101500.FFD")
+	if values["TailNo"] != "F-GZCA" {
+		tests.Fatal(values["TailNo"] + ": TailNo not populated from named group")
+	}
+	if values["FlightDate"] != "20170412-101500" {
+		tests.Fatal(values["FlightDate"] + ": FlightDate not populated from named group")
+	}
+	if values["EngPos"] != "1" {
+		tests.Fatal(values["EngPos"] + ": individual tag did not take precedence over named group")
+	}
+	if _, exists := values["Optional"]; exists {
+		tests.Fatal("group that did not take part in the match was populated")
+	}
+}
+
+func TestPathPatternNoMatch(tests *testing.T) {
+	target := Target{PathPattern: `(?P<TailNo>\d+)\.abc$`}
+	if len(target.pathEncodedMetadata("/data/file.xyz")) != 0 {
+		tests.Fatal("metadata populated from a path that did not match")
+	}
+}
+
+// the FFD file names found by the FindTestFiles target of the example configuration, each segment is padded with
+// underscores to its fixed width
+func TestExamplePathPatternPadding(tests *testing.T) {
+	client := linkClient{}
+	err := client.loadConfig("../docs/example_config.json")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	var target Target
+	for _, configured := range client.configuration.Targets {
+		if configured.Name == "FindTestFiles" {
+			target = configured
+		}
+	}
+	names := []struct {
+		name   string
+		values map[string]string
+	}{
+		{"170912-104530-AF0123____-LFPGKJFK-AF_FGZC__-1-956123-0A01FFD",
+			map[string]string{"FlightNo": "AF0123", "CityPair": "LFPGKJFK", "IATA": "AF", "TailNo": "FGZC", "EngPos": "1"}},
+		{"170912-104530-AF0123____-LFPGKJFK-AFFGZCA__-2-956123-0A01FFD",
+			map[string]string{"FlightNo": "AF0123", "CityPair": "LFPGKJFK", "IATA": "AF", "TailNo": "FGZCA", "EngPos": "2"}},
+		{"170912-104530-AF01234567-LFPG____-AFFGZCABC-1-956123-0A01FFD",
+			map[string]string{"FlightNo": "AF01234567", "CityPair": "LFPG", "IATA": "AF", "TailNo": "FGZCABC", "EngPos": "1"}},
+		{"170912-104530-AF-1234___-LFPGKJFK-AF_FGZCA_-1-956123-0A01FFD",
+			map[string]string{"FlightNo": "AF-1234", "CityPair": "LFPGKJFK", "IATA": "AF", "TailNo": "FGZCA", "EngPos": "1"}},
+	}
+	for _, test := range names {
+		values := target.pathEncodedMetadata("/data/" + test.name)
+		test.values["FlightDate"] = "170912-104530"
+		test.values["ESN"] = "956123"
+		test.values["SPN"] = "0A01"
+		for tag, expected := range test.values {
+			if values[tag] != expected {
+				tests.Fatal(test.name, ": ", tag, " is ", values[tag], " not ", expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package link
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/GeneralElectric/TrueConnect-Link/trueconnect"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The operation recorded when the metrics endpoint starts or fails, the path it serves metrics on by default and the
+// names of the metrics
+const (
+	metricsOperation     = "Metrics"
+	defaultMetricsPath   = "/metrics"
+	metricDiscovered     = "tclink_files_discovered_total"
+	metricUploaded       = "tclink_files_uploaded_total"
+	metricFailed         = "tclink_files_failed_total"
+	metricSkipped        = "tclink_files_skipped_total"
+	metricBytesSent      = "tclink_bytes_sent_total"
+	metricPartRetries    = "tclink_part_retries_total"
+	metricUploadDuration = "tclink_upload_duration_seconds"
+	metricScanDuration   = "tclink_scan_duration_seconds"
+	metricQueueDepth     = "tclink_queue_depth"
+	metricActiveWorkers  = "tclink_active_workers"
+	metricTokenRefreshes = "tclink_token_refreshes_total"
+	metricLastSuccess    = "tclink_last_success_timestamp_seconds"
+	metricSinceSuccess   = "tclink_seconds_since_last_success"
+	metricTypeCounter    = "counter"
+	metricTypeGauge      = "gauge"
+	metricTypeHistogram  = "histogram"
+	metricsContentType   = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// metricDefinition describes a metric served to Prometheus
+type metricDefinition struct {
+	name    string
+	help    string
+	kind    string
+	buckets []float64
+}
+
+// the metrics kept for each target, in the order they are served
+var targetMetrics = []metricDefinition{
+	{metricDiscovered, "Files found by the search of a target", metricTypeCounter, nil},
+	{metricUploaded, "Files uploaded", metricTypeCounter, nil},
+	{metricFailed, "Uploads that failed", metricTypeCounter, nil},
+	{metricSkipped, "Files skipped as they were already uploaded", metricTypeCounter, nil},
+	{metricBytesSent, "Bytes of file content sent to TrueConnect", metricTypeCounter, nil},
+	{metricPartRetries, "Partial uploads resumed from the last part sent", metricTypeCounter, nil},
+	{metricUploadDuration, "Seconds taken by successful uploads", metricTypeHistogram, []float64{1, 5, 15, 30, 60, 300, 900, 1800, 3600}},
+	{metricScanDuration, "Seconds taken by each search of a target", metricTypeHistogram, []float64{0.1, 0.5, 1, 5, 15, 60, 300}},
+}
+
+// metricSeries is the value of a metric for one target, a histogram counts the observations in each of its buckets
+type metricSeries struct {
+	value  float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// clientMetrics keeps the metrics of the client while it runs, its methods are safe to call on a nil value so code
+// that records metrics does not need to know whether they are being served
+type clientMetrics struct {
+	mutex          sync.Mutex
+	series         map[string]map[string]*metricSeries
+	queueDepth     int64
+	activeWorkers  int64
+	authentication int64
+	lastSuccess    time.Time
+	listener       net.Listener
+}
+
+func newClientMetrics() *clientMetrics {
+	return &clientMetrics{series: make(map[string]map[string]*metricSeries)}
+}
+
+func metricDefinitionOf(name string) metricDefinition {
+	for _, definition := range targetMetrics {
+		if definition.name == name {
+			return definition
+		}
+	}
+	return metricDefinition{name: name, kind: metricTypeCounter}
+}
+
+func (metrics *clientMetrics) seriesOf(name string, target string) *metricSeries {
+	byTarget, exists := metrics.series[name]
+	if !exists {
+		byTarget = make(map[string]*metricSeries)
+		metrics.series[name] = byTarget
+	}
+	series, exists := byTarget[target]
+	if !exists {
+		series = &metricSeries{counts: make([]uint64, len(metricDefinitionOf(name).buckets))}
+		byTarget[target] = series
+	}
+	return series
+}
+
+// add increases the counter of the target by value
+func (metrics *clientMetrics) add(name string, target string, value float64) {
+	if metrics == nil {
+		return
+	}
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.seriesOf(name, target).value += value
+}
+
+// observe adds a value to the histogram of the target
+func (metrics *clientMetrics) observe(name string, target string, value float64) {
+	if metrics == nil {
+		return
+	}
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	series := metrics.seriesOf(name, target)
+	for index, bound := range metricDefinitionOf(name).buckets {
+		if value <= bound {
+			series.counts[index]++
+		}
+	}
+	series.sum += value
+	series.count++
+}
+
+// queued changes the number of found files waiting for a free upload worker by change
+func (metrics *clientMetrics) queued(change int64) {
+	if metrics == nil {
+		return
+	}
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.queueDepth += change
+}
+
+// working changes the number of upload workers busy with a file by change
+func (metrics *clientMetrics) working(change int64) {
+	if metrics == nil {
+		return
+	}
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.activeWorkers += change
+}
+
+// authenticated counts the tokens requested to check the client can authenticate
+func (metrics *clientMetrics) authenticated() {
+	if metrics == nil {
+		return
+	}
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.authentication++
+}
+
+// uploaded records a successful upload of a file of the target
+func (metrics *clientMetrics) uploaded(target string, duration time.Duration) {
+	if metrics == nil {
+		return
+	}
+	metrics.add(metricUploaded, target, 1)
+	metrics.observe(metricUploadDuration, target, duration.Seconds())
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.lastSuccess = time.Now()
+}
+
+// sinceLastSuccess gives how long ago a file was last uploaded, false when none has been uploaded since the client
+// started
+func (metrics *clientMetrics) sinceLastSuccess() (time.Duration, bool) {
+	if metrics == nil {
+		return 0, false
+	}
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	if metrics.lastSuccess.IsZero() {
+		return 0, false
+	}
+	return time.Since(metrics.lastSuccess), true
+}
+
+// bytesUploaded gives the bytes of a file of the size that the progress shows have been sent
+func bytesUploaded(progress trueconnect.UploadProgress, size int64) int64 {
+	if progress.Complete {
+		return size
+	}
+	sent := int64(progress.Part) * uploadChunkSize
+	if sent > size {
+		return size
+	}
+	return sent
+}
+
+// write gives the metrics in the Prometheus text exposition format
+func (metrics *clientMetrics) write() string {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	var buffer bytes.Buffer
+	for _, definition := range targetMetrics {
+		fmt.Fprintf(&buffer, "# HELP %s %s\n# TYPE %s %s\n", definition.name, definition.help, definition.name, definition.kind)
+		byTarget := metrics.series[definition.name]
+		var targets []string
+		for target := range byTarget {
+			targets = append(targets, target)
+		}
+		sort.Strings(targets)
+		for _, target := range targets {
+			series := byTarget[target]
+			label := `target="` + escapeLabel(target) + `"`
+			if definition.kind != metricTypeHistogram {
+				fmt.Fprintf(&buffer, "%s{%s} %s\n", definition.name, label, formatMetric(series.value))
+				continue
+			}
+			for index, bound := range definition.buckets {
+				fmt.Fprintf(&buffer, "%s_bucket{%s,le=\"%s\"} %d\n", definition.name, label, formatMetric(bound), series.counts[index])
+			}
+			fmt.Fprintf(&buffer, "%s_bucket{%s,le=\"+Inf\"} %d\n", definition.name, label, series.count)
+			fmt.Fprintf(&buffer, "%s_sum{%s} %s\n", definition.name, label, formatMetric(series.sum))
+			fmt.Fprintf(&buffer, "%s_count{%s} %d\n", definition.name, label, series.count)
+		}
+	}
+
+	writeGauge := func(name string, help string, kind string, value float64) {
+		fmt.Fprintf(&buffer, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, kind, name, formatMetric(value))
+	}
+	writeGauge(metricQueueDepth, "Found files waiting for a free upload worker", metricTypeGauge, float64(metrics.queueDepth))
+	writeGauge(metricActiveWorkers, "Upload workers busy with a file", metricTypeGauge, float64(metrics.activeWorkers))
+	writeGauge(metricTokenRefreshes, "Tokens requested from the token URL", metricTypeCounter,
+		float64(metrics.authentication+trueconnect.TokenRequests()))
+	if !metrics.lastSuccess.IsZero() {
+		writeGauge(metricLastSuccess, "When a file was last uploaded as seconds since the epoch", metricTypeGauge,
+			float64(metrics.lastSuccess.UnixNano())/float64(time.Second))
+		writeGauge(metricSinceSuccess, "Seconds since a file was last uploaded", metricTypeGauge, time.Since(metrics.lastSuccess).Seconds())
+	}
+	return buffer.String()
+}
+
+func formatMetric(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// serveMetrics starts the metrics endpoint when it is configured, it is stopped by stopServing
+func (linkClient *linkClient) serveMetrics() {
+	config := linkClient.configuration.Metrics
+	if config == nil || config.Address == "" {
+		return
+	}
+	path := config.Path
+	if path == "" {
+		path = defaultMetricsPath
+	}
+	listener, err := net.Listen("tcp", config.Address)
+	if err != nil {
+		linkClient.statusRecorder.recordStatus(systemName, metricsOperation, failedStatus, "", err.Error())
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", metricsContentType)
+		writer.Write([]byte(linkClient.metrics.write()))
+	})
+	linkClient.metrics.mutex.Lock()
+	linkClient.metrics.listener = listener
+	linkClient.metrics.mutex.Unlock()
+	go http.Serve(listener, mux)
+	linkClient.statusRecorder.recordStatus(systemName, metricsOperation, startedStatus, "", "http://"+listener.Addr().String()+path)
+}
+
+// stopServing closes the metrics endpoint, it is safe to call when it was not started
+func (metrics *clientMetrics) stopServing() {
+	if metrics == nil {
+		return
+	}
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	if metrics.listener != nil {
+		metrics.listener.Close()
+		metrics.listener = nil
+	}
+}
@@ -0,0 +1,76 @@
+package link
+
+import (
+	"context"
+	"github.com/GeneralElectric/TrueConnect-Link/trueconnect"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsExposition(tests *testing.T) {
+	metrics := newClientMetrics()
+	metrics.add(metricDiscovered, "Data", 2)
+	metrics.add(metricBytesSent, `Quoted "target"`, 1024)
+	metrics.uploaded("Data", 3*time.Second)
+	metrics.queued(2)
+	metrics.working(1)
+
+	text := metrics.write()
+	for _, line := range []string{
+		"# TYPE tclink_files_discovered_total counter",
+		`tclink_files_discovered_total{target="Data"} 2`,
+		`tclink_bytes_sent_total{target="Quoted \"target\""} 1024`,
+		`tclink_upload_duration_seconds_bucket{target="Data",le="1"} 0`,
+		`tclink_upload_duration_seconds_bucket{target="Data",le="5"} 1`,
+		`tclink_upload_duration_seconds_bucket{target="Data",le="+Inf"} 1`,
+		`tclink_upload_duration_seconds_sum{target="Data"} 3`,
+		"tclink_queue_depth 2",
+		"tclink_active_workers 1",
+		"# TYPE tclink_seconds_since_last_success gauge",
+	} {
+		if !strings.Contains(text, line+"\n") {
+			tests.Fatal("metrics do not include ", line, "\n", text)
+		}
+	}
+
+	var missing *clientMetrics
+	missing.add(metricFailed, "Data", 1)
+	if _, exists := missing.sinceLastSuccess(); exists {
+		tests.Fatal("nil metrics have a last success")
+	}
+}
+
+func TestBytesUploaded(tests *testing.T) {
+	if bytesUploaded(trueconnect.UploadProgress{Part: 1}, 3*uploadChunkSize) != uploadChunkSize ||
+		bytesUploaded(trueconnect.UploadProgress{Part: 2}, uploadChunkSize+10) != uploadChunkSize+10 ||
+		bytesUploaded(trueconnect.UploadProgress{Complete: true}, 10) != 10 {
+		tests.Fatal("wrong bytes uploaded")
+	}
+}
+
+func TestServeMetrics(tests *testing.T) {
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+	client := linkClient{currentContext: currentContext, statusRecorder: createStatusRecorder(currentContext), metrics: newClientMetrics()}
+	client.configuration.Metrics = &MetricsConfig{Address: "127.0.0.1:0"}
+	client.serveMetrics()
+	defer client.metrics.stopServing()
+	if client.metrics.listener == nil {
+		tests.Fatal("metrics endpoint not started")
+	}
+	client.metrics.add(metricFailed, "Data", 1)
+
+	response, err := http.Get("http://" + client.metrics.listener.Addr().String() + defaultMetricsPath)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	if !strings.HasPrefix(response.Header.Get("Content-Type"), "text/plain") ||
+		!strings.Contains(string(body), `tclink_files_failed_total{target="Data"} 1`) {
+		tests.Fatal("metrics not served ", string(body))
+	}
+}
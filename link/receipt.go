@@ -0,0 +1,113 @@
+package link
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// Receipt defaults and the operation used to record receipts being written
+const (
+	defaultReceiptSuffix = ".tcreceipt.json"
+	receiptOperation     = "UploadReceipt"
+)
+
+// uploadReceipt is written next to an uploaded file to record where it was uploaded to and what was sent
+type uploadReceipt struct {
+	DataStoreRef string            `json:"data_store_ref"`
+	Endpoint     string            `json:"endpoint"`
+	Tenant       string            `json:"tenant"`
+	Target       string            `json:"target"`
+	File         string            `json:"file"`
+	Size         int64             `json:"size"`
+	Hashes       map[string]string `json:"hashes"`
+	Uploaded     time.Time         `json:"uploaded"`
+	Metadata     map[string]string `json:"metadata"`
+}
+
+func (receipt *ReceiptConfig) suffix() string {
+	if receipt.Suffix == "" {
+		return defaultReceiptSuffix
+	}
+	return receipt.Suffix
+}
+
+// receipt gives the receipt settings of the target, the receipt disposition writes receipts with the default settings
+// when there are none, nil is returned when the target does not write receipts
+func (target *Target) receipt() *ReceiptConfig {
+	if target.Receipt != nil {
+		return target.Receipt
+	}
+	if target.Disposition != nil && strings.ToLower(target.Disposition.Action) == dispositionReceipt {
+		return &ReceiptConfig{}
+	}
+	return nil
+}
+
+func (target *Target) receiptPath(filePath string) string {
+	return filePath + target.receipt().suffix()
+}
+
+func (linkClient *linkClient) newUploadReceipt(foundFile foundFile) uploadReceipt {
+	receipt := uploadReceipt{
+		DataStoreRef: foundFile.progress.Reference,
+		Endpoint:     linkClient.configuration.Endpoint,
+		Tenant:       foundFile.target.Tenant,
+		Target:       foundFile.target.Name,
+		File:         foundFile.uri,
+		Size:         foundFile.size,
+		Hashes:       map[string]string{sha256Hash: foundFile.hash},
+		Uploaded:     time.Now().UTC(),
+		Metadata:     make(map[string]string),
+	}
+	for key, value := range foundFile.getMetadata() {
+		receipt.Metadata[key] = value.Value
+	}
+	return receipt
+}
+
+// writeReceipt writes the receipt of an uploaded file next to it
+func (linkClient *linkClient) writeReceipt(foundFile foundFile, uid string) error {
+	receiptPath := foundFile.target.receiptPath(foundFile.uri)
+	data, err := json.MarshalIndent(linkClient.newUploadReceipt(foundFile), "", "  ")
+	if err == nil {
+		err = writeFileAtomically(receiptPath, data, 0644)
+	}
+	if err != nil {
+		linkClient.statusRecorder.recordStatus(systemName, receiptOperation, failedStatus, uid, err.Error())
+		return err
+	}
+	linkClient.statusRecorder.recordStatus(systemName, receiptOperation, uploadSuccess, uid, receiptPath)
+	return nil
+}
+
+// recogniseReceipt reads the receipt next to the found file and marks the file as uploaded when the receipt is for the
+// same content uploaded to the same endpoint and tenant, so files are not uploaded again after the local state is lost
+func (linkClient *linkClient) recogniseReceipt(foundFile *foundFile) bool {
+	data, err := ioutil.ReadFile(foundFile.target.receiptPath(foundFile.uri))
+	if err != nil {
+		return false
+	}
+	var receipt uploadReceipt
+	if json.Unmarshal(data, &receipt) != nil {
+		return false
+	}
+	if receipt.DataStoreRef == "" || receipt.Hashes[sha256Hash] != foundFile.hash ||
+		receipt.Tenant != foundFile.target.Tenant || receipt.Endpoint != linkClient.configuration.Endpoint {
+		return false
+	}
+	foundFile.progress.Reference = receipt.DataStoreRef
+	foundFile.progress.Complete = true
+	return true
+}
+
+// receiptMissing returns true when the target writes receipts and the uploaded file does not have one
+func (target *Target) receiptMissing(filePath string) bool {
+	if target.receipt() == nil {
+		return false
+	}
+	_, err := os.Stat(target.receiptPath(filePath))
+	return os.IsNotExist(err)
+}
@@ -0,0 +1,87 @@
+package link
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/GeneralElectric/TrueConnect-Link/trueconnect"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWriteReceipt(tests *testing.T) {
+	testfile, err := CreateTestFile("./TestWriteReceipt/testfile1.abc")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	defer os.RemoveAll("./TestWriteReceipt")
+
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+	client := linkClient{currentContext: currentContext, statusRecorder: createStatusRecorder(currentContext), configuration: Configuration{Endpoint: "https://tc.example.com"}}
+	target := Target{Name: "test", Tenant: "tenant1", Disposition: &DispositionConfig{Action: "receipt"}}
+	found := foundFile{uri: testfile, size: 10, hash: "deadface", target: &target, progress: trueconnect.UploadProgress{Reference: "ref1", Complete: true}}
+	client.writeReceipt(found, "uid")
+
+	data, err := ioutil.ReadFile(testfile + defaultReceiptSuffix)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	var receipt uploadReceipt
+	if err = json.Unmarshal(data, &receipt); err != nil {
+		tests.Fatal(err)
+	}
+	if receipt.DataStoreRef != "ref1" || receipt.Hashes[sha256Hash] != "deadface" || receipt.Endpoint != "https://tc.example.com" ||
+		receipt.Tenant != "tenant1" || receipt.Size != 10 || time.Since(receipt.Uploaded) > time.Minute {
+		tests.Fatal("receipt content not as expected ", receipt)
+	}
+	if receipt.Metadata[trueconnect.OriginalFileName] != testfile {
+		tests.Fatal("receipt does not hold the metadata sent ", receipt.Metadata)
+	}
+
+	if err = target.compile(); err != nil {
+		tests.Fatal(err)
+	}
+	if target.accepts(testfile+defaultReceiptSuffix, testFileInfo{size: 10}, time.Now()) {
+		tests.Fatal("receipt accepted for upload")
+	}
+	if target.receiptMissing(testfile) {
+		tests.Fatal("written receipt reported missing")
+	}
+}
+
+func TestRecogniseReceipt(tests *testing.T) {
+	testfile, err := CreateTestFile("./TestRecogniseReceipt/testfile1.abc")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	defer os.RemoveAll("./TestRecogniseReceipt")
+
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+	client := linkClient{currentContext: currentContext, statusRecorder: createStatusRecorder(currentContext), configuration: Configuration{Endpoint: "https://tc.example.com"}}
+	target := Target{Tenant: "tenant1", Receipt: &ReceiptConfig{Suffix: ".receipt"}}
+	client.writeReceipt(foundFile{uri: testfile, hash: "deadface", target: &target, progress: trueconnect.UploadProgress{Reference: "ref1", Complete: true}}, "uid")
+
+	found := foundFile{uri: testfile, hash: "deadface", target: &target}
+	if !client.recogniseReceipt(&found) || !found.progress.Complete || found.progress.Reference != "ref1" {
+		tests.Fatal("receipt not recognised")
+	}
+
+	changed := foundFile{uri: testfile, hash: "beefcafe", target: &target}
+	if client.recogniseReceipt(&changed) || changed.progress.Complete {
+		tests.Fatal("receipt recognised for changed content")
+	}
+
+	client.configuration.Endpoint = "https://other.example.com"
+	found = foundFile{uri: testfile, hash: "deadface", target: &target}
+	if client.recogniseReceipt(&found) {
+		tests.Fatal("receipt recognised for another endpoint")
+	}
+
+	recorder := createFileTransferRecorder()
+	if _, isOk, _ := recorder.startRecord("uid", trueconnect.UploadProgress{Reference: "ref1", Complete: true}); isOk {
+		tests.Fatal("file with a receipt started")
+	}
+}
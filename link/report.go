@@ -0,0 +1,250 @@
+package link
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/GeneralElectric/TrueConnect-Link/trueconnect"
+	"html/template"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The formats the Report command can write and the status given to attempts with no recorded outcome
+const (
+	formatJSONLines   = "jsonl"
+	formatHTML        = "html"
+	interruptedStatus = "Interrupted"
+)
+
+// reportRow describes one attempt to upload a file, from the Started entry to the entry recording its outcome
+type reportRow struct {
+	Started      time.Time         `json:"started"`
+	Finished     *time.Time        `json:"finished,omitempty"`
+	Target       string            `json:"target"`
+	Tenant       string            `json:"tenant"`
+	Status       string            `json:"status"`
+	Path         string            `json:"path"`
+	DataStoreRef string            `json:"data_store_ref,omitempty"`
+	Size         int64             `json:"size"`
+	Duration     float64           `json:"duration_seconds"`
+	Throughput   float64           `json:"throughput_bytes_per_second"`
+	Error        string            `json:"error,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	// the metadata values that could not be transformed and are shown as they were found
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// reportBuilder joins the entries of the status log for each upload into report rows, the entries are read oldest first
+type reportBuilder struct {
+	configured []Target
+	rows       []*reportRow
+	open       map[string]*reportRow
+	succeeded  map[string]*reportRow
+}
+
+func newReportBuilder(configured []Target) *reportBuilder {
+	return &reportBuilder{configured: configured, open: make(map[string]*reportRow), succeeded: make(map[string]*reportRow)}
+}
+
+// add takes account of an entry from the status log
+func (builder *reportBuilder) add(entry StatusRecordEntry) {
+	if entry.System != systemName {
+		// compacted entries repeat state recorded earlier
+		return
+	}
+	if entry.Operation == versionOperation && entry.Status == uploadSuccess {
+		// the version recorded after a successful upload holds the size of the file
+		var version fileVersion
+		if row, exists := builder.succeeded[entry.ContextID]; exists && json.Unmarshal([]byte(entry.Comments), &version) == nil {
+			row.Size = version.Size
+		}
+		return
+	}
+	if entry.Operation != fileUploadOpp {
+		return
+	}
+
+	switch entry.Status {
+	case startedStatus:
+		if row, exists := builder.open[entry.ContextID]; exists {
+			// the client stopped before the outcome of the earlier attempt was recorded
+			row.Status = interruptedStatus
+		}
+		row := builder.newRow(entry)
+		builder.rows = append(builder.rows, row)
+		builder.open[entry.ContextID] = row
+	case uploadSuccess, failedStatus, partialStatus:
+		row, exists := builder.open[entry.ContextID]
+		if !exists {
+			return
+		}
+		delete(builder.open, entry.ContextID)
+		finished := entry.Time
+		row.Finished = &finished
+		row.Status = entry.Status
+		switch entry.Status {
+		case uploadSuccess:
+			row.DataStoreRef = entry.Comments
+			builder.succeeded[entry.ContextID] = row
+		case partialStatus:
+			var progress trueconnect.UploadProgress
+			if json.Unmarshal([]byte(entry.Comments), &progress) == nil {
+				row.DataStoreRef = progress.Reference
+			}
+		default:
+			row.Error = entry.Comments
+		}
+	}
+}
+
+// newRow starts the row for an upload attempt, the target that found the file gives its tenant and metadata
+func (builder *reportBuilder) newRow(entry StatusRecordEntry) *reportRow {
+	row := &reportRow{Started: entry.Time, Path: entry.Comments, Status: startedStatus, Target: otherTarget}
+	if index := locateTarget(builder.configured, row.Path); index >= 0 {
+		target := &builder.configured[index]
+		row.Target = target.Name
+		row.Tenant = target.Tenant
+		row.Metadata = target.pathEncodedMetadata(row.Path)
+		for _, err := range target.transformMetadata(row.Metadata) {
+			row.Warnings = append(row.Warnings, err.Error())
+		}
+	}
+	return row
+}
+
+// build gives the rows the selector chooses, with the duration and throughput of each worked out
+func (builder *reportBuilder) build(selector commandSelector, since time.Time, until time.Time) []*reportRow {
+	var rows []*reportRow
+	for _, row := range builder.rows {
+		if !inTimeRange(row.Started, since, until) || !selected(selector.targets, row.Target) ||
+			!selected(selector.tenants, row.Tenant) || !selected(selector.status, row.Status) {
+			continue
+		}
+		if row.Finished != nil {
+			row.Duration = row.Finished.Sub(row.Started).Seconds()
+			if row.Duration > 0 && row.Status == uploadSuccess {
+				row.Throughput = float64(row.Size) / row.Duration
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// selected returns true when nothing is chosen or the value is one of those chosen, ignoring case
+func selected(chosen []string, value string) bool {
+	if len(chosen) == 0 {
+		return true
+	}
+	for _, choice := range chosen {
+		if strings.EqualFold(choice, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// report exports a row for each upload attempt recorded in the status log
+func (linkClient *linkClient) report() string {
+	since, until, err := linkClient.configuration.selector.times()
+	if err != nil {
+		linkClient.exitCode = 1
+		return err.Error()
+	}
+	format := linkClient.configuration.outputFormat
+	switch format {
+	case "":
+		format = formatCSV
+	case formatCSV, formatJSONLines, formatHTML:
+	default:
+		linkClient.exitCode = 1
+		return fmt.Sprintf("unrecognised format %q, use csv, jsonl or html", format)
+	}
+
+	configured, err := readConfiguredTargets(linkClient.configuration.ClientID + ".json")
+	if err != nil {
+		linkClient.statusRecorder.recordStatus(systemName, operationLoadConfig, failedStatus, "",
+			"files are not matched to targets in the report: "+err.Error())
+	}
+	builder := newReportBuilder(configured)
+	err = readStatusHistory(linkClient.configuration.ClientID+".recordStatus", since, builder.add)
+	if err != nil {
+		linkClient.exitCode = 1
+		return err.Error()
+	}
+	output, err := writeReport(builder.build(linkClient.configuration.selector, since, until), format)
+	if err != nil {
+		linkClient.exitCode = 1
+		return err.Error()
+	}
+	return output
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"started":  func(value time.Time) string { return formatStatusTime(&value, "") },
+	"finished": func(value *time.Time) string { return formatStatusTime(value, "") },
+	"meta":     func(row *reportRow, tag string) string { return row.Metadata[tag] },
+	"warnings": func(row *reportRow) string { return strings.Join(row.Warnings, "; ") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>TrueConnect-Link upload report</title></head>
+<body>
+<table border="1">
+<tr><th>Started</th><th>Finished</th><th>Target</th><th>Tenant</th><th>Status</th><th>Path</th><th>Data Store Ref</th><th>Size</th><th>Duration (s)</th><th>Throughput (B/s)</th><th>Error</th><th>Warnings</th>{{range .Tags}}<th>{{.}}</th>{{end}}</tr>
+{{range $row := .Rows}}<tr><td>{{started $row.Started}}</td><td>{{finished $row.Finished}}</td><td>{{$row.Target}}</td><td>{{$row.Tenant}}</td><td>{{$row.Status}}</td><td>{{$row.Path}}</td><td>{{$row.DataStoreRef}}</td><td>{{$row.Size}}</td><td>{{printf "%.0f" $row.Duration}}</td><td>{{printf "%.0f" $row.Throughput}}</td><td>{{$row.Error}}</td><td>{{warnings $row}}</td>{{range $.Tags}}<td>{{meta $row .}}</td>{{end}}</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// writeReport gives the rows in the format chosen, in CSV and HTML each metadata tag has its own column
+func writeReport(rows []*reportRow, format string) (string, error) {
+	var buffer bytes.Buffer
+	if format == formatJSONLines {
+		encoder := json.NewEncoder(&buffer)
+		for _, row := range rows {
+			if err := encoder.Encode(row); err != nil {
+				return "", err
+			}
+		}
+		return buffer.String(), nil
+	}
+
+	tagSet := make(map[string]struct{})
+	for _, row := range rows {
+		for tag := range row.Metadata {
+			tagSet[tag] = struct{}{}
+		}
+	}
+	var tags []string
+	for tag := range tagSet {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	if format == formatHTML {
+		err := reportTemplate.Execute(&buffer, struct {
+			Rows []*reportRow
+			Tags []string
+		}{rows, tags})
+		return buffer.String(), err
+	}
+
+	csvWriter := csv.NewWriter(&buffer)
+	csvWriter.Write(append([]string{"started", "finished", "target", "tenant", "status", "path", "data_store_ref", "size",
+		"duration_seconds", "throughput_bytes_per_second", "error", "warnings"}, tags...))
+	for _, row := range rows {
+		line := []string{formatStatusTime(&row.Started, ""), formatStatusTime(row.Finished, ""), row.Target, row.Tenant,
+			row.Status, row.Path, row.DataStoreRef, fmt.Sprint(row.Size), fmt.Sprintf("%.0f", row.Duration),
+			fmt.Sprintf("%.0f", row.Throughput), row.Error, strings.Join(row.Warnings, "; ")}
+		for _, tag := range tags {
+			line = append(line, row.Metadata[tag])
+		}
+		csvWriter.Write(line)
+	}
+	csvWriter.Flush()
+	return buffer.String(), csvWriter.Error()
+}
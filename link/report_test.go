@@ -0,0 +1,70 @@
+package link
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadReport(tests *testing.T) {
+	day := time.Date(2020, 3, 2, 0, 0, 0, 0, time.UTC)
+	at := func(second int) time.Time { return day.Add(time.Duration(second) * time.Second) }
+	configured := []Target{{Name: "flights", Tenant: "airline", Location: "/data/flights",
+		PathEncodedMetaDataTags: []PathEncodedMetaDataTag{{Tag: "TailNo", Match: `/data/flights/([A-Z0-9]+)/`}},
+		Transforms:              []TagTransform{{Tag: "TailNo", Steps: []TransformStep{{Type: "date", Layout: "2006"}}}}}}
+	entries := []StatusRecordEntry{
+		{Time: at(0), System: systemName, Operation: fileUploadOpp, Status: startedStatus, ContextID: "h1", Comments: "/data/flights/N123/a.zip"},
+		{Time: at(10), System: systemName, Operation: fileUploadOpp, Status: uploadSuccess, ContextID: "h1", Comments: "ref1"},
+		{Time: at(10), System: systemName, Operation: versionOperation, Status: uploadSuccess, ContextID: "h1", Comments: `{"path":"/data/flights/N123/a.zip","size":1000}`},
+		{Time: at(20), System: systemName, Operation: fileUploadOpp, Status: startedStatus, ContextID: "h2", Comments: "/data/flights/N456/b.zip"},
+		{Time: at(21), System: systemName, Operation: fileUploadOpp, Status: failedStatus, ContextID: "h2", Comments: "rejected"},
+		{Time: at(30), System: systemName, Operation: fileUploadOpp, Status: startedStatus, ContextID: "h3", Comments: "/tmp/c.zip"},
+		{Time: at(40), System: systemName, Operation: fileUploadOpp, Status: startedStatus, ContextID: "h3", Comments: "/tmp/c.zip"},
+		{Time: at(50), System: compactionSystem, Operation: fileUploadOpp, Status: uploadSuccess, ContextID: "h1", Comments: "ref1"},
+	}
+	builder := newReportBuilder(configured)
+	for _, entry := range entries {
+		builder.add(entry)
+	}
+
+	rows := builder.build(commandSelector{}, time.Time{}, time.Time{})
+	if len(rows) != 4 {
+		tests.Fatal("rows not as expected ", len(rows))
+	}
+	success := rows[0]
+	if success.Status != uploadSuccess || success.DataStoreRef != "ref1" || success.Size != 1000 || success.Duration != 10 ||
+		success.Throughput != 100 || success.Tenant != "airline" || success.Metadata["TailNo"] != "N123" ||
+		len(success.Warnings) != 1 {
+		tests.Fatal("successful upload not reported as expected ", *success)
+	}
+	if rows[1].Status != failedStatus || rows[1].Error != "rejected" || rows[2].Status != interruptedStatus ||
+		rows[3].Status != startedStatus || rows[3].Target != otherTarget {
+		tests.Fatal("other uploads not reported as expected ", *rows[1], *rows[2], *rows[3])
+	}
+
+	chosen := builder.build(commandSelector{tenants: []string{"AIRLINE"}, status: []string{"failed"}}, time.Time{}, time.Time{})
+	if len(chosen) != 1 || chosen[0].Path != "/data/flights/N456/b.zip" {
+		tests.Fatal("rows not chosen by tenant and status ", chosen)
+	}
+	if chosen = builder.build(commandSelector{}, at(15), at(35)); len(chosen) != 2 {
+		tests.Fatal("rows not chosen by time ", len(chosen))
+	}
+
+	output, err := writeReport(rows, formatCSV)
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if err != nil || len(lines) != 5 || !strings.HasSuffix(lines[0], ",TailNo") || !strings.Contains(lines[1], ",ref1,1000,10,100,,\"") || !strings.HasSuffix(lines[1], ",N123") {
+		tests.Fatal("report not written as CSV ", output)
+	}
+	output, _ = writeReport(rows, formatJSONLines)
+	lines = strings.Split(strings.TrimSpace(output), "\n")
+	var decoded reportRow
+	if len(lines) != 4 || json.Unmarshal([]byte(lines[0]), &decoded) != nil || decoded.DataStoreRef != "ref1" {
+		tests.Fatal("report not written as JSON Lines ", output)
+	}
+	rows[1].Error = "<script>"
+	output, err = writeReport(rows, formatHTML)
+	if err != nil || !strings.Contains(output, "<td>N123</td>") || strings.Contains(output, "<script>") {
+		tests.Fatal("report not written as HTML ", err, output)
+	}
+}
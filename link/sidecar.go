@@ -0,0 +1,319 @@
+package link
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/GeneralElectric/TrueConnect-Link/trueconnect"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Sidecar formats and the metadata used to link an uploaded sidecar to its data file
+const (
+	sidecarJSON        = "json"
+	sidecarXML         = "xml"
+	parentDataStoreRef = "parent_data_store_ref"
+	sidecarOperation   = "Sidecar"
+	sidecarUploadOpp   = "SidecarUpload"
+)
+
+// how long a failed sidecar upload waits before it is tried again
+const sidecarRetryInterval = 2 * time.Minute
+
+// generic XML element used to read sidecar files whose structure is not known in advance
+type xmlNode struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Content string     `xml:",chardata"`
+	Nodes   []xmlNode  `xml:",any"`
+}
+
+func (sidecar *SidecarConfig) validate() error {
+	if sidecar.Name == "" {
+		return fmt.Errorf("a sidecar needs a name")
+	}
+	switch sidecar.format(sidecar.Name) {
+	case sidecarJSON, sidecarXML:
+		return nil
+	}
+	return fmt.Errorf("unrecognised sidecar format %q", sidecar.Format)
+}
+
+func (sidecar *SidecarConfig) format(sidecarPath string) string {
+	if sidecar.Format != "" {
+		return strings.ToLower(sidecar.Format)
+	}
+	return strings.ToLower(strings.TrimPrefix(filepath.Ext(sidecarPath), "."))
+}
+
+// path gives the path of the sidecar file for the data file
+func (sidecar *SidecarConfig) path(filePath string) string {
+	name := filepath.Base(filePath)
+	replacer := strings.NewReplacer(
+		"$file", filePath,
+		"$dir", filepath.Dir(filePath),
+		"$name", name,
+		"$base", strings.TrimSuffix(name, filepath.Ext(name)))
+	return filepath.Clean(replacer.Replace(sidecar.Name))
+}
+
+// glob gives a pattern matching the names of the sidecar files, it also matches data files with the same extension
+func (sidecar *SidecarConfig) glob() string {
+	replacer := strings.NewReplacer("$file", "*", "$dir", "*", "$name", "*", "$base", "*")
+	return replacer.Replace(filepath.Base(filepath.Clean(sidecar.Name)))
+}
+
+// isSidecar reports whether the file is the sidecar of another file, looking for the data file in the directory of the
+// file and in the parent directories the sidecar name can lead down from
+func (sidecar *SidecarConfig) isSidecar(fullPath string) bool {
+	if matched, _ := filepath.Match(sidecar.glob(), filepath.Base(fullPath)); !matched {
+		return false
+	}
+	directory := filepath.Dir(fullPath)
+	for level := strings.Count(filepath.ToSlash(sidecar.Name), "/"); level >= 0; level-- {
+		entries, err := ioutil.ReadDir(directory)
+		if err == nil {
+			for _, entry := range entries {
+				candidate := filepath.Join(directory, entry.Name())
+				if !entry.IsDir() && candidate != fullPath && sidecar.path(candidate) == fullPath {
+					return true
+				}
+			}
+		}
+		directory = filepath.Dir(directory)
+	}
+	return false
+}
+
+// read gives the metadata values held in the sidecar file
+func (sidecar *SidecarConfig) read(sidecarPath string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(sidecarPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if sidecar.format(sidecarPath) == sidecarXML {
+		var root xmlNode
+		err = xml.Unmarshal(content, &root)
+		if err != nil {
+			return nil, err
+		}
+		return sidecar.xmlValues(root), nil
+	}
+
+	var root interface{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	err = decoder.Decode(&root)
+	if err != nil {
+		return nil, err
+	}
+	return sidecar.jsonValues(root), nil
+}
+
+func (sidecar *SidecarConfig) jsonValues(root interface{}) map[string]string {
+	values := make(map[string]string)
+	if len(sidecar.Fields) == 0 {
+		if object, isOk := root.(map[string]interface{}); isOk {
+			for key, value := range object {
+				if text, isScalar := jsonScalar(value); isScalar {
+					values[key] = text
+				}
+			}
+		}
+		return values
+	}
+
+	for _, field := range sidecar.Fields {
+		current := root
+		for _, element := range strings.Split(field.Field, "/") {
+			object, isOk := current.(map[string]interface{})
+			if !isOk {
+				current = nil
+				break
+			}
+			current = object[element]
+		}
+		if current == nil {
+			continue
+		}
+		if text, isScalar := jsonScalar(current); isScalar {
+			values[field.Tag] = text
+		} else {
+			encoded, _ := json.Marshal(current)
+			values[field.Tag] = string(encoded)
+		}
+	}
+	return values
+}
+
+func jsonScalar(value interface{}) (string, bool) {
+	switch typed := value.(type) {
+	case string:
+		return typed, true
+	case json.Number:
+		return typed.String(), true
+	case bool:
+		return fmt.Sprintf("%v", typed), true
+	}
+	return "", false
+}
+
+func (sidecar *SidecarConfig) xmlValues(root xmlNode) map[string]string {
+	values := make(map[string]string)
+	if len(sidecar.Fields) == 0 {
+		for _, attr := range root.Attrs {
+			values[attr.Name.Local] = attr.Value
+		}
+		for _, node := range root.Nodes {
+			if len(node.Nodes) == 0 {
+				values[node.XMLName.Local] = strings.TrimSpace(node.Content)
+			}
+		}
+		return values
+	}
+
+	for _, field := range sidecar.Fields {
+		if value, found := root.find(strings.Split(field.Field, "/")); found {
+			values[field.Tag] = value
+		}
+	}
+	return values
+}
+
+// find gives the content of the first element or attribute found at the path below this node
+func (node xmlNode) find(path []string) (string, bool) {
+	if len(path) == 0 {
+		return strings.TrimSpace(node.Content), true
+	}
+	if strings.HasPrefix(path[0], "@") && len(path) == 1 {
+		for _, attr := range node.Attrs {
+			if attr.Name.Local == path[0][1:] {
+				return attr.Value, true
+			}
+		}
+		return "", false
+	}
+	for _, child := range node.Nodes {
+		if child.XMLName.Local == path[0] {
+			if value, found := child.find(path[1:]); found {
+				return value, true
+			}
+		}
+	}
+	return "", false
+}
+
+// readSidecar looks for the sidecar of the found file and adds its values to those extracted for the file, false is
+// returned when the file should not be uploaded yet as the sidecar is required and is not available
+func (linkClient *linkClient) readSidecar(foundFile *foundFile) bool {
+	sidecar := foundFile.target.Sidecar
+	sidecarPath := sidecar.path(foundFile.uri)
+	if _, err := os.Stat(sidecarPath); err != nil {
+		return !sidecar.Required
+	}
+
+	values, err := sidecar.read(sidecarPath)
+	if err != nil {
+		if linkClient.statusRecorder != nil {
+			linkClient.statusRecorder.recordStatus(systemName, sidecarOperation, failedStatus, "", sidecarPath+": "+err.Error())
+		}
+		return !sidecar.Required
+	}
+
+	if dropped := dropReserved(values); len(dropped) > 0 && linkClient.statusRecorder != nil {
+		linkClient.statusRecorder.recordStatus(systemName, sidecarOperation, warningStatus, "",
+			sidecarPath+": ignored reserved metadata "+strings.Join(dropped, ", "))
+	}
+	if foundFile.extracted == nil {
+		foundFile.extracted = make(map[string]string)
+	}
+	for tag, value := range values {
+		foundFile.extracted[tag] = value
+	}
+	foundFile.sidecar = sidecarPath
+	return true
+}
+
+// uploadSidecar uploads the sidecar of a found file that has been uploaded, linking it to the uploaded file
+func (linkClient *linkClient) uploadSidecar(foundFile foundFile) error {
+	sidecar := foundFile.target.Sidecar
+	uid := linkClient.statusRecorder.recordStatus(systemName, sidecarUploadOpp, startedStatus, "", foundFile.sidecar)
+	info, err := os.Stat(foundFile.sidecar)
+	if err != nil {
+		linkClient.statusRecorder.recordStatus(systemName, sidecarUploadOpp, failedStatus, uid, err.Error())
+		return err
+	}
+	hash, err := computeSHA256Hash(foundFile.sidecar)
+	if err != nil {
+		linkClient.statusRecorder.recordStatus(systemName, sidecarUploadOpp, failedStatus, uid, err.Error())
+		return err
+	}
+
+	dataType := sidecar.DataType
+	if dataType == "" {
+		dataType = foundFile.target.DataType
+	}
+	dataFormat := sidecar.DataFormat
+	if dataFormat == "" {
+		dataFormat = sidecar.format(foundFile.sidecar)
+	}
+	host, _ := os.Hostname()
+	meta := make(map[string]trueconnect.MetadataValue)
+	meta[trueconnect.TenantID] = trueconnect.MetadataValue{Value: foundFile.target.Tenant, Immutable: true}
+	meta[trueconnect.DataType] = trueconnect.MetadataValue{Value: dataType, Immutable: true}
+	meta[trueconnect.FileFormat] = trueconnect.MetadataValue{Value: dataFormat, Immutable: true}
+	meta[trueconnect.OriginalFileName] = trueconnect.MetadataValue{Value: foundFile.sidecar, Immutable: true}
+	meta[sourceHost] = trueconnect.MetadataValue{Value: host, Immutable: true}
+	meta[fileSize] = trueconnect.MetadataValue{Value: fmt.Sprintf("%v", info.Size()), Immutable: true}
+	meta[lastModifiedDate] = trueconnect.MetadataValue{Value: info.ModTime().Format(time.RFC3339), Immutable: true}
+	meta[sha256Hash] = trueconnect.MetadataValue{Value: hash, Immutable: true}
+	meta[parentDataStoreRef] = trueconnect.MetadataValue{Value: foundFile.progress.Reference, Immutable: true}
+
+	tcwrapper := trueconnect.CreateWrapper(linkClient.configuration.TokenURL, linkClient.configuration.ClientID, linkClient.configuration.Secret, linkClient.configuration.Endpoint, uploadChunkSize)
+	progress, err := tcwrapper.PostToTC(linkClient.currentContext, trueconnect.UploadProgress{}, foundFile.sidecar, meta)
+	if err != nil {
+		linkClient.statusRecorder.recordStatus(systemName, sidecarUploadOpp, failedStatus, uid, err.Error())
+		return err
+	}
+	linkClient.statusRecorder.recordStatus(systemName, sidecarUploadOpp, uploadSuccess, uid, progress.Reference)
+	return nil
+}
+
+// retrySidecar tries the upload of the sidecar of an uploaded file again when it failed, the data file is disposed of
+// once its sidecar has been uploaded or given up on. Only the sidecar is retried, the data file is not taken again by a
+// worker. True is returned when a retry was queued, it is not when the sidecar no longer exists or has failed
+// maxattempts times
+func (linkClient *linkClient) retrySidecar(foundFile foundFile, uid string, err error) bool {
+	if err == nil || os.IsNotExist(err) || linkClient.isStopping {
+		return false
+	}
+	foundFile.sidecarAttempts++
+	if maxAttempts := linkClient.configuration.maxAttempts(foundFile.target); maxAttempts > 0 && foundFile.sidecarAttempts >= maxAttempts {
+		return false
+	}
+	record := uid + "~sidecar"
+	retryAt := time.Now().UTC().Add(sidecarRetryInterval)
+	linkClient.control.enqueue(record, foundFile, &retryAt)
+	go func() {
+		select {
+		case <-linkClient.currentContext.Done():
+			linkClient.control.dequeue(record)
+			return
+		case <-time.After(sidecarRetryInterval):
+		}
+		linkClient.control.dequeue(record)
+		if linkClient.isStopping {
+			return
+		}
+		if !linkClient.retrySidecar(foundFile, uid, linkClient.uploadSidecar(foundFile)) && foundFile.target.Disposition != nil {
+			linkClient.dispose(foundFile, uid)
+		}
+	}()
+	return true
+}
@@ -0,0 +1,239 @@
+package link
+
+import (
+	"context"
+	"github.com/GeneralElectric/TrueConnect-Link/trueconnect"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSidecarPath(tests *testing.T) {
+	dataFile := filepath.Join("data", "flight.FFD")
+	cases := map[string]string{
+		"$file.json":      filepath.Join("data", "flight.FFD.json"),
+		"$dir/$base.xml":  filepath.Join("data", "flight.xml"),
+		"$dir/meta/$name": filepath.Join("data", "meta", "flight.FFD"),
+	}
+	for name, expected := range cases {
+		sidecar := SidecarConfig{Name: name}
+		if sidecar.path(dataFile) != expected {
+			tests.Fatal(sidecar.path(dataFile) + " expected " + expected)
+		}
+	}
+}
+
+func TestReadJSONSidecar(tests *testing.T) {
+	sidecarPath, err := CreateTestSidecar("TestReadJSONSidecar/flight.json", `{"tail": "F-GZCA", "esn": 956123, "flight": {"number": "AF123", "legs": [1, 2]}}`)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	defer os.RemoveAll("TestReadJSONSidecar")
+
+	sidecar := SidecarConfig{Name: "$dir/$base.json"}
+	values, err := sidecar.read(sidecarPath)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	if values["tail"] != "F-GZCA" || values["esn"] != "956123" {
+		tests.Fatal("top level values not read from sidecar ", values)
+	}
+	if _, exists := values["flight"]; exists {
+		tests.Fatal("object read as a top level value")
+	}
+
+	sidecar.Fields = []SidecarField{{Field: "flight/number", Tag: "FlightNo"}, {Field: "flight/legs", Tag: "Legs"}, {Field: "missing/value", Tag: "Missing"}}
+	values, err = sidecar.read(sidecarPath)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	if values["FlightNo"] != "AF123" || values["Legs"] != "[1,2]" {
+		tests.Fatal("mapped fields not read from sidecar ", values)
+	}
+	if _, exists := values["Missing"]; exists {
+		tests.Fatal("missing field given a value")
+	}
+}
+
+func TestSidecarCannotOverrideReservedMetadata(tests *testing.T) {
+	testfile, err := CreateTestFile("./TestSidecarCannotOverrideReservedMetadata/testfile.abc")
+	if err != nil {
+		tests.Fatal(err.Error())
+	}
+	defer os.RemoveAll("./TestSidecarCannotOverrideReservedMetadata")
+	_, err = CreateTestSidecar("./TestSidecarCannotOverrideReservedMetadata/testfile.abc.json",
+		`{"tenant_id": "forged", "sha_256": "forged", "tail": "F-GZCA"}`)
+	if err != nil {
+		tests.Fatal(err.Error())
+	}
+
+	target := Target{Tenant: "tenant1", Sidecar: &SidecarConfig{Name: "$file.json"}}
+	found := foundFile{uri: testfile, hash: "deadface", target: &target}
+	client := linkClient{}
+	if !client.readSidecar(&found) {
+		tests.Fatal("sidecar not read")
+	}
+	meta := found.getMetadata()
+	if meta[trueconnect.TenantID] != (trueconnect.MetadataValue{Value: "tenant1", Immutable: true}) ||
+		meta[sha256Hash] != (trueconnect.MetadataValue{Value: "deadface", Immutable: true}) {
+		tests.Fatal("sidecar overrode reserved metadata ", meta[trueconnect.TenantID], meta[sha256Hash])
+	}
+	if meta["tail"].Value != "F-GZCA" {
+		tests.Fatal("sidecar values not added to the metadata")
+	}
+}
+
+func TestReadXMLSidecar(tests *testing.T) {
+	sidecarPath, err := CreateTestSidecar("TestReadXMLSidecar/flight.xml", `<descriptor version="2"><tail>F-GZCA</tail><flight number="AF123"><from>CDG</from></flight></descriptor>`)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	defer os.RemoveAll("TestReadXMLSidecar")
+
+	sidecar := SidecarConfig{Name: "$dir/$base.xml"}
+	values, err := sidecar.read(sidecarPath)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	if values["tail"] != "F-GZCA" || values["version"] != "2" {
+		tests.Fatal("top level values not read from sidecar ", values)
+	}
+
+	sidecar.Fields = []SidecarField{{Field: "flight/@number", Tag: "FlightNo"}, {Field: "flight/from", Tag: "From"}}
+	values, err = sidecar.read(sidecarPath)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	if values["FlightNo"] != "AF123" || values["From"] != "CDG" {
+		tests.Fatal("mapped fields not read from sidecar ", values)
+	}
+}
+
+func TestRequiredSidecarHoldsFile(tests *testing.T) {
+	testfile1, err := CreateTestFile("./TestRequiredSidecarHoldsFile/testfile1.abc")
+	if err != nil {
+		tests.Fatal(err.Error())
+	}
+	defer os.RemoveAll("./TestRequiredSidecarHoldsFile")
+	testfile2, err := CreateTestFile("./TestRequiredSidecarHoldsFile/testfile2.abc")
+	if err != nil {
+		tests.Fatal(err.Error())
+	}
+	_, err = CreateTestSidecar("./TestRequiredSidecarHoldsFile/testfile2.abc.json", `{"tail": "F-GZCA"}`)
+	if err != nil {
+		tests.Fatal(err.Error())
+	}
+
+	target := Target{
+		Location: filepath.Dir(testfile1),
+		Match:    `\.abc$`,
+		Sidecar:  &SidecarConfig{Name: "$file.json", Required: true},
+	}
+
+	foundFiles := make(chan foundFile, 10)
+	client := linkClient{}
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+	client.currentContext = currentContext
+	err = client.findFiles(target, &foundFiles)
+	if err != nil && err != io.EOF {
+		tests.Fatal("Unexpected err return from findfiles: " + err.Error())
+	}
+	close(foundFiles)
+
+	counter := 0
+	for foundFile := range foundFiles {
+		if foundFile.uri != testfile2 {
+			tests.Fatal("Found: " + foundFile.uri + " without its sidecar")
+		}
+		if foundFile.getMetadata()["tail"].Value != "F-GZCA" {
+			tests.Fatal("sidecar values not added to the metadata")
+		}
+		counter++
+	}
+	if counter != 1 {
+		tests.Fatal("file with sidecar not found")
+	}
+}
+
+func TestSidecarNotFoundAsDataFile(tests *testing.T) {
+	dataFile, err := CreateTestFile("./TestSidecarNotFoundAsDataFile/flight.dat")
+	if err != nil {
+		tests.Fatal(err.Error())
+	}
+	defer os.RemoveAll("./TestSidecarNotFoundAsDataFile")
+	_, err = CreateTestSidecar("./TestSidecarNotFoundAsDataFile/flight.json", `{"tail": "F-GZCA"}`)
+	if err != nil {
+		tests.Fatal(err.Error())
+	}
+	// a file with the extension of the sidecars that is not the sidecar of another file is a data file
+	report, err := CreateTestSidecar("./TestSidecarNotFoundAsDataFile/report.json", `{}`)
+	if err != nil {
+		tests.Fatal(err.Error())
+	}
+
+	target := Target{
+		Location: filepath.Dir(dataFile),
+		Sidecar:  &SidecarConfig{Name: "$dir/$base.json"},
+	}
+
+	foundFiles := make(chan foundFile, 10)
+	client := linkClient{}
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+	client.currentContext = currentContext
+	err = client.findFiles(target, &foundFiles)
+	if err != nil && err != io.EOF {
+		tests.Fatal("Unexpected err return from findfiles: " + err.Error())
+	}
+	close(foundFiles)
+
+	found := make(map[string]bool)
+	for foundFile := range foundFiles {
+		found[foundFile.uri] = true
+	}
+	if len(found) != 2 || !found[dataFile] || !found[report] {
+		tests.Fatal("sidecar found as a data file or data file not found ", found)
+	}
+}
+
+func TestFailedSidecarUploadRetried(tests *testing.T) {
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+	client := linkClient{currentContext: currentContext, control: newServiceControl()}
+	target := Target{Name: "test"}
+	found := foundFile{uri: "/in/file.abc", hash: "abc", target: &target, sidecar: "/in/file.abc.json"}
+
+	if client.retrySidecar(found, "abc~/in/file.abc", nil) {
+		tests.Fatal("uploaded sidecar queued")
+	}
+	if client.retrySidecar(found, "abc~/in/file.abc", os.ErrNotExist) {
+		tests.Fatal("missing sidecar queued")
+	}
+	if !client.retrySidecar(found, "abc~/in/file.abc", io.ErrUnexpectedEOF) {
+		tests.Fatal("failed sidecar not queued")
+	}
+	if _, queue, _ := client.control.snapshot(); len(queue) != 1 || queue[0].Record != "abc~/in/file.abc~sidecar" || queue[0].RetryAt == nil {
+		tests.Fatal("failed sidecar not queued for a retry on its own ", queue)
+	}
+
+	target.MaxAttempts = 2
+	found.sidecarAttempts = 1
+	if client.retrySidecar(found, "abc~/in/file.abc", io.ErrUnexpectedEOF) {
+		tests.Fatal("sidecar queued after maxattempts failures")
+	}
+}
+
+func CreateTestSidecar(createFileName string, content string) (string, error) {
+	fileName, err := filepath.Abs(createFileName)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(filepath.Dir(fileName), 0775)
+	if err != nil {
+		return "", err
+	}
+	return fileName, ioutil.WriteFile(fileName, []byte(content), 0600)
+}
@@ -0,0 +1,493 @@
+package link
+
+import (
+	"encoding/json"
+	"github.com/GeneralElectric/TrueConnect-Link/trueconnect"
+	bolt "go.etcd.io/bbolt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// bolt buckets and keys used by the state store
+var (
+	progressBucket = []byte("progress")
+	versionsBucket = []byte("versions")
+	failuresBucket = []byte("failures")
+	outboxBucket   = []byte("outbox")
+	metaBucket     = []byte("meta")
+	migratedKey    = []byte("migrated")
+	dedupKey       = []byte("dedup")
+	stateBuckets   = [][]byte{progressBucket, versionsBucket, failuresBucket, outboxBucket, metaBucket}
+)
+
+// How long opening the state store waits for another process to close it and the operation recorded when the state
+// store cannot be written
+const (
+	stateStoreOpenTimeout = 5 * time.Second
+	stateStoreOperation   = "StateStore"
+)
+
+// recordStateError records that the state of the record could not be written, so the file may be uploaded again or
+// its failed attempts not counted
+func (linkClient *linkClient) recordStateError(record string, err error) {
+	if err != nil {
+		linkClient.statusRecorder.recordStatus(systemName, stateStoreOperation, failedStatus, record, err.Error())
+	}
+}
+
+// stateStore holds the progress of each upload and the last version uploaded from each path so they do not have to be
+// rebuilt from the status log when the client starts
+type stateStore interface {
+	progress(record string) (trueconnect.UploadProgress, bool)
+	putProgress(record string, progress trueconnect.UploadProgress) error
+	deleteProgress(record string) error
+	version(path string) (fileVersion, bool)
+	putVersion(version fileVersion) error
+	deleteVersion(path string) error
+	failure(record string) (failureRecord, bool)
+	putFailure(record string, failure failureRecord) error
+	deleteFailure(record string) error
+	// importState adds the records in one update and marks the store as migrated from the status log
+	importState(progress map[string]trueconnect.UploadProgress, versions map[string]fileVersion, failures map[string]failureRecord) error
+	migrated() bool
+	// dedupPolicies gives the deduplication policy each target's uploads were last recorded with
+	dedupPolicies() map[string]string
+	putDedupPolicies(policies map[string]string) error
+	// forEachProgress calls each for every record held, stopping at the first error
+	forEachProgress(each func(record string, progress trueconnect.UploadProgress) error) error
+	// forEachVersion calls each for every version held, stopping at the first error
+	forEachVersion(each func(version fileVersion) error) error
+	// forEachFailure calls each for every failure held, stopping at the first error
+	forEachFailure(each func(record string, failure failureRecord) error) error
+	putDelivery(delivery webhookDelivery) error
+	deleteDelivery(id string) error
+	// forEachDelivery calls each for every webhook delivery waiting in the outbox oldest first, stopping at the first error
+	forEachDelivery(each func(delivery webhookDelivery) error) error
+	close() error
+}
+
+// boltStateStore keeps the state in a bolt database file, each change is written to disk before it returns
+type boltStateStore struct {
+	db *bolt.DB
+}
+
+func openBoltStateStore(fileName string) (*boltStateStore, error) {
+	db, err := bolt.Open(fileName, 0600, &bolt.Options{Timeout: stateStoreOpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range stateBuckets {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStateStore{db: db}, nil
+}
+
+func (store *boltStateStore) get(bucket []byte, key string, value interface{}) bool {
+	found := false
+	store.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucket).Get([]byte(key))
+		found = data != nil && json.Unmarshal(data, value) == nil
+		return nil
+	})
+	return found
+}
+
+func (store *boltStateStore) put(bucket []byte, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), data)
+	})
+}
+
+func (store *boltStateStore) progress(record string) (trueconnect.UploadProgress, bool) {
+	var progress trueconnect.UploadProgress
+	found := store.get(progressBucket, record, &progress)
+	return progress, found
+}
+
+func (store *boltStateStore) putProgress(record string, progress trueconnect.UploadProgress) error {
+	return store.put(progressBucket, record, progress)
+}
+
+func (store *boltStateStore) deleteProgress(record string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(progressBucket).Delete([]byte(record))
+	})
+}
+
+func (store *boltStateStore) version(path string) (fileVersion, bool) {
+	var version fileVersion
+	found := store.get(versionsBucket, path, &version)
+	return version, found
+}
+
+func (store *boltStateStore) putVersion(version fileVersion) error {
+	return store.put(versionsBucket, version.Path, version)
+}
+
+func (store *boltStateStore) deleteVersion(path string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(versionsBucket).Delete([]byte(path))
+	})
+}
+
+func (store *boltStateStore) failure(record string) (failureRecord, bool) {
+	var failure failureRecord
+	found := store.get(failuresBucket, record, &failure)
+	return failure, found
+}
+
+func (store *boltStateStore) putFailure(record string, failure failureRecord) error {
+	return store.put(failuresBucket, record, failure)
+}
+
+func (store *boltStateStore) deleteFailure(record string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(failuresBucket).Delete([]byte(record))
+	})
+}
+
+func (store *boltStateStore) importState(progress map[string]trueconnect.UploadProgress, versions map[string]fileVersion, failures map[string]failureRecord) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		for record, value := range progress {
+			data, err := json.Marshal(value)
+			if err == nil {
+				err = tx.Bucket(progressBucket).Put([]byte(record), data)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		for path, value := range versions {
+			data, err := json.Marshal(value)
+			if err == nil {
+				err = tx.Bucket(versionsBucket).Put([]byte(path), data)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		for record, value := range failures {
+			data, err := json.Marshal(value)
+			if err == nil {
+				err = tx.Bucket(failuresBucket).Put([]byte(record), data)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(metaBucket).Put(migratedKey, []byte(time.Now().UTC().Format(time.RFC3339)))
+	})
+}
+
+func (store *boltStateStore) migrated() bool {
+	found := false
+	store.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket(metaBucket).Get(migratedKey) != nil
+		return nil
+	})
+	return found
+}
+
+func (store *boltStateStore) dedupPolicies() map[string]string {
+	policies := make(map[string]string)
+	store.db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket(metaBucket).Get(dedupKey); data != nil {
+			json.Unmarshal(data, &policies)
+		}
+		return nil
+	})
+	return policies
+}
+
+func (store *boltStateStore) putDedupPolicies(policies map[string]string) error {
+	data, err := json.Marshal(policies)
+	if err != nil {
+		return err
+	}
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(dedupKey, data)
+	})
+}
+
+func (store *boltStateStore) forEachProgress(each func(record string, progress trueconnect.UploadProgress) error) error {
+	return store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(progressBucket).ForEach(func(key []byte, data []byte) error {
+			var progress trueconnect.UploadProgress
+			if json.Unmarshal(data, &progress) != nil {
+				return nil
+			}
+			return each(string(key), progress)
+		})
+	})
+}
+
+func (store *boltStateStore) forEachVersion(each func(version fileVersion) error) error {
+	return store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(versionsBucket).ForEach(func(key []byte, data []byte) error {
+			var version fileVersion
+			if json.Unmarshal(data, &version) != nil {
+				return nil
+			}
+			return each(version)
+		})
+	})
+}
+
+func (store *boltStateStore) forEachFailure(each func(record string, failure failureRecord) error) error {
+	return store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(failuresBucket).ForEach(func(key []byte, data []byte) error {
+			var failure failureRecord
+			if json.Unmarshal(data, &failure) != nil {
+				return nil
+			}
+			return each(string(key), failure)
+		})
+	})
+}
+
+func (store *boltStateStore) putDelivery(delivery webhookDelivery) error {
+	return store.put(outboxBucket, delivery.ID, delivery)
+}
+
+func (store *boltStateStore) deleteDelivery(id string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucket).Delete([]byte(id))
+	})
+}
+
+func (store *boltStateStore) forEachDelivery(each func(delivery webhookDelivery) error) error {
+	return store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucket).ForEach(func(key []byte, data []byte) error {
+			var delivery webhookDelivery
+			if json.Unmarshal(data, &delivery) != nil {
+				return nil
+			}
+			return each(delivery)
+		})
+	})
+}
+
+func (store *boltStateStore) close() error {
+	return store.db.Close()
+}
+
+// memoryStateStore keeps the state in memory only, it is used when no state file is needed
+type memoryStateStore struct {
+	records     map[string]trueconnect.UploadProgress
+	versions    map[string]fileVersion
+	failures    map[string]failureRecord
+	outbox      map[string]webhookDelivery
+	isMigrated  bool
+	dedup       map[string]string
+	memoryMutex sync.Mutex
+}
+
+func newMemoryStateStore() *memoryStateStore {
+	return &memoryStateStore{
+		records:  make(map[string]trueconnect.UploadProgress),
+		versions: make(map[string]fileVersion),
+		failures: make(map[string]failureRecord),
+		outbox:   make(map[string]webhookDelivery),
+	}
+}
+
+func (store *memoryStateStore) progress(record string) (trueconnect.UploadProgress, bool) {
+	store.memoryMutex.Lock()
+	defer store.memoryMutex.Unlock()
+	progress, exists := store.records[record]
+	return progress, exists
+}
+
+func (store *memoryStateStore) putProgress(record string, progress trueconnect.UploadProgress) error {
+	store.memoryMutex.Lock()
+	defer store.memoryMutex.Unlock()
+	store.records[record] = progress
+	return nil
+}
+
+func (store *memoryStateStore) deleteProgress(record string) error {
+	store.memoryMutex.Lock()
+	defer store.memoryMutex.Unlock()
+	delete(store.records, record)
+	return nil
+}
+
+func (store *memoryStateStore) version(path string) (fileVersion, bool) {
+	store.memoryMutex.Lock()
+	defer store.memoryMutex.Unlock()
+	version, exists := store.versions[path]
+	return version, exists
+}
+
+func (store *memoryStateStore) putVersion(version fileVersion) error {
+	store.memoryMutex.Lock()
+	defer store.memoryMutex.Unlock()
+	store.versions[version.Path] = version
+	return nil
+}
+
+func (store *memoryStateStore) deleteVersion(path string) error {
+	store.memoryMutex.Lock()
+	defer store.memoryMutex.Unlock()
+	delete(store.versions, path)
+	return nil
+}
+
+func (store *memoryStateStore) failure(record string) (failureRecord, bool) {
+	store.memoryMutex.Lock()
+	defer store.memoryMutex.Unlock()
+	failure, exists := store.failures[record]
+	return failure, exists
+}
+
+func (store *memoryStateStore) putFailure(record string, failure failureRecord) error {
+	store.memoryMutex.Lock()
+	defer store.memoryMutex.Unlock()
+	store.failures[record] = failure
+	return nil
+}
+
+func (store *memoryStateStore) deleteFailure(record string) error {
+	store.memoryMutex.Lock()
+	defer store.memoryMutex.Unlock()
+	delete(store.failures, record)
+	return nil
+}
+
+func (store *memoryStateStore) importState(progress map[string]trueconnect.UploadProgress, versions map[string]fileVersion, failures map[string]failureRecord) error {
+	store.memoryMutex.Lock()
+	defer store.memoryMutex.Unlock()
+	for record, value := range progress {
+		store.records[record] = value
+	}
+	for path, value := range versions {
+		store.versions[path] = value
+	}
+	for record, value := range failures {
+		store.failures[record] = value
+	}
+	store.isMigrated = true
+	return nil
+}
+
+func (store *memoryStateStore) migrated() bool {
+	store.memoryMutex.Lock()
+	defer store.memoryMutex.Unlock()
+	return store.isMigrated
+}
+
+func (store *memoryStateStore) dedupPolicies() map[string]string {
+	store.memoryMutex.Lock()
+	defer store.memoryMutex.Unlock()
+	policies := make(map[string]string)
+	for name, policy := range store.dedup {
+		policies[name] = policy
+	}
+	return policies
+}
+
+func (store *memoryStateStore) putDedupPolicies(policies map[string]string) error {
+	store.memoryMutex.Lock()
+	defer store.memoryMutex.Unlock()
+	store.dedup = make(map[string]string)
+	for name, policy := range policies {
+		store.dedup[name] = policy
+	}
+	return nil
+}
+
+func (store *memoryStateStore) forEachProgress(each func(record string, progress trueconnect.UploadProgress) error) error {
+	store.memoryMutex.Lock()
+	records := make(map[string]trueconnect.UploadProgress, len(store.records))
+	for record, progress := range store.records {
+		records[record] = progress
+	}
+	store.memoryMutex.Unlock()
+	for record, progress := range records {
+		if err := each(record, progress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *memoryStateStore) forEachVersion(each func(version fileVersion) error) error {
+	store.memoryMutex.Lock()
+	versions := make([]fileVersion, 0, len(store.versions))
+	for _, version := range store.versions {
+		versions = append(versions, version)
+	}
+	store.memoryMutex.Unlock()
+	for _, version := range versions {
+		if err := each(version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *memoryStateStore) forEachFailure(each func(record string, failure failureRecord) error) error {
+	store.memoryMutex.Lock()
+	failures := make(map[string]failureRecord, len(store.failures))
+	for record, failure := range store.failures {
+		failures[record] = failure
+	}
+	store.memoryMutex.Unlock()
+	for record, failure := range failures {
+		if err := each(record, failure); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *memoryStateStore) putDelivery(delivery webhookDelivery) error {
+	store.memoryMutex.Lock()
+	defer store.memoryMutex.Unlock()
+	store.outbox[delivery.ID] = delivery
+	return nil
+}
+
+func (store *memoryStateStore) deleteDelivery(id string) error {
+	store.memoryMutex.Lock()
+	defer store.memoryMutex.Unlock()
+	delete(store.outbox, id)
+	return nil
+}
+
+func (store *memoryStateStore) forEachDelivery(each func(delivery webhookDelivery) error) error {
+	store.memoryMutex.Lock()
+	deliveries := make([]webhookDelivery, 0, len(store.outbox))
+	for _, delivery := range store.outbox {
+		deliveries = append(deliveries, delivery)
+	}
+	store.memoryMutex.Unlock()
+	// the IDs start with the time the delivery was queued
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].ID < deliveries[j].ID
+	})
+	for _, delivery := range deliveries {
+		if err := each(delivery); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *memoryStateStore) close() error {
+	return nil
+}
@@ -0,0 +1,149 @@
+package link
+
+import (
+	"encoding/csv"
+	"github.com/GeneralElectric/TrueConnect-Link/trueconnect"
+	"os"
+	"testing"
+	"time"
+)
+
+func testStateStore(tests *testing.T, store stateStore) {
+	if _, exists := store.progress("abc123"); exists {
+		tests.Fatal("empty store has a record")
+	}
+	progress := trueconnect.UploadProgress{Reference: "ref1", Part: 3}
+	if err := store.putProgress("abc123", progress); err != nil {
+		tests.Fatal(err)
+	}
+	if stored, exists := store.progress("abc123"); !exists || stored != progress {
+		tests.Fatal("stored progress not returned ", stored)
+	}
+	if err := store.deleteProgress("abc123"); err != nil {
+		tests.Fatal(err)
+	}
+	if _, exists := store.progress("abc123"); exists {
+		tests.Fatal("deleted record returned")
+	}
+
+	version := fileVersion{Path: "/in/file.zip", Hash: "deadface", Ref: "ref1", Version: 2, Size: 10}
+	if err := store.putVersion(version); err != nil {
+		tests.Fatal(err)
+	}
+	if stored, exists := store.version("/in/file.zip"); !exists || stored != version {
+		tests.Fatal("stored version not returned ", stored)
+	}
+	if err := store.deleteVersion("/in/file.zip"); err != nil {
+		tests.Fatal(err)
+	}
+	if _, exists := store.version("/in/file.zip"); exists {
+		tests.Fatal("deleted version returned")
+	}
+
+	failure := failureRecord{Path: "/in/bad.zip", Target: "t1", Attempts: 3, Reason: "rejected", Abandoned: true}
+	if err := store.putFailure("bad123", failure); err != nil {
+		tests.Fatal(err)
+	}
+	if stored, exists := store.failure("bad123"); !exists || stored != failure {
+		tests.Fatal("stored failure not returned ", stored)
+	}
+	count := 0
+	store.forEachFailure(func(record string, failure failureRecord) error {
+		count++
+		return nil
+	})
+	if count != 1 {
+		tests.Fatal("failures not listed ", count)
+	}
+	if err := store.deleteFailure("bad123"); err != nil {
+		tests.Fatal(err)
+	}
+	if _, exists := store.failure("bad123"); exists {
+		tests.Fatal("deleted failure returned")
+	}
+
+	for _, id := range []string{"20180102T150406.000000000Z-b", "20180102T150405.000000000Z-a"} {
+		if err := store.putDelivery(webhookDelivery{ID: id, URL: "https://example.com/hook", Payload: []byte("{}")}); err != nil {
+			tests.Fatal(err)
+		}
+	}
+	var ids []string
+	store.forEachDelivery(func(delivery webhookDelivery) error {
+		ids = append(ids, delivery.ID)
+		return nil
+	})
+	if len(ids) != 2 || ids[0] != "20180102T150405.000000000Z-a" {
+		tests.Fatal("deliveries not listed oldest first ", ids)
+	}
+	if err := store.deleteDelivery(ids[0]); err != nil {
+		tests.Fatal(err)
+	}
+	store.deleteDelivery(ids[1])
+
+	if store.migrated() {
+		tests.Fatal("store migrated before import")
+	}
+	err := store.importState(map[string]trueconnect.UploadProgress{"def456": {Complete: true, Reference: "ref2"}}, map[string]fileVersion{}, map[string]failureRecord{})
+	if err != nil {
+		tests.Fatal(err)
+	}
+	if stored, exists := store.progress("def456"); !exists || !store.migrated() || stored.Reference != "ref2" {
+		tests.Fatal("imported state not stored")
+	}
+}
+
+func TestMemoryStateStore(tests *testing.T) {
+	testStateStore(tests, newMemoryStateStore())
+}
+
+func TestBoltStateStore(tests *testing.T) {
+	defer os.Remove("TestBoltStateStore.state")
+	store, err := openBoltStateStore("TestBoltStateStore.state")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	testStateStore(tests, store)
+	store.close()
+
+	store, err = openBoltStateStore("TestBoltStateStore.state")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	defer store.close()
+	if _, exists := store.progress("def456"); !exists || !store.migrated() {
+		tests.Fatal("state not kept after reopening the store")
+	}
+}
+
+func TestStateMigratedOnce(tests *testing.T) {
+	defer os.Remove("TestStateMigratedOnce.state")
+	defer os.Remove("TestStateMigratedOnce.recordStatus")
+	statusFile, err := os.Create("TestStateMigratedOnce.recordStatus")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	entry := StatusRecordEntry{Time: time.Now(), System: systemName, Operation: fileUploadOpp, Status: uploadSuccess, ContextID: "abc123", Comments: "ref1"}
+	csvWriter := csv.NewWriter(statusFile)
+	csvWriter.Write(entry.StatusRecordToLine())
+	csvWriter.Flush()
+	statusFile.Close()
+
+	recorder, err := openFileTransferRecorder("TestStateMigratedOnce.state", "TestStateMigratedOnce.recordStatus")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	if progress, isOk, _ := recorder.startRecord("abc123", trueconnect.UploadProgress{}); isOk || progress.Reference != "ref1" {
+		tests.Fatal("status log not migrated")
+	}
+	recorder.store.deleteProgress("abc123")
+	recorder.close()
+
+	recorder, err = openFileTransferRecorder("TestStateMigratedOnce.state", "TestStateMigratedOnce.recordStatus")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	defer recorder.close()
+	if _, isOk, _ := recorder.startRecord("abc123", trueconnect.UploadProgress{}); !isOk {
+		tests.Fatal("status log migrated again")
+	}
+}
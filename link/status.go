@@ -0,0 +1,389 @@
+package link
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/GeneralElectric/TrueConnect-Link/trueconnect"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The formats the output of reporting commands can be written in and the names used for files found outside of any
+// configured target and for the totals
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+	formatCSV   = "csv"
+	otherTarget = "(other)"
+	overallName = "overall"
+)
+
+// targetStatus summarises the uploads of the files found by a target, each file is counted once by its last outcome
+type targetStatus struct {
+	Target          string     `json:"target"`
+	Succeeded       int        `json:"succeeded"`
+	Partial         int        `json:"partial"`
+	Failed          int        `json:"failed"`
+	Skipped         int        `json:"skipped"`
+	Abandoned       int        `json:"abandoned"`
+	Pending         int        `json:"pending"`
+	BytesUploaded   int64      `json:"bytesuploaded"`
+	LastSuccess     *time.Time `json:"lastsuccess,omitempty"`
+	LastSuccessFile string     `json:"lastsuccessfile,omitempty"`
+	LastError       *time.Time `json:"lasterror,omitempty"`
+	LastErrorText   string     `json:"lasterrortext,omitempty"`
+}
+
+// uploadStatus is the summary given by the Status command
+type uploadStatus struct {
+	Since   *time.Time      `json:"since,omitempty"`
+	Until   *time.Time      `json:"until,omitempty"`
+	Targets []*targetStatus `json:"targets"`
+	Overall targetStatus    `json:"overall"`
+	Notes   []string        `json:"notes,omitempty"`
+}
+
+// statusBuilder works out the upload status from the entries of the status log, which are read oldest first
+type statusBuilder struct {
+	configured []Target
+	since      time.Time
+	until      time.Time
+	uris       map[string]string
+	outcomes   map[string]StatusRecordEntry
+	sizes      map[string]int64
+	targets    map[string]*targetStatus
+}
+
+func newStatusBuilder(configured []Target, since time.Time, until time.Time) *statusBuilder {
+	return &statusBuilder{
+		configured: configured,
+		since:      since,
+		until:      until,
+		uris:       make(map[string]string),
+		outcomes:   make(map[string]StatusRecordEntry),
+		sizes:      make(map[string]int64),
+		targets:    make(map[string]*targetStatus),
+	}
+}
+
+func inTimeRange(entryTime time.Time, since time.Time, until time.Time) bool {
+	return (since.IsZero() || !entryTime.Before(since)) && (until.IsZero() || entryTime.Before(until))
+}
+
+// add takes account of an entry from the status log
+func (builder *statusBuilder) add(entry StatusRecordEntry) {
+	if entry.System != systemName {
+		// compacted entries repeat state recorded earlier
+		return
+	}
+	if entry.Operation == fileUploadOpp && entry.Status == startedStatus {
+		builder.uris[entry.ContextID] = entry.Comments
+	}
+	if !inTimeRange(entry.Time, builder.since, builder.until) {
+		return
+	}
+
+	switch {
+	case entry.Operation == fileUploadOpp:
+		switch entry.Status {
+		case skippedStatus:
+			// uploaded files are skipped each time they are found again, which does not change their outcome
+			if _, exists := builder.outcomes[entry.ContextID]; !exists {
+				builder.outcomes[entry.ContextID] = entry
+			}
+		case startedStatus, heldStatus, uploadSuccess, partialStatus, failedStatus, abandonedStatus:
+			builder.outcomes[entry.ContextID] = entry
+		}
+		if entry.Status == failedStatus {
+			builder.lastError(builder.target(builder.fileOf(entry.ContextID, entry.Comments)), entry)
+		}
+	case entry.Operation == versionOperation && entry.Status == uploadSuccess:
+		var version fileVersion
+		if json.Unmarshal([]byte(entry.Comments), &version) == nil {
+			builder.sizes[entry.ContextID] = version.Size
+			if _, exists := builder.uris[entry.ContextID]; !exists {
+				builder.uris[entry.ContextID] = version.Path
+			}
+		}
+	case entry.Status == failedStatus:
+		// a target that could not be searched records the failure under its own name
+		if builder.isConfigured(entry.Operation) {
+			builder.lastError(builder.status(entry.Operation), entry)
+		} else if uri, exists := builder.uris[entry.ContextID]; exists {
+			builder.lastError(builder.target(uri), entry)
+		}
+	}
+}
+
+// fileOf gives the path of the file an upload was recorded for, falling back to the path in its key or the comments
+func (builder *statusBuilder) fileOf(uid string, comments string) string {
+	if uri, exists := builder.uris[uid]; exists {
+		return uri
+	}
+	if index := strings.Index(uid, "~"); index >= 0 && !strings.HasPrefix(uid[index+1:], "tenant:") {
+		return uid[index+1:]
+	}
+	return comments
+}
+
+// target gives the status of the configured target whose location holds the file
+func (builder *statusBuilder) target(uri string) *targetStatus {
+	if index := locateTarget(builder.configured, uri); index >= 0 {
+		return builder.status(builder.configured[index].Name)
+	}
+	return builder.status(otherTarget)
+}
+
+// locateTarget gives the index of the target whose location holds the file or -1 when there is none, the deepest
+// location is used when the locations of targets overlap
+func locateTarget(targets []Target, uri string) int {
+	found := -1
+	longest := -1
+	cleanURI := filepath.Clean(uri)
+	for index, target := range targets {
+		if target.Location == "" {
+			continue
+		}
+		location := filepath.Clean(target.Location)
+		if cleanURI != location && !strings.HasPrefix(cleanURI, strings.TrimSuffix(location, string(filepath.Separator))+string(filepath.Separator)) {
+			continue
+		}
+		if len(location) > longest {
+			found = index
+			longest = len(location)
+		}
+	}
+	return found
+}
+
+func (builder *statusBuilder) isConfigured(name string) bool {
+	for _, target := range builder.configured {
+		if target.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (builder *statusBuilder) status(name string) *targetStatus {
+	status, exists := builder.targets[name]
+	if !exists {
+		status = &targetStatus{Target: name}
+		builder.targets[name] = status
+	}
+	return status
+}
+
+func (builder *statusBuilder) lastError(status *targetStatus, entry StatusRecordEntry) {
+	if status.LastError == nil || !entry.Time.Before(*status.LastError) {
+		entryTime := entry.Time
+		status.LastError = &entryTime
+		status.LastErrorText = entry.Operation + ": " + entry.Comments
+	}
+}
+
+// addPending counts the uploads the state store holds as waiting to be resumed which have no outcome in the time range
+func (builder *statusBuilder) addPending(uid string, progress trueconnect.UploadProgress) {
+	if progress.Complete {
+		return
+	}
+	if _, exists := builder.outcomes[uid]; exists {
+		return
+	}
+	builder.target(builder.fileOf(uid, "")).Pending++
+}
+
+// build counts each file by its last outcome and gives the status of the chosen targets, all targets when none are
+// chosen
+func (builder *statusBuilder) build(chosen []string) uploadStatus {
+	for uid, entry := range builder.outcomes {
+		uri := builder.fileOf(uid, entry.Comments)
+		status := builder.target(uri)
+		switch entry.Status {
+		case uploadSuccess:
+			status.Succeeded++
+			status.BytesUploaded += builder.sizes[uid]
+			if status.LastSuccess == nil || entry.Time.After(*status.LastSuccess) {
+				entryTime := entry.Time
+				status.LastSuccess = &entryTime
+				status.LastSuccessFile = uri
+			}
+		case partialStatus:
+			status.Partial++
+		case failedStatus:
+			status.Failed++
+		case skippedStatus:
+			status.Skipped++
+		case abandonedStatus:
+			status.Abandoned++
+		default:
+			status.Pending++
+		}
+	}
+
+	var names []string
+	if len(chosen) > 0 {
+		names = chosen
+	} else {
+		for _, target := range builder.configured {
+			names = append(names, target.Name)
+		}
+		if _, exists := builder.targets[otherTarget]; exists {
+			names = append(names, otherTarget)
+		}
+	}
+
+	result := uploadStatus{Overall: targetStatus{Target: overallName}}
+	if !builder.since.IsZero() {
+		result.Since = &builder.since
+	}
+	if !builder.until.IsZero() {
+		result.Until = &builder.until
+	}
+	for _, name := range names {
+		status := builder.status(name)
+		result.Targets = append(result.Targets, status)
+		result.Overall.add(status)
+	}
+	return result
+}
+
+// add includes the counts of another target in the totals
+func (status *targetStatus) add(other *targetStatus) {
+	status.Succeeded += other.Succeeded
+	status.Partial += other.Partial
+	status.Failed += other.Failed
+	status.Skipped += other.Skipped
+	status.Abandoned += other.Abandoned
+	status.Pending += other.Pending
+	status.BytesUploaded += other.BytesUploaded
+	if other.LastSuccess != nil && (status.LastSuccess == nil || other.LastSuccess.After(*status.LastSuccess)) {
+		status.LastSuccess = other.LastSuccess
+		status.LastSuccessFile = other.LastSuccessFile
+	}
+	if other.LastError != nil && (status.LastError == nil || other.LastError.After(*status.LastError)) {
+		status.LastError = other.LastError
+		status.LastErrorText = other.LastErrorText
+	}
+}
+
+// readConfiguredTargets gives the targets of the configuration file without checking them, they are only used to tell
+// which target found each file
+func readConfiguredTargets(configURI string) ([]Target, error) {
+	var config Configuration
+	data, err := ioutil.ReadFile(configURI)
+	if err == nil {
+		err = json.Unmarshal(data, &config)
+	}
+	return config.Targets, err
+}
+
+// status summarises the uploads recorded in the status log and the state file
+func (linkClient *linkClient) status() string {
+	since, until, err := linkClient.configuration.selector.times()
+	if err != nil {
+		linkClient.exitCode = 1
+		return err.Error()
+	}
+	format := linkClient.configuration.outputFormat
+	switch format {
+	case "":
+		format = formatTable
+	case formatTable, formatJSON, formatCSV:
+	default:
+		linkClient.exitCode = 1
+		return fmt.Sprintf("unrecognised format %q, use table, json or csv", format)
+	}
+
+	var notes []string
+	configured, err := readConfiguredTargets(linkClient.configuration.ClientID + ".json")
+	if err != nil {
+		notes = append(notes, "the configuration could not be read so files are not matched to targets: "+err.Error())
+	}
+	builder := newStatusBuilder(configured, since, until)
+	err = readStatusHistory(linkClient.configuration.ClientID+".recordStatus", since, builder.add)
+	if err != nil {
+		linkClient.exitCode = 1
+		return err.Error()
+	}
+	if linkClient.stateUnavailable != nil {
+		notes = append(notes, "uploads waiting to be resumed are not counted as the state file could not be opened: "+linkClient.stateUnavailable.Error())
+	} else {
+		linkClient.fileTransferRecorder.store.forEachProgress(func(uid string, progress trueconnect.UploadProgress) error {
+			builder.addPending(uid, progress)
+			return nil
+		})
+	}
+
+	result := builder.build(linkClient.configuration.selector.targets)
+	result.Notes = notes
+	output, err := writeStatus(result, format)
+	if err != nil {
+		linkClient.exitCode = 1
+		return err.Error()
+	}
+	return output
+}
+
+// writeStatus gives the status in the format chosen
+func writeStatus(result uploadStatus, format string) (string, error) {
+	var buffer bytes.Buffer
+	rows := append(append([]*targetStatus{}, result.Targets...), &result.Overall)
+	switch format {
+	case formatJSON:
+		data, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		buffer.Write(data)
+		buffer.WriteString("\n")
+	case formatCSV:
+		csvWriter := csv.NewWriter(&buffer)
+		csvWriter.Write([]string{"target", "succeeded", "partial", "failed", "skipped", "abandoned", "pending", "bytesuploaded",
+			"lastsuccess", "lastsuccessfile", "lasterror", "lasterrortext"})
+		for _, status := range rows {
+			csvWriter.Write([]string{status.Target, fmt.Sprint(status.Succeeded), fmt.Sprint(status.Partial),
+				fmt.Sprint(status.Failed), fmt.Sprint(status.Skipped), fmt.Sprint(status.Abandoned), fmt.Sprint(status.Pending),
+				fmt.Sprint(status.BytesUploaded), formatStatusTime(status.LastSuccess, ""), status.LastSuccessFile,
+				formatStatusTime(status.LastError, ""), status.LastErrorText})
+		}
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return "", err
+		}
+	default:
+		if result.Since != nil || result.Until != nil {
+			fmt.Fprintf(&buffer, "from %s until %s\n\n", formatStatusTime(result.Since, "the start"), formatStatusTime(result.Until, "now"))
+		}
+		writer := tabwriter.NewWriter(&buffer, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "TARGET\tSUCCEEDED\tPARTIAL\tFAILED\tSKIPPED\tABANDONED\tPENDING\tBYTES\tLAST SUCCESS\tLAST ERROR")
+		for _, status := range rows {
+			fmt.Fprintf(writer, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%s\t%s\n", status.Target, status.Succeeded, status.Partial,
+				status.Failed, status.Skipped, status.Abandoned, status.Pending, status.BytesUploaded,
+				formatStatusTime(status.LastSuccess, "-"), formatStatusTime(status.LastError, "-"))
+		}
+		writer.Flush()
+		for _, status := range result.Targets {
+			if status.LastError != nil {
+				fmt.Fprintf(&buffer, "\nlast error of %s: %s", status.Target, strings.Replace(truncate(status.LastErrorText, maxHookOutputLength), "\n", " ", -1))
+			}
+		}
+		for _, note := range result.Notes {
+			fmt.Fprintf(&buffer, "\nNOTE: %s", note)
+		}
+		buffer.WriteString("\n")
+	}
+	return buffer.String(), nil
+}
+
+func formatStatusTime(value *time.Time, empty string) string {
+	if value == nil {
+		return empty
+	}
+	return value.UTC().Format(time.RFC3339)
+}
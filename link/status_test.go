@@ -0,0 +1,76 @@
+package link
+
+import (
+	"encoding/json"
+	"github.com/GeneralElectric/TrueConnect-Link/trueconnect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadStatus(tests *testing.T) {
+	day := time.Date(2020, 3, 2, 0, 0, 0, 0, time.UTC)
+	at := func(hour int) time.Time { return day.Add(time.Duration(hour) * time.Hour) }
+	configured := []Target{{Name: "flights", Location: "/data/flights"}, {Name: "engines", Location: "/data/flights/engines"}}
+	entries := []StatusRecordEntry{
+		{Time: at(-2), System: systemName, Operation: fileUploadOpp, Status: startedStatus, ContextID: "h0~/data/flights/old.zip", Comments: "/data/flights/old.zip"},
+		{Time: at(-2), System: systemName, Operation: fileUploadOpp, Status: uploadSuccess, ContextID: "h0~/data/flights/old.zip", Comments: "ref0"},
+		{Time: at(1), System: systemName, Operation: fileUploadOpp, Status: skippedStatus, ContextID: "h0~/data/flights/old.zip", Comments: "/data/flights/old.zip duplicate of ref0"},
+		{Time: at(1), System: systemName, Operation: fileUploadOpp, Status: startedStatus, ContextID: "h1~/data/flights/a.zip", Comments: "/data/flights/a.zip"},
+		{Time: at(2), System: systemName, Operation: fileUploadOpp, Status: uploadSuccess, ContextID: "h1~/data/flights/a.zip", Comments: "ref1"},
+		{Time: at(2), System: systemName, Operation: versionOperation, Status: uploadSuccess, ContextID: "h1~/data/flights/a.zip", Comments: `{"path":"/data/flights/a.zip","size":100}`},
+		{Time: at(3), System: systemName, Operation: fileUploadOpp, Status: skippedStatus, ContextID: "h1~/data/flights/a.zip", Comments: "/data/flights/a.zip duplicate of ref1"},
+		{Time: at(3), System: systemName, Operation: fileUploadOpp, Status: startedStatus, ContextID: "h2~/data/flights/engines/b.zip", Comments: "/data/flights/engines/b.zip"},
+		{Time: at(4), System: systemName, Operation: fileUploadOpp, Status: failedStatus, ContextID: "h2~/data/flights/engines/b.zip", Comments: "rejected"},
+		{Time: at(5), System: systemName, Operation: "flights", Status: failedStatus, ContextID: "ctx", Comments: "access denied"},
+		{Time: at(5), System: compactionSystem, Operation: fileUploadOpp, Status: uploadSuccess, ContextID: "h1~/data/flights/a.zip", Comments: "ref1"},
+		{Time: at(6), System: systemName, Operation: fileUploadOpp, Status: startedStatus, ContextID: "h3~/tmp/c.zip", Comments: "/tmp/c.zip"},
+	}
+
+	builder := newStatusBuilder(configured, day, time.Time{})
+	for _, entry := range entries {
+		builder.add(entry)
+	}
+	builder.addPending("h4~/data/flights/engines/d.zip", trueconnect.UploadProgress{Reference: "ref4"})
+	result := builder.build(nil)
+
+	if len(result.Targets) != 3 || result.Targets[2].Target != otherTarget {
+		tests.Fatal("targets not as expected ", result.Targets)
+	}
+	flights, engines, other := result.Targets[0], result.Targets[1], result.Targets[2]
+	if flights.Succeeded != 1 || flights.Skipped != 1 || flights.BytesUploaded != 100 || flights.LastSuccessFile != "/data/flights/a.zip" {
+		tests.Fatal("flights status not as expected ", *flights)
+	}
+	if flights.LastErrorText != "flights: access denied" {
+		tests.Fatal("target failure not reported ", flights.LastErrorText)
+	}
+	if engines.Failed != 1 || engines.Pending != 1 || engines.LastErrorText != fileUploadOpp+": rejected" {
+		tests.Fatal("engines status not as expected ", *engines)
+	}
+	if other.Pending != 1 || result.Overall.Succeeded != 1 || result.Overall.Pending != 2 || result.Overall.Failed != 1 {
+		tests.Fatal("overall status not as expected ", result.Overall)
+	}
+
+	output, err := writeStatus(result, formatJSON)
+	var decoded uploadStatus
+	if err != nil || json.Unmarshal([]byte(output), &decoded) != nil || len(decoded.Targets) != 3 {
+		tests.Fatal("status not written as JSON ", output)
+	}
+	output, _ = writeStatus(result, formatCSV)
+	if lines := strings.Split(strings.TrimSpace(output), "\n"); len(lines) != 5 || !strings.HasPrefix(lines[4], overallName+",1,") {
+		tests.Fatal("status not written as CSV ", output)
+	}
+	output, _ = writeStatus(result, formatTable)
+	if !strings.Contains(output, "from 2020-03-02T00:00:00Z until now") || !strings.Contains(output, "last error of engines") {
+		tests.Fatal("status not written as a table ", output)
+	}
+
+	chosen := newStatusBuilder(configured, day, at(3))
+	for _, entry := range entries {
+		chosen.add(entry)
+	}
+	result = chosen.build([]string{"engines"})
+	if len(result.Targets) != 1 || result.Overall.Failed != 0 || result.Overall.Pending != 0 {
+		tests.Fatal("chosen targets and times not as expected ", result.Overall)
+	}
+}
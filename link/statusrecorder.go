@@ -1,19 +1,55 @@
 package link
 
 import (
+	"bufio"
 	"context"
 	"encoding/csv"
+	"encoding/json"
 	"github.com/google/uuid"
 	"io"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// When the status log is written to disk
+const (
+	syncNever           = "never"
+	syncAlways          = "always"
+	syncInterval        = "interval"
+	defaultSyncInterval = 1
+)
+
+// The formats the status log can be written in and the version of the JSON Lines format, the version changes when the
+// meaning of a field changes
+const (
+	statusFormatCSV        = "csv"
+	statusFormatJSONLines  = "jsonl"
+	statusLogSchemaVersion = 1
+)
+
+// the number of entries held while the status log is being written before recording a change waits
+const statusChannelBuffer = 1000
+
 type statusRecorder struct {
 	currentContext context.Context
 	statusChannel  chan StatusRecordEntry
 	fileToClose    *os.File
+	fileName       string
+	segmentStart   time.Time
+	lastSync       time.Time
+	unsynced       bool
+	// when a rotation that failed is tried again
+	rotationRetry time.Time
+	compressMutex sync.Mutex
+	compressing   sync.WaitGroup
+	config        *StatusLogConfig
+	compact       func(write func(StatusRecordEntry) error) error
+	sinks         []*bufferedSink
+	configMutex   sync.Mutex
 }
 
 // StatusRecordEntry is used to record the change in state in the application and is used to record such things as the
@@ -36,6 +72,49 @@ type StatusRecordEntry struct {
 
 	// extra information relating to the change
 	Comments string
+
+	// The typed details of the change, these are only written when the status log is in the JSON Lines format
+	Details *StatusDetails
+}
+
+// StatusDetails holds the typed details of a change such as a file upload that the JSON Lines status log carries
+// alongside the comments
+type StatusDetails struct {
+	// The path of the file
+	Path string `json:"path,omitempty"`
+
+	// The name of the target that found the file
+	Target string `json:"target,omitempty"`
+
+	// The tenant the file is uploaded to
+	Tenant string `json:"tenant,omitempty"`
+
+	// The size of the file in bytes
+	Size int64 `json:"size,omitempty"`
+
+	// The number of seconds the operation took
+	Duration float64 `json:"duration_seconds,omitempty"`
+
+	// The reference of the uploaded file in TrueConnect
+	DataStoreRef string `json:"data_store_ref,omitempty"`
+
+	// A short code for the kind of error such as "http_404", "not_found" or "permission"
+	ErrorCode string `json:"error_code,omitempty"`
+
+	// The error the operation failed with
+	Error string `json:"error,omitempty"`
+}
+
+// statusRecordJSON is a status entry as written to a JSON Lines status log
+type statusRecordJSON struct {
+	Schema    int       `json:"schema"`
+	Time      time.Time `json:"time"`
+	System    string    `json:"system"`
+	Operation string    `json:"operation"`
+	Status    string    `json:"status"`
+	ContextID string    `json:"context"`
+	Comments  string    `json:"comments,omitempty"`
+	*StatusDetails
 }
 
 // StatusRecordEntryFromLine will take the parts of a line of text produced by a CSV reader that parses status entries from TrueConnect-Link and turn them
@@ -70,6 +149,143 @@ func (recordEntry *StatusRecordEntry) StatusRecordToLine() []string {
 	}
 }
 
+// StatusRecordEntryFromJSON will take a line of a JSON Lines status log from TrueConnect-Link and turn it into a
+// StatusRecordEntry structure, the entry of a line that cannot be read has a zero time
+func StatusRecordEntryFromJSON(line []byte) (StatusRecordEntry, error) {
+	var statusRecordEntry StatusRecordEntry
+	var record statusRecordJSON
+	err := json.Unmarshal(line, &record)
+	if err != nil {
+		return statusRecordEntry, err
+	}
+	statusRecordEntry.Time = record.Time
+	statusRecordEntry.System = record.System
+	statusRecordEntry.Operation = record.Operation
+	statusRecordEntry.Status = record.Status
+	statusRecordEntry.ContextID = record.ContextID
+	statusRecordEntry.Comments = record.Comments
+	statusRecordEntry.Details = record.StatusDetails
+	return statusRecordEntry, nil
+}
+
+// StatusRecordToJSON will take a StatusRecordEntry and turn it into a line of a JSON Lines status log
+func (recordEntry *StatusRecordEntry) StatusRecordToJSON() ([]byte, error) {
+	return json.Marshal(statusRecordJSON{
+		Schema:        statusLogSchemaVersion,
+		Time:          recordEntry.Time,
+		System:        recordEntry.System,
+		Operation:     recordEntry.Operation,
+		Status:        recordEntry.Status,
+		ContextID:     recordEntry.ContextID,
+		Comments:      recordEntry.Comments,
+		StatusDetails: recordEntry.Details,
+	})
+}
+
+// statusEncoder writes status entries to the status log in its configured format
+type statusEncoder struct {
+	output    io.Writer
+	format    string
+	csvWriter *csv.Writer
+}
+
+func newStatusEncoder(output io.Writer, format string) *statusEncoder {
+	return &statusEncoder{output: output, format: format, csvWriter: csv.NewWriter(output)}
+}
+
+func (encoder *statusEncoder) write(entry StatusRecordEntry) error {
+	if encoder.format != statusFormatJSONLines {
+		return encoder.csvWriter.Write(entry.StatusRecordToLine())
+	}
+	data, err := entry.StatusRecordToJSON()
+	if err != nil {
+		return err
+	}
+	_, err = encoder.output.Write(append(data, '\n'))
+	return err
+}
+
+// setFormat changes the format of the entries written from now on, earlier entries are left in the format they were
+// written in as the status log readers recognise the format of each entry
+func (encoder *statusEncoder) setFormat(format string) {
+	encoder.flush()
+	encoder.format = format
+}
+
+func (encoder *statusEncoder) flush() {
+	encoder.csvWriter.Flush()
+}
+
+// statusEntryReader reads the entries of a status log one at a time. Entries written as CSV and as JSON Lines can be
+// mixed in the same log, the format of each is recognised from its first character
+type statusEntryReader struct {
+	reader *bufio.Reader
+}
+
+func newStatusEntryReader(reader io.Reader) *statusEntryReader {
+	return &statusEntryReader{reader: bufio.NewReader(reader)}
+}
+
+// next gives the next entry of the log and false when it could not be read, io.EOF is returned at the end of the log
+func (entryReader *statusEntryReader) next() (StatusRecordEntry, bool, error) {
+	var line string
+	var err error
+	for line == "" {
+		line, err = entryReader.reader.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return StatusRecordEntry{}, false, err
+		}
+		// blank lines are not entries
+		line = strings.TrimRight(line, "\r\n")
+	}
+
+	if strings.HasPrefix(strings.TrimSpace(line), "{") {
+		entry, err := StatusRecordEntryFromJSON([]byte(line))
+		return entry, err == nil && !entry.Time.IsZero(), nil
+	}
+
+	// a quoted CSV field can hold line breaks, the entry goes on until its quotes are balanced
+	for strings.Count(line, `"`)%2 == 1 && err == nil {
+		var more string
+		more, err = entryReader.reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return StatusRecordEntry{}, false, err
+		}
+		line += "\n" + strings.TrimRight(more, "\r\n")
+	}
+	parts, err := csv.NewReader(strings.NewReader(line)).Read()
+	entry := StatusRecordEntryFromLine(parts)
+	return entry, err == nil && len(parts) == 6 && !entry.Time.IsZero(), nil
+}
+
+// readStatusLog calls each for every entry in the status log, records that cannot be read such as a line left half
+// written by a power cut are skipped and their numbers returned along with those of the entries each returned false for
+func readStatusLog(fileName string, each func(StatusRecordEntry) bool) ([]int, error) {
+	statusFile, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer statusFile.Close()
+	return readStatusEntries(statusFile, each)
+}
+
+func readStatusEntries(reader io.Reader, each func(StatusRecordEntry) bool) ([]int, error) {
+	var badRecords []int
+	entryReader := newStatusEntryReader(reader)
+	for record := 1; ; record++ {
+		statusEntry, valid, err := entryReader.next()
+		if err == io.EOF {
+			return badRecords, nil
+		}
+		if err != nil {
+			return badRecords, err
+		}
+		if !valid || !each(statusEntry) {
+			badRecords = append(badRecords, record)
+		}
+	}
+}
+
 func createStatusRecorder(ctx context.Context) *statusRecorder {
 	return createStatusWriter(ctx, os.Stdout)
 }
@@ -79,41 +295,161 @@ func createFileStatusRecorder(ctx context.Context, fileName string) (*statusReco
 	if err != nil {
 		return nil, err
 	}
+	err = endLastLine(statusFile)
+	if err != nil {
+		statusFile.Close()
+		return nil, err
+	}
 
 	thisRecorder := createStatusWriter(ctx, statusFile)
 	thisRecorder.fileToClose = statusFile
+	thisRecorder.fileName = fileName
+	thisRecorder.segmentStart = segmentStartTime(fileName)
 	return thisRecorder, nil
 }
 
+// endLastLine ends a line left half written in the status log so that new entries start on a line of their own
+func endLastLine(statusFile *os.File) error {
+	info, err := statusFile.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	last := make([]byte, 1)
+	_, err = statusFile.ReadAt(last, info.Size()-1)
+	if err != nil || last[0] == '\n' {
+		return err
+	}
+	_, err = statusFile.Write([]byte("\n"))
+	return err
+}
+
+// configure sets when the status log is written to disk and rotated and the sinks entries are copied to, compact is
+// called to write the state still needed into each new segment
+func (statusRecorder *statusRecorder) configure(config StatusLogConfig, compact func(write func(StatusRecordEntry) error) error) {
+	statusRecorder.configMutex.Lock()
+	statusRecorder.config = &config
+	statusRecorder.compact = compact
+	previous := statusRecorder.sinks
+	statusRecorder.sinks = startSinks(config.Sinks, func(status string, contextID string, comments string) {
+		statusRecorder.recordStatus(systemName, sinkOperation, status, contextID, comments)
+	})
+	statusRecorder.configMutex.Unlock()
+
+	for _, sink := range previous {
+		sink.stop()
+	}
+}
+
+// stopSinks stops the configured sinks once they have written the entries they hold
+func (statusRecorder *statusRecorder) stopSinks() {
+	statusRecorder.configMutex.Lock()
+	sinks := statusRecorder.sinks
+	statusRecorder.sinks = nil
+	statusRecorder.configMutex.Unlock()
+	for _, sink := range sinks {
+		sink.stop()
+	}
+}
+
+// offerToSinks copies an entry written to the status log to each configured sink without waiting for them
+func (statusRecorder *statusRecorder) offerToSinks(entry StatusRecordEntry) {
+	statusRecorder.configMutex.Lock()
+	defer statusRecorder.configMutex.Unlock()
+	for _, sink := range statusRecorder.sinks {
+		sink.offer(entry)
+	}
+}
+
+func (statusRecorder *statusRecorder) settings() (*StatusLogConfig, func(write func(StatusRecordEntry) error) error) {
+	statusRecorder.configMutex.Lock()
+	defer statusRecorder.configMutex.Unlock()
+	return statusRecorder.config, statusRecorder.compact
+}
+
+// format gives the format new entries are written in, CSV until the configuration chooses another
+func (statusRecorder *statusRecorder) format() string {
+	config, _ := statusRecorder.settings()
+	if config == nil || strings.ToLower(config.Format) != statusFormatJSONLines {
+		return statusFormatCSV
+	}
+	return statusFormatJSONLines
+}
+
+// syncIfDue writes the entries recorded since the last sync to disk when the configuration asks for it
+func (statusRecorder *statusRecorder) syncIfDue(now time.Time) {
+	config, _ := statusRecorder.settings()
+	if config == nil || statusRecorder.fileToClose == nil || !statusRecorder.unsynced {
+		return
+	}
+	switch strings.ToLower(config.Sync) {
+	case syncAlways:
+	case syncInterval:
+		interval := config.SyncInterval
+		if interval <= 0 {
+			interval = defaultSyncInterval
+		}
+		if now.Sub(statusRecorder.lastSync) < time.Duration(interval)*time.Second {
+			return
+		}
+	default:
+		return
+	}
+	statusRecorder.fileToClose.Sync()
+	statusRecorder.lastSync = now
+	statusRecorder.unsynced = false
+}
+
 func createStatusWriter(ctx context.Context, writer io.Writer) *statusRecorder {
 	thisRecorder := statusRecorder{}
 	thisRecorder.currentContext = ctx
-	thisRecorder.statusChannel = make(chan StatusRecordEntry)
+	// entries are held while the log is written, synced or rotated so that recording a change is not held up
+	thisRecorder.statusChannel = make(chan StatusRecordEntry, statusChannelBuffer)
 	go func(currentStatusChannel chan StatusRecordEntry) {
-		csvWriter := csv.NewWriter(writer)
+		encoder := newStatusEncoder(writer, statusFormatCSV)
+		syncTicker := time.NewTicker(time.Second)
+		defer syncTicker.Stop()
 		defer close(currentStatusChannel)
-		defer csvWriter.Flush()
+		defer encoder.flush()
 
+		write := func(statusEntry StatusRecordEntry) {
+			if format := thisRecorder.format(); format != encoder.format {
+				encoder.setFormat(format)
+			}
+			err := encoder.write(statusEntry)
+			if err != nil {
+				err := encoder.write(statusEntry)
+				if err != nil {
+					log.Fatal(err)
+				}
+			}
+			encoder.flush()
+			thisRecorder.offerToSinks(statusEntry)
+			thisRecorder.unsynced = true
+			thisRecorder.syncIfDue(time.Now())
+			encoder = thisRecorder.rotateIfDue(encoder)
+		}
 		for {
 			select {
 			case statusEntry, isOk := <-currentStatusChannel:
 				if !isOk {
 					// if the channel has closed
-					csvWriter.Flush()
+					encoder.flush()
 					return
 				}
-				err := csvWriter.Write(statusEntry.StatusRecordToLine())
-				if err != nil {
-					err := csvWriter.Write(statusEntry.StatusRecordToLine())
-					if err != nil {
-						log.Fatal(err)
-					}
-				}
-				csvWriter.Flush()
-				break
+				write(statusEntry)
+			case <-syncTicker.C:
+				thisRecorder.syncIfDue(time.Now())
 			case <-thisRecorder.currentContext.Done():
-				csvWriter.Flush()
+				// the entries recorded before stopping, including failures compressing rotated segments, are still
+				// written
+				thisRecorder.compressing.Wait()
+				for pending := len(currentStatusChannel); pending > 0; pending-- {
+					write(<-currentStatusChannel)
+				}
+				encoder.flush()
+				thisRecorder.stopSinks()
 				if thisRecorder.fileToClose != nil {
+					thisRecorder.fileToClose.Sync()
 					err := thisRecorder.fileToClose.Close()
 					if err != nil {
 						log.Fatal(err)
@@ -128,6 +464,52 @@ func createStatusWriter(ctx context.Context, writer io.Writer) *statusRecorder {
 }
 
 func (statusRecorder *statusRecorder) recordStatus(system string, operation string, status string, contextID string, comments string) string {
+	return statusRecorder.recordDetailedStatus(system, operation, status, contextID, comments, nil)
+}
+
+// recordDetailedStatus records a change along with its typed details, the details are only written to a JSON Lines log
+func (statusRecorder *statusRecorder) recordDetailedStatus(system string, operation string, status string, contextID string, comments string, details *StatusDetails) string {
+	statusEntry := newStatusEntry(system, operation, status, contextID, comments)
+	statusEntry.Details = details
+
+	select {
+
+	case statusRecorder.statusChannel <- statusEntry:
+		break
+	case <-statusRecorder.currentContext.Done():
+		break
+	}
+	return statusEntry.ContextID
+}
+
+// errorCode gives a short code for the kind of error for the JSON Lines status log
+func errorCode(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case os.IsNotExist(err):
+		return "not_found"
+	case os.IsPermission(err):
+		return "permission"
+	case err == context.Canceled:
+		return "cancelled"
+	}
+	if timeout, isTimeout := err.(interface {
+		Timeout() bool
+	}); isTimeout && timeout.Timeout() {
+		return "timeout"
+	}
+	// the errors of TrueConnect requests start with the HTTP status of the response
+	message := err.Error()
+	if len(message) >= 4 && message[3] == ' ' {
+		if code, convErr := strconv.Atoi(message[:3]); convErr == nil && code >= 100 {
+			return "http_" + message[:3]
+		}
+	}
+	return "error"
+}
+
+func newStatusEntry(system string, operation string, status string, contextID string, comments string) StatusRecordEntry {
 	statusEntry := StatusRecordEntry{
 		Time:      time.Now().UTC(),
 		System:    system,
@@ -140,13 +522,5 @@ func (statusRecorder *statusRecorder) recordStatus(system string, operation stri
 	if statusEntry.ContextID == "" {
 		statusEntry.ContextID = uuid.New().String()
 	}
-
-	select {
-
-	case statusRecorder.statusChannel <- statusEntry:
-		break
-	case <-statusRecorder.currentContext.Done():
-		break
-	}
-	return statusEntry.ContextID
+	return statusEntry
 }
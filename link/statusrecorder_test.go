@@ -3,7 +3,10 @@ package link
 import (
 	"context"
 	"encoding/csv"
+	"errors"
+	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -44,3 +47,148 @@ func TestCreateLogger(tests *testing.T) {
 	}
 
 }
+
+func TestReadDamagedStatusLog(tests *testing.T) {
+	damaged := "2018-01-02T15:04:05Z,TrueConnect-Link,FileUpload,Success,abc~/in/a.zip,ref1\n" +
+		"not a time,TrueConnect-Link,FileUpload,Success,abc~/in/b.zip,ref2\n" +
+		"2018-01-02T15:04:06Z,TrueConnect-Link,FileUpload,Partial,abc~/in/c.zip,\"{\"\"Reference\"\":\"\"ref3\"\"}\"\n" +
+		"2018-01-02T15:04:07Z,TrueConnect-Link,FileUp"
+	entries := 0
+	badRecords, err := readStatusEntries(strings.NewReader(damaged), func(StatusRecordEntry) bool {
+		entries++
+		return true
+	})
+	if err != nil {
+		tests.Fatal(err)
+	}
+	if entries != 2 || len(badRecords) != 2 || badRecords[0] != 2 || badRecords[1] != 4 {
+		tests.Fatal("damaged records not skipped ", entries, badRecords)
+	}
+}
+
+func TestHalfWrittenLineEnded(tests *testing.T) {
+	defer os.Remove("TestHalfWrittenLineEnded.csv")
+	err := ioutil.WriteFile("TestHalfWrittenLineEnded.csv", []byte("2018-01-02T15:04:07Z,TrueConnect-Link,FileUp"), 0600)
+	if err != nil {
+		tests.Fatal(err)
+	}
+
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	recorder, err := createFileStatusRecorder(currentContext, "TestHalfWrittenLineEnded.csv")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	recorder.configure(StatusLogConfig{Sync: "always"}, nil)
+	recorder.recordStatus(systemName, fileUploadOpp, uploadSuccess, "abc~/in/a.zip", "ref1")
+	cancelFunction()
+	time.Sleep(time.Millisecond * 200)
+
+	var read []StatusRecordEntry
+	badRecords, err := readStatusLog("TestHalfWrittenLineEnded.csv", func(entry StatusRecordEntry) bool {
+		read = append(read, entry)
+		return true
+	})
+	if err != nil {
+		tests.Fatal(err)
+	}
+	if len(badRecords) != 1 || len(read) != 1 || read[0].Comments != "ref1" {
+		tests.Fatal("entry written after a half written line not read ", badRecords, read)
+	}
+}
+
+func TestJSONLinesStatusLog(tests *testing.T) {
+	defer os.Remove("TestJSONLinesStatusLog.csv")
+	err := ioutil.WriteFile("TestJSONLinesStatusLog.csv", []byte("2018-01-02T15:04:05Z,TrueConnect-Link,FileUpload,Success,abc~/in/a.zip,\"first\nline\"\n"), 0600)
+	if err != nil {
+		tests.Fatal(err)
+	}
+
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	recorder, err := createFileStatusRecorder(currentContext, "TestJSONLinesStatusLog.csv")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	recorder.configure(StatusLogConfig{Format: "jsonl"}, nil)
+	recorder.recordDetailedStatus(systemName, fileUploadOpp, failedStatus, "def~/in/b.zip", "second,\"line\"",
+		&StatusDetails{Path: "/in/b.zip", Tenant: "tenant1", Size: 1024, Duration: 1.5, ErrorCode: "http_404"})
+	cancelFunction()
+	time.Sleep(time.Millisecond * 200)
+
+	data, err := ioutil.ReadFile("TestJSONLinesStatusLog.csv")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if !strings.HasPrefix(lines[len(lines)-1], `{"schema":1,`) {
+		tests.Fatal("entry not written as JSON Lines ", lines[len(lines)-1])
+	}
+
+	var read []StatusRecordEntry
+	badRecords, err := readStatusLog("TestJSONLinesStatusLog.csv", func(entry StatusRecordEntry) bool {
+		read = append(read, entry)
+		return true
+	})
+	if err != nil {
+		tests.Fatal(err)
+	}
+	if len(badRecords) != 0 || len(read) != 2 || read[0].Comments != "first\nline" || read[0].Details != nil {
+		tests.Fatal("CSV entry not read from a mixed log ", badRecords, read)
+	}
+	if read[1].Comments != "second,\"line\"" || read[1].ContextID != "def~/in/b.zip" || read[1].Details == nil ||
+		read[1].Details.Size != 1024 || read[1].Details.Tenant != "tenant1" || read[1].Details.ErrorCode != "http_404" {
+		tests.Fatal("JSON Lines entry not read ", read[1])
+	}
+}
+
+func TestErrorCode(tests *testing.T) {
+	_, notFound := os.Open("TestErrorCode.missing")
+	for err, code := range map[error]string{
+		notFound:                          "not_found",
+		context.Canceled:                  "cancelled",
+		errors.New("404 Not Found"):       "http_404",
+		errors.New("MD5Hash not matched"): "error",
+	} {
+		if errorCode(err) != code {
+			tests.Fatal("wrong code for ", err, errorCode(err))
+		}
+	}
+}
+
+// blockedWriter holds up every write until it is released, as a slow disk would
+type blockedWriter struct {
+	release chan struct{}
+	written chan string
+}
+
+func (writer blockedWriter) Write(data []byte) (int, error) {
+	<-writer.release
+	writer.written <- string(data)
+	return len(data), nil
+}
+
+func TestRecordStatusNotHeldUp(tests *testing.T) {
+	writer := blockedWriter{release: make(chan struct{}), written: make(chan string, 100)}
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	recorder := createStatusWriter(currentContext, writer)
+
+	recorded := make(chan struct{})
+	go func() {
+		for index := 0; index < 10; index++ {
+			recorder.recordStatus(systemName, fileUploadOpp, startedStatus, "", "/in/a.zip")
+		}
+		close(recorded)
+	}()
+	select {
+	case <-recorded:
+	case <-time.After(time.Second):
+		tests.Fatal("recording held up while the status log was written")
+	}
+
+	// the entries recorded are still written when the client stops
+	cancelFunction()
+	close(writer.release)
+	time.Sleep(time.Millisecond * 200)
+	if written := len(writer.written); written != 10 {
+		tests.Fatal("entries recorded before stopping not written ", written)
+	}
+}
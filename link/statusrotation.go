@@ -0,0 +1,242 @@
+package link
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Names used when rotating the status log, compacted entries are written with their own system name so they can be told
+// apart from the entries recorded when the operation happened
+const (
+	compactionSystem   = "TrueConnect-Link-Compaction"
+	statusLogOperation = "StatusLog"
+	rotatedStatus      = "Rotated"
+	segmentTimeLayout  = "20060102T150405.000000000Z"
+	// how long to wait before trying again to rotate a status log that could not be renamed
+	rotationRetryInterval = time.Minute
+)
+
+// rotationDue returns true when the current segment has grown past the maximum size or age
+func (statusRecorder *statusRecorder) rotationDue(config *StatusLogConfig, now time.Time) bool {
+	if config.MaxAge > 0 && now.Sub(statusRecorder.segmentStart) >= time.Duration(config.MaxAge)*time.Second {
+		return true
+	}
+	if config.MaxSize > 0 {
+		info, err := statusRecorder.fileToClose.Stat()
+		return err == nil && info.Size() >= config.MaxSize
+	}
+	return false
+}
+
+// rotateIfDue is called by the status writer after each entry, when the segment is due to be rotated it is closed and
+// replaced with a new segment holding the compacted state, the closed segment is compressed in the background. It gives
+// the writer for the current segment
+func (statusRecorder *statusRecorder) rotateIfDue(encoder *statusEncoder) *statusEncoder {
+	config, compact := statusRecorder.settings()
+	if config == nil || statusRecorder.fileToClose == nil {
+		return encoder
+	}
+	now := time.Now().UTC()
+	if now.Before(statusRecorder.rotationRetry) || !statusRecorder.rotationDue(config, now) {
+		return encoder
+	}
+
+	encoder.flush()
+	statusRecorder.fileToClose.Sync()
+	statusRecorder.fileToClose.Close()
+	segmentName := statusRecorder.fileName + "." + now.Format(segmentTimeLayout)
+	renameErr := os.Rename(statusRecorder.fileName, segmentName)
+
+	statusFile, err := os.OpenFile(statusRecorder.fileName, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+	statusRecorder.fileToClose = statusFile
+	encoder = newStatusEncoder(statusFile, encoder.format)
+	if renameErr != nil {
+		statusRecorder.rotationRetry = now.Add(rotationRetryInterval)
+		encoder.write(newStatusEntry(systemName, statusLogOperation, failedStatus, "", renameErr.Error()))
+		encoder.flush()
+		return encoder
+	}
+	statusRecorder.segmentStart = now
+
+	contextID := uuid.New().String()
+	if compact != nil {
+		err = compact(func(entry StatusRecordEntry) error {
+			entry.System = compactionSystem
+			entry.Time = now
+			return encoder.write(entry)
+		})
+		if err != nil {
+			encoder.write(newStatusEntry(systemName, statusLogOperation, failedStatus, contextID, err.Error()))
+		}
+	}
+
+	encoder.write(newStatusEntry(systemName, statusLogOperation, rotatedStatus, contextID, filepath.Base(segmentName)))
+	encoder.flush()
+	statusRecorder.compressing.Add(1)
+	go statusRecorder.compressRotated(segmentName, config.Retain, contextID)
+	return encoder
+}
+
+// compressRotated compresses the rotated segment and removes the oldest segments, recording any failure. Segments are
+// compressed one at a time
+func (statusRecorder *statusRecorder) compressRotated(segmentName string, retain int, contextID string) {
+	defer statusRecorder.compressing.Done()
+	statusRecorder.compressMutex.Lock()
+	defer statusRecorder.compressMutex.Unlock()
+	err := compressSegment(segmentName)
+	if os.IsNotExist(err) {
+		// removed as one of the oldest segments by an earlier rotation
+		return
+	}
+	if err == nil {
+		err = removeOldSegments(statusRecorder.fileName, retain)
+	}
+	if err != nil {
+		statusRecorder.recordStatus(systemName, statusLogOperation, failedStatus, contextID, filepath.Base(segmentName)+": "+err.Error())
+	}
+}
+
+// segmentStartTime gives the time of the first entry in the status log segment, or now when it is empty
+func segmentStartTime(fileName string) time.Time {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return time.Now().UTC()
+	}
+	defer file.Close()
+	entry, valid, err := newStatusEntryReader(file).next()
+	if err != nil || !valid {
+		return time.Now().UTC()
+	}
+	return entry.Time
+}
+
+// compressSegment replaces the rotated segment with a gzip copy of it
+func compressSegment(segmentName string) error {
+	source, err := os.Open(segmentName)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	destination, err := os.OpenFile(segmentName+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	zipWriter := gzip.NewWriter(destination)
+	_, err = io.Copy(zipWriter, source)
+	if err == nil {
+		err = zipWriter.Close()
+	}
+	if err == nil {
+		err = destination.Sync()
+	}
+	closeErr := destination.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(segmentName + ".gz")
+		return err
+	}
+	source.Close()
+	return os.Remove(segmentName)
+}
+
+// statusSegments gives the rotated segments of the status log, oldest first
+func statusSegments(fileName string) ([]string, error) {
+	matches, err := filepath.Glob(fileName + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var segments []string
+	for _, match := range matches {
+		segmentTime := strings.TrimSuffix(strings.TrimPrefix(match, fileName+"."), ".gz")
+		if _, err := time.Parse(segmentTimeLayout, segmentTime); err == nil {
+			segments = append(segments, match)
+		}
+	}
+	// the time in the segment names sorts in the order they were rotated
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// removeOldSegments removes the oldest rotated segments so that no more than retain are kept, 0 keeps them all
+func removeOldSegments(fileName string, retain int) error {
+	if retain <= 0 {
+		return nil
+	}
+	segments, err := statusSegments(fileName)
+	if err != nil {
+		return err
+	}
+	for len(segments) > retain {
+		err = os.Remove(segments[0])
+		if err != nil {
+			return fmt.Errorf("could not remove old status log %s: %v", segments[0], err)
+		}
+		segments = segments[1:]
+	}
+	return nil
+}
+
+// readStatusHistory reads the rotated segments of the status log oldest first and then the current log. Segments rotated
+// before the since time are not read as all of their entries are older, records that cannot be read are skipped
+func readStatusHistory(fileName string, since time.Time, each func(StatusRecordEntry)) error {
+	segments, err := statusSegments(fileName)
+	if err != nil {
+		return err
+	}
+	readEntry := func(entry StatusRecordEntry) bool {
+		each(entry)
+		return true
+	}
+	for index, segment := range segments {
+		if index > 0 && segments[index-1]+".gz" == segment {
+			// left behind when compressing the segment was interrupted, the segment itself is read
+			continue
+		}
+		rotated, _ := time.Parse(segmentTimeLayout, strings.TrimSuffix(strings.TrimPrefix(segment, fileName+"."), ".gz"))
+		if !since.IsZero() && rotated.Before(since) {
+			continue
+		}
+		err = readStatusSegment(segment, readEntry)
+		if err != nil {
+			return fmt.Errorf("could not read status log %s: %v", segment, err)
+		}
+	}
+	_, err = readStatusLog(fileName, readEntry)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func readStatusSegment(segmentName string, each func(StatusRecordEntry) bool) error {
+	file, err := os.Open(segmentName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	if strings.HasSuffix(segmentName, ".gz") {
+		zipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer zipReader.Close()
+		reader = zipReader
+	}
+	_, err = readStatusEntries(reader, each)
+	return err
+}
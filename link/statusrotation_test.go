@@ -0,0 +1,138 @@
+package link
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"github.com/GeneralElectric/TrueConnect-Link/trueconnect"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusLogRotation(tests *testing.T) {
+	dir, err := ioutil.TempDir("", "rotation")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "client.recordStatus")
+
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	recorder, err := createFileStatusRecorder(currentContext, fileName)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	transfers := createFileTransferRecorder()
+	transfers.startRecord("deadface~/in/file.zip", trueconnect.UploadProgress{})
+	transfers.stopRecord("deadface~/in/file.zip", trueconnect.UploadProgress{Complete: true, Reference: "ref1"})
+	recorder.configure(StatusLogConfig{MaxSize: 500, Retain: 2}, transfers.snapshot)
+
+	for index := 0; index < 40; index++ {
+		recorder.recordStatus(systemName, fileUploadOpp, startedStatus, "", fmt.Sprintf("/in/%d.zip", index))
+	}
+	cancelFunction()
+	time.Sleep(time.Millisecond * 200)
+
+	segments, err := statusSegments(fileName)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	if len(segments) != 2 {
+		tests.Fatal("rotated logs not limited to the retained count ", segments)
+	}
+	for _, segment := range segments {
+		if !strings.HasSuffix(segment, ".gz") {
+			tests.Fatal("rotated log not compressed ", segment)
+		}
+	}
+
+	zipped, err := os.Open(segments[1])
+	if err != nil {
+		tests.Fatal(err)
+	}
+	defer zipped.Close()
+	zipReader, err := gzip.NewReader(zipped)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	lines, err := csv.NewReader(zipReader).ReadAll()
+	if err != nil || len(lines) == 0 {
+		tests.Fatal("rotated log not readable ", err)
+	}
+
+	rebuilt := createFileTransferRecorder()
+	if err = rebuilt.buildFromStatusEntry(fileName); err != nil {
+		tests.Fatal(err)
+	}
+	if progress, isOk, _ := rebuilt.startRecord("deadface~/in/file.zip", trueconnect.UploadProgress{}); isOk || progress.Reference != "ref1" {
+		tests.Fatal("state not carried into the new log")
+	}
+
+	started := func(count *int) func(StatusRecordEntry) {
+		return func(entry StatusRecordEntry) {
+			if entry.System == systemName && entry.Status == startedStatus {
+				*count++
+			}
+		}
+	}
+	var inHistory, inLog int
+	if err = readStatusHistory(fileName, time.Time{}, started(&inHistory)); err != nil {
+		tests.Fatal(err)
+	}
+	readStatusLog(fileName, func(entry StatusRecordEntry) bool {
+		started(&inLog)(entry)
+		return true
+	})
+	if inHistory <= inLog {
+		tests.Fatal("rotated logs not read with the current log ", inHistory, inLog)
+	}
+	inHistory = 0
+	readStatusHistory(fileName, time.Now().Add(time.Hour), started(&inHistory))
+	if inHistory != inLog {
+		tests.Fatal("rotated logs older than the since time read ", inHistory, inLog)
+	}
+}
+
+func TestStatusLogRotationBacksOff(tests *testing.T) {
+	if runtime.GOOS == "windows" {
+		tests.Skip("an open status log cannot be removed")
+	}
+	dir, err := ioutil.TempDir("", "rotation")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "client.recordStatus")
+
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	recorder, err := createFileStatusRecorder(currentContext, fileName)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	recorder.configure(StatusLogConfig{MaxSize: 200}, nil)
+	// the log cannot be renamed when it has gone, the next rotation waits rather than being tried after every entry
+	os.Remove(fileName)
+	for index := 0; index < 20; index++ {
+		recorder.recordStatus(systemName, fileUploadOpp, startedStatus, "", fmt.Sprintf("/in/%d.zip", index))
+	}
+	cancelFunction()
+	time.Sleep(time.Millisecond * 200)
+
+	segments, _ := statusSegments(fileName)
+	failures := 0
+	readStatusLog(fileName, func(entry StatusRecordEntry) bool {
+		if entry.Operation == statusLogOperation && entry.Status == failedStatus {
+			failures++
+		}
+		return true
+	})
+	if len(segments) != 0 || failures != 1 {
+		tests.Fatal("rotation tried again straight after failing ", segments, failures)
+	}
+}
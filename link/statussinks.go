@@ -0,0 +1,427 @@
+package link
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The kinds of sink status entries can be copied to, the severities entries are filtered by and the operation and
+// statuses recorded in the status log when a sink fails, recovers or falls behind
+const (
+	sinkFile              = "file"
+	sinkStdout            = "stdout"
+	sinkSyslog            = "syslog"
+	sinkJournald          = "journald"
+	sinkRotatingFile      = "rotatingfile"
+	severityDebug         = "debug"
+	severityInfo          = "info"
+	severityWarning       = "warning"
+	severityError         = "error"
+	sinkOperation         = "StatusSink"
+	droppedStatus         = "Dropped"
+	defaultSinkBuffer     = 1000
+	defaultSinkMaxSize    = 10000000
+	defaultSinkRetain     = 5
+	journaldSocket        = "/run/systemd/journal/socket"
+	syslogFacilityDaemon  = 3
+	syslogIdentifier      = "trueconnect-link"
+	sinkReconnectInterval = 10 * time.Second
+	sinkStopTimeout       = 2 * time.Second
+)
+
+// severities in increasing order, the index is the value compared with the minimum severity of a sink
+var severities = []string{severityDebug, severityInfo, severityWarning, severityError}
+
+// the syslog severity of each of the severities
+var syslogSeverities = []int{7, 6, 4, 3}
+
+// the local sockets syslog is looked for on when no address is configured
+var syslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// statusSink is a destination status entries are copied to as well as the status log
+type statusSink interface {
+	write(entry StatusRecordEntry) error
+	close() error
+}
+
+// bufferedSink holds the entries for a sink while the sink writes them, so a slow or broken sink never holds up the
+// status log. Entries are dropped when the buffer is full and the number dropped is recorded in the status log
+type bufferedSink struct {
+	name     string
+	sink     statusSink
+	minimum  int
+	entries  chan StatusRecordEntry
+	dropped  int64
+	failing  bool
+	report   func(status string, contextID string, comments string)
+	finished chan struct{}
+}
+
+// severityLevel gives the position of the named severity in severities, debug when it is not set
+func severityLevel(name string) (int, error) {
+	if name == "" {
+		name = severityDebug
+	}
+	for level, severity := range severities {
+		if strings.EqualFold(severity, name) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unrecognised severity %q, use debug, info, warning or error", name)
+}
+
+// statusSeverity gives how severe the change recorded by the entry is
+func statusSeverity(entry StatusRecordEntry) int {
+	switch entry.Status {
+	case failedStatus, abandonedStatus:
+		return 3
+	case partialStatus, heldStatus, recoveredStatus, interruptedStatus, droppedStatus, warningStatus:
+		return 2
+	case startedStatus, searchingStatus, skippedStatus:
+		return 0
+	}
+	return 1
+}
+
+// validate checks the sink configuration when the configuration is loaded
+func (config StatusSinkConfig) validate() error {
+	switch strings.ToLower(config.Type) {
+	case sinkFile, sinkRotatingFile:
+		if config.Path == "" {
+			return fmt.Errorf("the %s status sink needs a path", config.Type)
+		}
+	case sinkStdout, sinkSyslog, sinkJournald:
+	default:
+		return fmt.Errorf("unrecognised status sink type %q, use file, stdout, syslog, journald or rotatingfile", config.Type)
+	}
+	switch strings.ToLower(config.Format) {
+	case "", statusFormatCSV, statusFormatJSONLines:
+	default:
+		return fmt.Errorf("unrecognised status sink format %q, use csv or jsonl", config.Format)
+	}
+	if config.Buffer < 0 || config.MaxSize < 0 || config.Retain < 0 {
+		return fmt.Errorf("the buffer, maximum size and number of files retained of the %s status sink cannot be negative", config.Type)
+	}
+	_, err := severityLevel(config.MinSeverity)
+	return err
+}
+
+// name describes the sink in the status log
+func (config StatusSinkConfig) name() string {
+	name := strings.ToLower(config.Type)
+	if config.Path != "" {
+		return name + ":" + config.Path
+	}
+	if config.Address != "" {
+		return name + ":" + config.Address
+	}
+	return name
+}
+
+// newStatusSink creates the sink described by the configuration, sinks open what they write to when they first write so
+// that a sink that cannot be opened is reported in the status log like any other failure
+func newStatusSink(config StatusSinkConfig) statusSink {
+	format := strings.ToLower(config.Format)
+	if format != statusFormatJSONLines {
+		format = statusFormatCSV
+	}
+	switch strings.ToLower(config.Type) {
+	case sinkStdout:
+		return &writerSink{encoder: newStatusEncoder(os.Stdout, format)}
+	case sinkRotatingFile:
+		maxSize, retain := config.MaxSize, config.Retain
+		if maxSize == 0 {
+			maxSize = defaultSinkMaxSize
+		}
+		if retain == 0 {
+			retain = defaultSinkRetain
+		}
+		return &rotatingFileSink{path: config.Path, format: format, maxSize: maxSize, retain: retain}
+	case sinkSyslog:
+		return &socketSink{addresses: sinkAddresses(config.Address, syslogSockets), format: format, message: syslogMessage}
+	case sinkJournald:
+		return &socketSink{addresses: sinkAddresses(config.Address, []string{journaldSocket}), format: format, message: journaldMessage}
+	}
+	return &writerSink{path: config.Path, format: format}
+}
+
+func sinkAddresses(address string, defaults []string) []string {
+	if address != "" {
+		return []string{address}
+	}
+	return defaults
+}
+
+// startSinks starts a buffered sink for each configured sink, each runs until it is stopped
+func startSinks(configs []StatusSinkConfig, report func(status string, contextID string, comments string)) []*bufferedSink {
+	var sinks []*bufferedSink
+	for _, config := range configs {
+		size := config.Buffer
+		if size == 0 {
+			size = defaultSinkBuffer
+		}
+		minimum, _ := severityLevel(config.MinSeverity)
+		buffered := &bufferedSink{
+			name:     config.name(),
+			sink:     newStatusSink(config),
+			minimum:  minimum,
+			entries:  make(chan StatusRecordEntry, size),
+			report:   report,
+			finished: make(chan struct{}),
+		}
+		go buffered.run()
+		sinks = append(sinks, buffered)
+	}
+	return sinks
+}
+
+// offer gives the sink an entry without waiting, the entry is dropped when the sink is not keeping up
+func (buffered *bufferedSink) offer(entry StatusRecordEntry) {
+	if statusSeverity(entry) < buffered.minimum {
+		return
+	}
+	select {
+	case buffered.entries <- entry:
+	default:
+		atomic.AddInt64(&buffered.dropped, 1)
+	}
+}
+
+// stop ends the sink once it has written the entries it holds, waiting no longer than sinkStopTimeout for a sink that
+// is not keeping up
+func (buffered *bufferedSink) stop() {
+	close(buffered.entries)
+	select {
+	case <-buffered.finished:
+	case <-time.After(sinkStopTimeout):
+	}
+}
+
+func (buffered *bufferedSink) run() {
+	defer close(buffered.finished)
+	defer buffered.sink.close()
+	for entry := range buffered.entries {
+		buffered.deliver(entry)
+	}
+}
+
+// deliver writes an entry to the sink, the first failure and the recovery after it are recorded in the status log
+// along with the number of entries dropped
+func (buffered *bufferedSink) deliver(entry StatusRecordEntry) {
+	err := buffered.sink.write(entry)
+	if err != nil && !buffered.failing {
+		buffered.failing = true
+		buffered.report(failedStatus, buffered.name, err.Error())
+	} else if err == nil && buffered.failing {
+		buffered.failing = false
+		buffered.report(recoveredStatus, buffered.name, "")
+	}
+	if dropped := atomic.SwapInt64(&buffered.dropped, 0); dropped > 0 {
+		buffered.report(droppedStatus, buffered.name, fmt.Sprintf("%d entries dropped as the sink was not keeping up", dropped))
+	}
+}
+
+// formatStatusEntry gives the entry as a line in the format without the line ending
+func formatStatusEntry(entry StatusRecordEntry, format string) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := newStatusEncoder(&buffer, format)
+	err := encoder.write(entry)
+	encoder.flush()
+	if err == nil {
+		err = encoder.csvWriter.Error()
+	}
+	return bytes.TrimRight(buffer.Bytes(), "\r\n"), err
+}
+
+// writerSink appends entries to a file or to standard output
+type writerSink struct {
+	path    string
+	format  string
+	file    *os.File
+	encoder *statusEncoder
+}
+
+func (sink *writerSink) write(entry StatusRecordEntry) error {
+	if sink.encoder == nil {
+		file, err := os.OpenFile(sink.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		sink.file = file
+		sink.encoder = newStatusEncoder(file, sink.format)
+	}
+	err := sink.encoder.write(entry)
+	sink.encoder.flush()
+	if err == nil {
+		err = sink.encoder.csvWriter.Error()
+	}
+	return err
+}
+
+func (sink *writerSink) close() error {
+	if sink.file == nil {
+		return nil
+	}
+	err := sink.file.Close()
+	sink.file = nil
+	sink.encoder = nil
+	return err
+}
+
+// rotatingFileSink appends entries to a file that is renamed once it reaches its maximum size, the newest rotated file
+// has the suffix .1 and only the configured number of them are kept
+type rotatingFileSink struct {
+	path    string
+	format  string
+	maxSize int64
+	retain  int
+	file    *os.File
+	size    int64
+}
+
+func (sink *rotatingFileSink) write(entry StatusRecordEntry) error {
+	line, err := formatStatusEntry(entry, sink.format)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if sink.file != nil && sink.size > 0 && sink.size+int64(len(line)) > sink.maxSize {
+		sink.close()
+		err = sink.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	if sink.file == nil {
+		file, err := os.OpenFile(sink.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		sink.file = file
+		sink.size = info.Size()
+	}
+	written, err := sink.file.Write(line)
+	sink.size += int64(written)
+	return err
+}
+
+func (sink *rotatingFileSink) rotate() error {
+	os.Remove(sink.path + "." + strconv.Itoa(sink.retain))
+	for index := sink.retain - 1; index > 0; index-- {
+		name := sink.path + "." + strconv.Itoa(index)
+		if _, err := os.Stat(name); err == nil {
+			if err := os.Rename(name, sink.path+"."+strconv.Itoa(index+1)); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Rename(sink.path, sink.path+".1")
+}
+
+func (sink *rotatingFileSink) close() error {
+	if sink.file == nil {
+		return nil
+	}
+	err := sink.file.Close()
+	sink.file = nil
+	return err
+}
+
+// socketSink sends each entry as a datagram to a local socket such as that of syslog or journald, the socket is opened
+// again after it fails though no more than once every sinkReconnectInterval
+type socketSink struct {
+	addresses []string
+	format    string
+	message   func(entry StatusRecordEntry, text []byte) []byte
+	conn      net.Conn
+	lastDial  time.Time
+}
+
+func (sink *socketSink) write(entry StatusRecordEntry) error {
+	if sink.conn == nil {
+		if time.Since(sink.lastDial) < sinkReconnectInterval {
+			return fmt.Errorf("the socket could not be opened recently, %s", strings.Join(sink.addresses, ", "))
+		}
+		sink.lastDial = time.Now()
+		var err error
+		for _, address := range sink.addresses {
+			sink.conn, err = net.Dial("unixgram", address)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	text, err := formatStatusEntry(entry, sink.format)
+	if err != nil {
+		return err
+	}
+	_, err = sink.conn.Write(sink.message(entry, text))
+	if err != nil {
+		sink.close()
+		sink.lastDial = time.Time{}
+	}
+	return err
+}
+
+func (sink *socketSink) close() error {
+	if sink.conn == nil {
+		return nil
+	}
+	err := sink.conn.Close()
+	sink.conn = nil
+	return err
+}
+
+// syslogMessage gives the entry as a syslog message in the format of RFC 3164 as local syslog daemons expect
+func syslogMessage(entry StatusRecordEntry, text []byte) []byte {
+	priority := syslogFacilityDaemon*8 + syslogSeverities[statusSeverity(entry)]
+	host, _ := os.Hostname()
+	header := fmt.Sprintf("<%d>%s %s %s[%d]: ", priority, entry.Time.Local().Format(time.Stamp), host, syslogIdentifier, os.Getpid())
+	return append([]byte(header), text...)
+}
+
+// journaldMessage gives the entry in the native journald protocol, with the fields of the entry as journal fields so
+// that they can be matched on with journalctl
+func journaldMessage(entry StatusRecordEntry, text []byte) []byte {
+	var buffer bytes.Buffer
+	writeJournalField(&buffer, "MESSAGE", string(text))
+	writeJournalField(&buffer, "PRIORITY", strconv.Itoa(syslogSeverities[statusSeverity(entry)]))
+	writeJournalField(&buffer, "SYSLOG_IDENTIFIER", syslogIdentifier)
+	writeJournalField(&buffer, "TRUECONNECT_SYSTEM", entry.System)
+	writeJournalField(&buffer, "TRUECONNECT_OPERATION", entry.Operation)
+	writeJournalField(&buffer, "TRUECONNECT_STATUS", entry.Status)
+	writeJournalField(&buffer, "TRUECONNECT_CONTEXT", entry.ContextID)
+	return buffer.Bytes()
+}
+
+// writeJournalField writes a field in the native journald protocol, values holding a line break are written with their
+// length in front as the protocol requires
+func writeJournalField(writer io.Writer, name string, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(writer, "%s=%s\n", name, value)
+		return
+	}
+	length := uint64(len(value))
+	size := make([]byte, 8)
+	for index := range size {
+		size[index] = byte(length >> (8 * uint(index)))
+	}
+	fmt.Fprintf(writer, "%s\n", name)
+	writer.Write(size)
+	fmt.Fprintf(writer, "%s\n", value)
+}
@@ -0,0 +1,171 @@
+package link
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusSinks(tests *testing.T) {
+	defer os.Remove("TestStatusSinks.csv")
+	defer os.Remove("TestStatusSinks.errors")
+	defer os.Remove("TestStatusSinks.rotating")
+	defer os.Remove("TestStatusSinks.rotating.1")
+	defer os.Remove("TestStatusSinks.rotating.2")
+
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	recorder, err := createFileStatusRecorder(currentContext, "TestStatusSinks.csv")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	recorder.configure(StatusLogConfig{Sinks: []StatusSinkConfig{
+		{Type: "file", Path: "TestStatusSinks.errors", Format: "jsonl", MinSeverity: "warning"},
+		{Type: "rotatingfile", Path: "TestStatusSinks.rotating", MaxSize: 150, Retain: 2},
+	}}, nil)
+	for index := 0; index < 5; index++ {
+		recorder.recordStatus(systemName, fileUploadOpp, startedStatus, "abc~/in/a.zip", "/in/a.zip")
+	}
+	recorder.recordStatus(systemName, fileUploadOpp, failedStatus, "abc~/in/a.zip", "connection refused")
+	cancelFunction()
+	time.Sleep(time.Millisecond * 200)
+
+	data, err := ioutil.ReadFile("TestStatusSinks.errors")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], `"status":"Failed"`) {
+		tests.Fatal("the sink did not filter by severity ", lines)
+	}
+
+	for _, name := range []string{"TestStatusSinks.rotating", "TestStatusSinks.rotating.1", "TestStatusSinks.rotating.2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			tests.Fatal("rotated file missing ", err)
+		}
+		if info.Size() > 150 {
+			tests.Fatal("rotated file larger than its maximum size ", name, info.Size())
+		}
+	}
+	if _, err := os.Stat("TestStatusSinks.rotating.3"); err == nil {
+		os.Remove("TestStatusSinks.rotating.3")
+		tests.Fatal("more rotated files kept than retained")
+	}
+}
+
+// blockedSink waits to be released before writing each entry
+type blockedSink struct {
+	release chan struct{}
+	written []StatusRecordEntry
+}
+
+func (sink *blockedSink) write(entry StatusRecordEntry) error {
+	<-sink.release
+	sink.written = append(sink.written, entry)
+	return nil
+}
+
+func (sink *blockedSink) close() error {
+	return nil
+}
+
+func TestSlowSinkDropsEntries(tests *testing.T) {
+	var reports []string
+	sink := &blockedSink{release: make(chan struct{})}
+	buffered := &bufferedSink{name: "blocked", sink: sink, entries: make(chan StatusRecordEntry, 1), finished: make(chan struct{}),
+		report: func(status string, contextID string, comments string) {
+			reports = append(reports, status+" "+comments)
+		}}
+	go buffered.run()
+
+	offered := make(chan struct{})
+	go func() {
+		for index := 0; index < 5; index++ {
+			buffered.offer(newStatusEntry(systemName, fileUploadOpp, uploadSuccess, "", ""))
+		}
+		close(offered)
+	}()
+	select {
+	case <-offered:
+	case <-time.After(time.Second):
+		tests.Fatal("offering entries to a slow sink waited for it")
+	}
+	close(sink.release)
+	buffered.stop()
+
+	if len(sink.written) < 1 || len(sink.written) > 2 || len(reports) != 1 || !strings.HasPrefix(reports[0], droppedStatus) {
+		tests.Fatal("dropped entries not reported ", len(sink.written), reports)
+	}
+}
+
+func TestSocketSinks(tests *testing.T) {
+	if runtime.GOOS == "windows" {
+		tests.Skip("local datagram sockets are not available")
+	}
+	directory, err := ioutil.TempDir("", "TestSocketSinks")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	address := filepath.Join(directory, "socket")
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: address, Net: "unixgram"})
+	if err != nil {
+		tests.Fatal(err)
+	}
+	defer listener.Close()
+
+	entry := newStatusEntry(systemName, fileUploadOpp, failedStatus, "abc~/in/a.zip", "first\nsecond")
+	buffer := make([]byte, 4096)
+	syslog := newStatusSink(StatusSinkConfig{Type: "syslog", Address: address})
+	err = syslog.write(entry)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	size, err := listener.Read(buffer)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	if message := string(buffer[:size]); !strings.HasPrefix(message, "<27>") || !strings.Contains(message, "abc~/in/a.zip") {
+		tests.Fatal("syslog message not written ", message)
+	}
+	syslog.close()
+
+	journald := newStatusSink(StatusSinkConfig{Type: "journald", Address: address, Format: "jsonl"})
+	err = journald.write(entry)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	size, err = listener.Read(buffer)
+	if err != nil {
+		tests.Fatal(err)
+	}
+	message := string(buffer[:size])
+	if !strings.Contains(message, "PRIORITY=3\n") || !strings.Contains(message, "TRUECONNECT_STATUS=Failed\n") ||
+		!strings.HasPrefix(message, `MESSAGE={"schema":1,`) {
+		tests.Fatal("journald message not written ", message)
+	}
+	journald.close()
+}
+
+func TestValidateStatusSinks(tests *testing.T) {
+	for _, config := range []StatusSinkConfig{
+		{Type: "file"},
+		{Type: "kafka"},
+		{Type: "stdout", Format: "xml"},
+		{Type: "stdout", MinSeverity: "loud"},
+		{Type: "syslog", Buffer: -1},
+	} {
+		if config.validate() == nil {
+			tests.Fatal("invalid sink accepted ", config)
+		}
+	}
+	if err := (StatusSinkConfig{Type: "journald", MinSeverity: "Warning"}).validate(); err != nil {
+		tests.Fatal(err)
+	}
+}
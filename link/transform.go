@@ -0,0 +1,169 @@
+package link
+
+import (
+	"fmt"
+	"github.com/GeneralElectric/TrueConnect-Link/trueconnect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Types of TransformStep
+const (
+	transformDate    = "date"
+	transformUpper   = "upper"
+	transformLower   = "lower"
+	transformTrim    = "trim"
+	transformReplace = "replace"
+	transformLookup  = "lookup"
+)
+
+// the status recorded for each metadata value that could not be transformed when its file is uploaded
+const warningStatus = "Warning"
+
+// metadata set by the client itself that cannot be the target of a mapping
+var reservedMetadata = map[string]struct{}{
+	trueconnect.TenantID:         {},
+	trueconnect.DataType:         {},
+	trueconnect.FileFormat:       {},
+	trueconnect.OriginalFileName: {},
+	sourceHost:                   {},
+	fileSize:                     {},
+	lastModifiedDate:             {},
+	sha256Hash:                   {},
+	supersedesTag:                {},
+	versionTag:                   {},
+}
+
+// dropReserved removes the values whose tags are reserved metadata, so values read from a file cannot replace the
+// metadata set by the client, and gives the tags removed
+func dropReserved(values map[string]string) []string {
+	var dropped []string
+	for tag := range values {
+		if _, reserved := reservedMetadata[tag]; reserved {
+			dropped = append(dropped, tag)
+			delete(values, tag)
+		}
+	}
+	sort.Strings(dropped)
+	return dropped
+}
+
+type compiledTransform struct {
+	tag   string
+	steps []transformFunc
+	mapTo []string
+}
+
+type transformFunc func(value string) (string, error)
+
+func compileTransform(transform TagTransform) (compiledTransform, error) {
+	compiled := compiledTransform{tag: transform.Tag, mapTo: transform.MapTo}
+	for _, key := range transform.MapTo {
+		if _, reserved := reservedMetadata[key]; reserved {
+			return compiled, fmt.Errorf("cannot map a value onto %s", key)
+		}
+	}
+
+	for _, step := range transform.Steps {
+		function, err := compileStep(step)
+		if err != nil {
+			return compiled, err
+		}
+		compiled.steps = append(compiled.steps, function)
+	}
+	return compiled, nil
+}
+
+func compileStep(step TransformStep) (transformFunc, error) {
+	switch strings.ToLower(step.Type) {
+	case transformDate:
+		if step.Layout == "" {
+			return nil, fmt.Errorf("a date transform needs a layout")
+		}
+		location := time.UTC
+		if step.Timezone != "" {
+			var err error
+			location, err = time.LoadLocation(step.Timezone)
+			if err != nil {
+				return nil, err
+			}
+		}
+		layout := step.Layout
+		return func(value string) (string, error) {
+			date, err := time.ParseInLocation(layout, value, location)
+			if err != nil {
+				return value, err
+			}
+			return date.UTC().Format(time.RFC3339), nil
+		}, nil
+	case transformUpper:
+		return func(value string) (string, error) { return strings.ToUpper(value), nil }, nil
+	case transformLower:
+		return func(value string) (string, error) { return strings.ToLower(value), nil }, nil
+	case transformTrim:
+		cutset := step.Cutset
+		return func(value string) (string, error) {
+			if cutset == "" {
+				return strings.TrimSpace(value), nil
+			}
+			return strings.Trim(value, cutset), nil
+		}, nil
+	case transformReplace:
+		regex, err := regexp.Compile(step.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		replacement := step.Replacement
+		return func(value string) (string, error) { return regex.ReplaceAllString(value, replacement), nil }, nil
+	case transformLookup:
+		table := step.Table
+		defaultValue := step.Default
+		return func(value string) (string, error) {
+			if replacement, exists := table[value]; exists {
+				return replacement, nil
+			}
+			if defaultValue != "" {
+				return defaultValue, nil
+			}
+			return value, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unrecognised transform type %q", step.Type)
+}
+
+// transformMetadata applies the configured transforms to the extracted metadata values and copies the results to any
+// mapped tags. A value that cannot be transformed is left as it was found and is not mapped, the errors for these
+// values are returned
+func (target *Target) transformMetadata(values map[string]string) []error {
+	if target.compiled == nil && target.compile() != nil {
+		return nil
+	}
+
+	var errs []error
+	for _, transform := range target.compiled.transforms {
+		value, exists := values[transform.tag]
+		if !exists {
+			continue
+		}
+
+		var err error
+		for _, step := range transform.steps {
+			value, err = step(value)
+			if err != nil {
+				break
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf(errInvalidTag, target.Name, transform.tag, err))
+			continue
+		}
+
+		values[transform.tag] = value
+		for _, key := range transform.mapTo {
+			values[key] = value
+		}
+	}
+	return errs
+}
@@ -0,0 +1,144 @@
+package link
+
+import (
+	"context"
+	"github.com/GeneralElectric/TrueConnect-Link/trueconnect"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDateTransformMapsToStandardKeys(tests *testing.T) {
+	target := Target{
+		PathPattern: `(?P<FlightDate>\d{8}-\d{6})\.FFD$`,
+		Transforms: []TagTransform{
+			{
+				Tag:   "FlightDate",
+				Steps: []TransformStep{{Type: "date", Layout: "20060102-150405", Timezone: "Europe/Paris"}},
+				MapTo: []string{trueconnect.DataStartDate, trueconnect.DataEndDate},
+			},
+		},
+	}
+
+	foundFile := foundFile{uri: "/data/20170412-101500.FFD", target: &target}
+	metadata := foundFile.getMetadata()
+	if metadata["FlightDate"].Value != "2017-04-12T08:15:00Z" {
+		tests.Fatal(metadata["FlightDate"].Value + ": date not transformed to RFC3339")
+	}
+	if metadata[trueconnect.DataStartDate].Value != "2017-04-12T08:15:00Z" {
+		tests.Fatal("transformed value not mapped to data_start_date")
+	}
+	if metadata[trueconnect.DataEndDate].Value != "2017-04-12T08:15:00Z" {
+		tests.Fatal("transformed value not mapped to data_end_date")
+	}
+}
+
+func TestTransformPipeline(tests *testing.T) {
+	target := Target{
+		Transforms: []TagTransform{
+			{Tag: "TailNo", Steps: []TransformStep{
+				{Type: "trim", Cutset: "_"},
+				{Type: "upper"},
+				{Type: "replace", Pattern: `^F(\w+)$`, Replacement: "F-$1"},
+			}},
+			{Tag: "Airline", Steps: []TransformStep{
+				{Type: "lower"},
+				{Type: "lookup", Table: map[string]string{"af": "Air France"}, Default: "Unknown"},
+			}},
+			{Tag: "Station", Steps: []TransformStep{
+				{Type: "trim"},
+				{Type: "lookup", Table: map[string]string{"CDG": "Paris"}},
+			}},
+		},
+	}
+
+	values := map[string]string{"TailNo": "fgzca__", "Airline": "AF", "Station": " ORY "}
+	if errs := target.transformMetadata(values); len(errs) != 0 {
+		tests.Fatal(errs)
+	}
+	if values["TailNo"] != "F-GZCA" {
+		tests.Fatal(values["TailNo"] + ": trim, upper and replace not applied")
+	}
+	if values["Airline"] != "Air France" {
+		tests.Fatal(values["Airline"] + ": lookup not applied")
+	}
+	if values["Station"] != "ORY" {
+		tests.Fatal(values["Station"] + ": lookup without default changed value")
+	}
+}
+
+func TestFailedTransformLeavesValue(tests *testing.T) {
+	target := Target{
+		Transforms: []TagTransform{
+			{
+				Tag:   "FlightDate",
+				Steps: []TransformStep{{Type: "date", Layout: "20060102-150405"}},
+				MapTo: []string{trueconnect.DataStartDate},
+			},
+		},
+	}
+
+	values := map[string]string{"FlightDate": "not a date"}
+	if errs := target.transformMetadata(values); len(errs) != 1 {
+		tests.Fatal("expected an error from invalid date")
+	}
+	if values["FlightDate"] != "not a date" {
+		tests.Fatal("value changed by failed transform")
+	}
+	if _, exists := values[trueconnect.DataStartDate]; exists {
+		tests.Fatal("value mapped from failed transform")
+	}
+}
+
+func TestInvalidTransformsRejected(tests *testing.T) {
+	invalid := []TagTransform{
+		{Tag: "a", Steps: []TransformStep{{Type: "reverse"}}},
+		{Tag: "a", Steps: []TransformStep{{Type: "date"}}},
+		{Tag: "a", Steps: []TransformStep{{Type: "date", Layout: "2006", Timezone: "Nowhere/Special"}}},
+		{Tag: "a", Steps: []TransformStep{{Type: "replace", Pattern: "("}}},
+		{Tag: "a", MapTo: []string{trueconnect.TenantID}},
+	}
+	for _, transform := range invalid {
+		target := Target{Transforms: []TagTransform{transform}}
+		if target.compile() == nil {
+			tests.Fatal("invalid transform accepted ", transform)
+		}
+	}
+}
+
+func TestTransformErrorRecorded(tests *testing.T) {
+	defer os.Remove("TestTransformErrorRecorded.csv")
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	recorder, err := createFileStatusRecorder(currentContext, "TestTransformErrorRecorded.csv")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	recorder.configure(StatusLogConfig{Sync: "always"}, nil)
+	client := linkClient{currentContext: currentContext, statusRecorder: recorder}
+	target := Target{
+		PathPattern: `(?P<FlightDate>\d{8}-\d{6})\.FFD$`,
+		Transforms:  []TagTransform{{Tag: "FlightDate", Steps: []TransformStep{{Type: "date", Layout: "2006-01-02"}}}},
+	}
+	found := foundFile{uri: "/data/20170412-101500.FFD", hash: "abc", target: &target}
+	if metadata := client.uploadMetadata(found); metadata["FlightDate"].Value != "20170412-101500" {
+		tests.Fatal("value that could not be transformed not uploaded as found ", metadata["FlightDate"].Value)
+	}
+	cancelFunction()
+	time.Sleep(time.Millisecond * 200)
+
+	var warnings []StatusRecordEntry
+	_, err = readStatusLog("TestTransformErrorRecorded.csv", func(entry StatusRecordEntry) bool {
+		if entry.Operation == fileUploadOpp && entry.Status == warningStatus {
+			warnings = append(warnings, entry)
+		}
+		return true
+	})
+	if err != nil {
+		tests.Fatal(err)
+	}
+	if len(warnings) != 1 || warnings[0].ContextID != client.configuration.uid(found) ||
+		!strings.HasPrefix(warnings[0].Comments, "/data/20170412-101500.FFD: ") {
+		tests.Fatal("transform error not recorded ", warnings)
+	}
+}
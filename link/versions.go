@@ -0,0 +1,103 @@
+package link
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Actions taken when a file is found with different content to the last version uploaded from its path, the operation
+// used to record versions and the metadata added to a new version
+const (
+	onChangeReupload = "reupload"
+	onChangeIgnore   = "ignore"
+	onChangeAppend   = "append"
+	versionOperation = "FileVersion"
+	supersedesTag    = "supersedes"
+	versionTag       = "version"
+)
+
+// fileVersion describes the last content uploaded from a path
+type fileVersion struct {
+	Path    string `json:"path"`
+	Hash    string `json:"hash"`
+	Ref     string `json:"ref"`
+	Version int    `json:"version"`
+	Size    int64  `json:"size"`
+}
+
+func validateOnChange(onChange string) error {
+	switch strings.ToLower(onChange) {
+	case "", onChangeReupload, onChangeIgnore, onChangeAppend:
+		return nil
+	}
+	return fmt.Errorf("unrecognised changed file action %q", onChange)
+}
+
+func (recorder *fileTransferRecorder) lastVersion(path string) (fileVersion, bool) {
+	return recorder.store.version(path)
+}
+
+func (recorder *fileTransferRecorder) recordVersion(version fileVersion) error {
+	return recorder.store.putVersion(version)
+}
+
+// checkVersion compares the found file with the last version uploaded from its path, false is returned when the file
+// has changed and the target is set not to upload the change
+func (linkClient *linkClient) checkVersion(foundFile *foundFile, uid string) bool {
+	previous, exists := linkClient.fileTransferRecorder.lastVersion(foundFile.uri)
+	if !exists || previous.Hash == foundFile.hash {
+		return true
+	}
+
+	switch strings.ToLower(foundFile.target.OnChange) {
+	case onChangeIgnore:
+		linkClient.statusRecorder.recordStatus(systemName, fileUploadOpp, skippedStatus, uid, foundFile.uri+" changed since "+previous.Ref)
+		return false
+	case onChangeAppend:
+		appended, err := isAppended(foundFile.uri, previous)
+		if err != nil || !appended {
+			linkClient.statusRecorder.recordStatus(systemName, fileUploadOpp, skippedStatus, uid, foundFile.uri+" changed other than by appending since "+previous.Ref)
+			return false
+		}
+	}
+	foundFile.previous = &previous
+	return true
+}
+
+// recordVersion records the uploaded file as the latest version uploaded from its path
+func (linkClient *linkClient) recordVersion(foundFile foundFile, uid string) {
+	version := fileVersion{Path: foundFile.uri, Hash: foundFile.hash, Ref: foundFile.progress.Reference, Version: 1, Size: foundFile.size}
+	if foundFile.previous != nil {
+		version.Version = foundFile.previous.Version + 1
+	}
+	linkClient.recordStateError(uid, linkClient.fileTransferRecorder.recordVersion(version))
+	data, _ := json.Marshal(version)
+	linkClient.statusRecorder.recordStatus(systemName, versionOperation, uploadSuccess, uid, string(data))
+}
+
+// isAppended returns true when the file starts with the previous version, so it has only been added to
+func isAppended(filePath string, previous fileVersion) (bool, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if info.Size() < previous.Size {
+		return false, nil
+	}
+
+	hash := sha256.New()
+	_, err = io.CopyN(hash, file, previous.Size)
+	if err != nil {
+		return false, err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)) == previous.Hash, nil
+}
@@ -0,0 +1,78 @@
+package link
+
+import (
+	"context"
+	"github.com/GeneralElectric/TrueConnect-Link/trueconnect"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestChangedFileVersions(tests *testing.T) {
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+	client := linkClient{currentContext: currentContext, statusRecorder: createStatusRecorder(currentContext), fileTransferRecorder: createFileTransferRecorder()}
+	target := Target{}
+
+	first := foundFile{uri: "/in/file.zip", hash: "deadface", size: 10, target: &target, progress: trueconnect.UploadProgress{Complete: true, Reference: "ref1"}}
+	if !client.checkVersion(&first, "uid1") || first.previous != nil {
+		tests.Fatal("first version treated as a change")
+	}
+	client.recordVersion(first, "uid1")
+
+	changed := foundFile{uri: "/in/file.zip", hash: "beefcafe", size: 12, target: &target}
+	if !client.checkVersion(&changed, "uid2") || changed.previous == nil {
+		tests.Fatal("changed file not detected")
+	}
+	metadata := changed.getMetadata()
+	if metadata[supersedesTag].Value != "ref1" || metadata[versionTag].Value != "2" {
+		tests.Fatal("new version metadata not as expected ", metadata)
+	}
+	changed.progress = trueconnect.UploadProgress{Complete: true, Reference: "ref2"}
+	client.recordVersion(changed, "uid2")
+	if version, _ := client.fileTransferRecorder.lastVersion("/in/file.zip"); version.Version != 2 || version.Ref != "ref2" {
+		tests.Fatal("new version not recorded ", version)
+	}
+
+	target.OnChange = "ignore"
+	ignored := foundFile{uri: "/in/file.zip", hash: "cafebabe", target: &target}
+	if client.checkVersion(&ignored, "uid3") {
+		tests.Fatal("changed file not ignored")
+	}
+}
+
+func TestAppendedFileVersions(tests *testing.T) {
+	testfile, err := CreateTestFile("./TestAppendedFileVersions/log.txt")
+	if err != nil {
+		tests.Fatal(err)
+	}
+	defer os.RemoveAll("./TestAppendedFileVersions")
+	if err = ioutil.WriteFile(testfile, []byte("line 1\n"), 0644); err != nil {
+		tests.Fatal(err)
+	}
+	hash, _ := computeSHA256Hash(testfile)
+	previous := fileVersion{Path: testfile, Hash: hash, Ref: "ref1", Version: 1, Size: 7}
+
+	if err = ioutil.WriteFile(testfile, []byte("line 1\nline 2\n"), 0644); err != nil {
+		tests.Fatal(err)
+	}
+	if appended, err := isAppended(testfile, previous); err != nil || !appended {
+		tests.Fatal("appended file not recognised ", err)
+	}
+
+	if err = ioutil.WriteFile(testfile, []byte("line 0\nline 2\n"), 0644); err != nil {
+		tests.Fatal(err)
+	}
+	if appended, _ := isAppended(testfile, previous); appended {
+		tests.Fatal("rewritten file treated as appended")
+	}
+
+	currentContext, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+	client := linkClient{currentContext: currentContext, statusRecorder: createStatusRecorder(currentContext), fileTransferRecorder: createFileTransferRecorder()}
+	client.fileTransferRecorder.recordVersion(previous)
+	rewritten := foundFile{uri: testfile, hash: "changed", target: &Target{OnChange: "append"}}
+	if client.checkVersion(&rewritten, "uid") {
+		tests.Fatal("rewritten file uploaded when only appends are")
+	}
+}
@@ -0,0 +1,352 @@
+package link
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The operation recorded when webhooks are sent, the headers sent with each payload and how long to wait before trying
+// a payload again, the wait doubles after each failed attempt up to webhookRetryMax
+const (
+	webhookOperation       = "Webhook"
+	webhookSignatureHeader = "X-Link-Signature"
+	webhookTimestampHeader = "X-Link-Timestamp"
+	webhookEventHeader     = "X-Link-Event"
+	webhookDeliveryHeader  = "X-Link-Delivery"
+	defaultWebhookTimeout  = 10
+	webhookRetryBase       = 5 * time.Second
+	webhookRetryMax        = time.Hour
+	webhookIDLayout        = "20060102T150405.000000000Z"
+)
+
+// the status each event is sent to webhooks as
+var webhookStatuses = map[string]string{
+	eventSuccess:       uploadSuccess,
+	eventFailure:       failedStatus,
+	eventPartial:       partialStatus,
+	eventAbandoned:     abandonedStatus,
+	eventCycleComplete: statSearchComplete,
+}
+
+// webhookPayload is the JSON posted to a webhook
+type webhookPayload struct {
+	ID           string            `json:"id"`
+	Event        string            `json:"event"`
+	Time         time.Time         `json:"time"`
+	ClientID     string            `json:"client_id"`
+	Target       string            `json:"target"`
+	Tenant       string            `json:"tenant"`
+	Path         string            `json:"path,omitempty"`
+	DataStoreRef string            `json:"data_store_ref,omitempty"`
+	Error        string            `json:"error,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// webhookDelivery is a payload waiting in the outbox to be sent to a webhook. The ID starts with the time it was queued
+// so the outbox is sent oldest first
+type webhookDelivery struct {
+	ID          string          `json:"id"`
+	URL         string          `json:"url"`
+	Record      string          `json:"record,omitempty"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"nextattempt"`
+}
+
+// webhookSender queues payloads in the outbox and sends them, a payload is sent at least once so endpoints should use
+// its ID to recognise one they have already had
+type webhookSender struct {
+	clientID string
+	webhooks []WebhookConfig
+	store    stateStore
+	record   func(status string, contextID string, comments string)
+	wake     chan struct{}
+	// only one pass over the outbox is made at a time
+	sending sync.Mutex
+	// the webhooks whose last delivery failed, a delivery that succeeds after a failure is recorded as a recovery
+	failing map[string]bool
+}
+
+func (webhook *WebhookConfig) validate() error {
+	address, err := url.Parse(webhook.URL)
+	if err != nil || (address.Scheme != "http" && address.Scheme != "https") || address.Host == "" {
+		return fmt.Errorf("the webhook URL %q is not an http or https URL", webhook.URL)
+	}
+	for _, event := range webhook.Events {
+		if webhookEvent(event) == "" {
+			return fmt.Errorf("unrecognised webhook event %q, use Success, Failed, Partial, Abandoned or SearchComplete", event)
+		}
+	}
+	if webhook.Timeout < 0 || webhook.MaxAttempts < 0 {
+		return fmt.Errorf("the timeout and maximum attempts of the webhook %s cannot be negative", webhook.URL)
+	}
+	return nil
+}
+
+// webhookEvent gives the event sent as the status, ignoring case, or nothing when the status is not sent to webhooks
+func webhookEvent(status string) string {
+	for event, eventStatus := range webhookStatuses {
+		if strings.EqualFold(eventStatus, status) {
+			return event
+		}
+	}
+	return ""
+}
+
+// wants returns true when the webhook is sent the event of the target
+func (webhook *WebhookConfig) wants(event string, target string) bool {
+	if _, exists := webhookStatuses[event]; !exists {
+		return false
+	}
+	if len(webhook.Events) > 0 && !selected(webhook.Events, webhookStatuses[event]) {
+		return false
+	}
+	return selected(webhook.Targets, target)
+}
+
+func newWebhookSender(clientID string, webhooks []WebhookConfig, store stateStore, record func(status string, contextID string, comments string)) *webhookSender {
+	return &webhookSender{clientID: clientID, webhooks: webhooks, store: store, record: record, wake: make(chan struct{}, 1),
+		failing: make(map[string]bool)}
+}
+
+// startWebhooks sends the payloads in the outbox in the background until the client stops, including those left by an
+// earlier run
+func (linkClient *linkClient) startWebhooks() {
+	if len(linkClient.configuration.Webhooks) == 0 {
+		return
+	}
+	store := linkClient.fileTransferRecorder.store
+	if store == nil {
+		store = newMemoryStateStore()
+	}
+	linkClient.webhooks = newWebhookSender(linkClient.configuration.ClientID, linkClient.configuration.Webhooks, store,
+		func(status string, contextID string, comments string) {
+			linkClient.statusRecorder.recordStatus(systemName, webhookOperation, status, contextID, comments)
+		})
+	go linkClient.webhooks.run(linkClient.currentContext)
+}
+
+// queue adds a payload for each webhook that wants the event to the outbox, it is safe to call on a nil sender
+func (sender *webhookSender) queue(event linkEvent, record string) {
+	if sender == nil {
+		return
+	}
+	queued := false
+	for _, webhook := range sender.webhooks {
+		if !webhook.wants(event.Event, event.Target) {
+			continue
+		}
+		id := time.Now().UTC().Format(webhookIDLayout) + "-" + uuid.New().String()
+		payload, err := json.Marshal(webhookPayload{
+			ID:           id,
+			Event:        webhookStatuses[event.Event],
+			Time:         event.Time,
+			ClientID:     sender.clientID,
+			Target:       event.Target,
+			Tenant:       event.Tenant,
+			Path:         event.File,
+			DataStoreRef: event.StorageRef,
+			Error:        event.Error,
+			Metadata:     event.Metadata,
+		})
+		if err == nil {
+			err = sender.store.putDelivery(webhookDelivery{ID: id, URL: webhook.URL, Record: record, Payload: payload})
+		}
+		if err != nil {
+			sender.record(failedStatus, record, "the "+event.Event+" event was not queued for "+webhook.URL+": "+err.Error())
+			continue
+		}
+		queued = true
+	}
+	if queued {
+		select {
+		case sender.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// wants returns true when any webhook is sent the event of the target, it is safe to call on a nil sender
+func (sender *webhookSender) wants(event string, target string) bool {
+	if sender == nil {
+		return false
+	}
+	for _, webhook := range sender.webhooks {
+		if webhook.wants(event, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// run sends the payloads as they are queued and tries those that failed again when they are due
+func (sender *webhookSender) run(ctx context.Context) {
+	for {
+		next := sender.send(ctx)
+		wait := webhookRetryMax
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-sender.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// flush makes a last attempt to send the payloads that are due before the client stops, those that cannot be sent stay
+// in the outbox for the next run. It is safe to call on a nil sender
+func (sender *webhookSender) flush() {
+	if sender == nil {
+		return
+	}
+	sender.send(context.Background())
+}
+
+// send makes one pass over the outbox sending the payloads that are due, it gives when the next payload left is due or
+// the zero time when none are left. Once sending to a webhook fails the rest of its payloads wait until the next pass
+func (sender *webhookSender) send(ctx context.Context) time.Time {
+	sender.sending.Lock()
+	defer sender.sending.Unlock()
+
+	var deliveries []webhookDelivery
+	sender.store.forEachDelivery(func(delivery webhookDelivery) error {
+		deliveries = append(deliveries, delivery)
+		return nil
+	})
+
+	var next time.Time
+	unreachable := make(map[string]bool)
+	for _, delivery := range deliveries {
+		if ctx.Err() != nil {
+			return next
+		}
+		webhook, configured := sender.webhook(delivery.URL)
+		if !configured {
+			// the webhook has been removed from the configuration
+			sender.store.deleteDelivery(delivery.ID)
+			continue
+		}
+		now := time.Now().UTC()
+		if unreachable[delivery.URL] || delivery.NextAttempt.After(now) {
+			if next.IsZero() || delivery.NextAttempt.Before(next) {
+				next = delivery.NextAttempt
+			}
+			continue
+		}
+
+		err := postWebhook(ctx, webhook, delivery)
+		if err == nil {
+			sender.store.deleteDelivery(delivery.ID)
+			if sender.failing[delivery.URL] {
+				delete(sender.failing, delivery.URL)
+				sender.record(recoveredStatus, delivery.Record, delivery.ID+" sent to "+delivery.URL+" after failing")
+			}
+			continue
+		}
+		unreachable[delivery.URL] = true
+		sender.failing[delivery.URL] = true
+		delivery.Attempts++
+		comments := fmt.Sprintf("%s to %s attempt %d: %v", delivery.ID, delivery.URL, delivery.Attempts, err)
+		if webhook.MaxAttempts > 0 && delivery.Attempts >= webhook.MaxAttempts {
+			sender.store.deleteDelivery(delivery.ID)
+			sender.record(abandonedStatus, delivery.Record, comments)
+			continue
+		}
+		delivery.NextAttempt = now.Add(webhookBackoff(delivery.Attempts))
+		sender.store.putDelivery(delivery)
+		sender.record(failedStatus, delivery.Record, comments)
+		if next.IsZero() || delivery.NextAttempt.Before(next) {
+			next = delivery.NextAttempt
+		}
+	}
+	return next
+}
+
+func (sender *webhookSender) webhook(address string) (WebhookConfig, bool) {
+	for _, webhook := range sender.webhooks {
+		if webhook.URL == address {
+			return webhook, true
+		}
+	}
+	return WebhookConfig{}, false
+}
+
+// webhookBackoff gives how long to wait before trying a payload again after the number of failed attempts
+func webhookBackoff(attempts int) time.Duration {
+	wait := webhookRetryBase
+	for attempt := 1; attempt < attempts && wait < webhookRetryMax; attempt++ {
+		wait *= 2
+	}
+	if wait > webhookRetryMax {
+		wait = webhookRetryMax
+	}
+	return wait
+}
+
+// signPayload gives the HMAC-SHA256 signature sent in the X-Link-Signature header, it covers the timestamp sent in the
+// X-Link-Timestamp header as well as the payload so that a delivery cannot be replayed later
+func signPayload(secret string, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook posts the payload to the webhook, any response other than 2xx is a failure
+func postWebhook(ctx context.Context, webhook WebhookConfig, delivery webhookDelivery) error {
+	timeout := webhook.Timeout
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+	timeoutContext, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	request, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(timeoutContext)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", systemName)
+	var payload webhookPayload
+	if json.Unmarshal(delivery.Payload, &payload) == nil {
+		request.Header.Set(webhookEventHeader, payload.Event)
+	}
+	request.Header.Set(webhookDeliveryHeader, delivery.ID)
+	for name, value := range webhook.Headers {
+		request.Header.Set(name, value)
+	}
+	if webhook.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		request.Header.Set(webhookTimestampHeader, timestamp)
+		request.Header.Set(webhookSignatureHeader, signPayload(webhook.Secret, timestamp, delivery.Payload))
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("the webhook responded %s", response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package link
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookDelivery(tests *testing.T) {
+	var mutex sync.Mutex
+	var received []webhookPayload
+	var signatures []string
+	failNext := true
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if failNext {
+			failNext = false
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(request.Body)
+		var payload webhookPayload
+		json.Unmarshal(body, &payload)
+		received = append(received, payload)
+		signatures = append(signatures, request.Header.Get(webhookSignatureHeader))
+		timestamp, _ := strconv.ParseInt(request.Header.Get(webhookTimestampHeader), 10, 64)
+		if request.Header.Get(webhookSignatureHeader) != signPayload("secret1", request.Header.Get(webhookTimestampHeader), body) ||
+			time.Since(time.Unix(timestamp, 0)) > time.Minute || request.Header.Get("Authorization") != "Bearer abc" {
+			writer.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	store := newMemoryStateStore()
+	var statuses []string
+	sender := newWebhookSender("User1", []WebhookConfig{
+		{URL: server.URL, Events: []string{"success", "Abandoned"}, Secret: "secret1", Headers: map[string]string{"Authorization": "Bearer abc"}},
+	}, store, func(status string, contextID string, comments string) {
+		statuses = append(statuses, status)
+	})
+
+	target := &Target{Name: "Data", Tenant: "tenant1"}
+	file := foundFile{uri: "/in/a.zip", target: target}
+	file.progress.Reference = "ref1"
+	if !sender.wants(eventSuccess, "Data") || sender.wants(eventFailure, "Data") {
+		tests.Fatal("webhook events not filtered")
+	}
+	sender.queue(newFileEvent(eventSuccess, file, nil), "abc~/in/a.zip")
+	sender.queue(newFileEvent(eventFailure, file, nil), "abc~/in/a.zip")
+
+	next := sender.send(context.Background())
+	if next.IsZero() || len(received) != 0 || len(statuses) != 1 || statuses[0] != failedStatus {
+		tests.Fatal("failed delivery not kept for a retry ", next, statuses)
+	}
+	var waiting []webhookDelivery
+	store.forEachDelivery(func(delivery webhookDelivery) error {
+		waiting = append(waiting, delivery)
+		return nil
+	})
+	if len(waiting) != 1 || waiting[0].Attempts != 1 || waiting[0].NextAttempt.Sub(time.Now()) > webhookRetryBase {
+		tests.Fatal("the outbox does not hold the delivery to retry ", waiting)
+	}
+
+	// a delivery that is not yet due is not sent
+	sender.send(context.Background())
+	if len(received) != 0 {
+		tests.Fatal("delivery sent before it was due")
+	}
+	waiting[0].NextAttempt = time.Now().Add(-time.Second)
+	store.putDelivery(waiting[0])
+	next = sender.send(context.Background())
+	if !next.IsZero() || len(received) != 1 || len(statuses) != 2 || statuses[1] != recoveredStatus {
+		tests.Fatal("delivery not retried ", next, received, statuses)
+	}
+	payload := received[0]
+	if payload.Event != uploadSuccess || payload.Path != "/in/a.zip" || payload.DataStoreRef != "ref1" ||
+		payload.Target != "Data" || payload.Tenant != "tenant1" || payload.ClientID != "User1" || payload.ID != waiting[0].ID {
+		tests.Fatal("wrong payload ", payload)
+	}
+
+	// deliveries are only recorded when they fail or recover
+	sender.queue(newFileEvent(eventSuccess, file, nil), "abc~/in/a.zip")
+	sender.send(context.Background())
+	if len(received) != 2 || len(statuses) != 2 {
+		tests.Fatal("successful delivery recorded ", received, statuses)
+	}
+}
+
+func TestWebhookAbandoned(tests *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	store := newMemoryStateStore()
+	var statuses []string
+	sender := newWebhookSender("User1", []WebhookConfig{{URL: server.URL, MaxAttempts: 1}}, store,
+		func(status string, contextID string, comments string) {
+			statuses = append(statuses, status)
+		})
+	sender.queue(newTargetEvent(eventCycleComplete, &Target{Name: "Data"}), "")
+	sender.queue(newTargetEvent(eventStart, &Target{Name: "Data"}), "")
+	sender.send(context.Background())
+
+	left := 0
+	store.forEachDelivery(func(webhookDelivery) error {
+		left++
+		return nil
+	})
+	if left != 0 || len(statuses) != 1 || statuses[0] != abandonedStatus {
+		tests.Fatal("delivery not given up after its maximum attempts ", left, statuses)
+	}
+}
+
+func TestWebhookBackoff(tests *testing.T) {
+	if webhookBackoff(1) != webhookRetryBase || webhookBackoff(3) != 4*webhookRetryBase || webhookBackoff(100) != webhookRetryMax {
+		tests.Fatal("wrong backoff ", webhookBackoff(1), webhookBackoff(3), webhookBackoff(100))
+	}
+}
+
+func TestValidateWebhooks(tests *testing.T) {
+	for _, webhook := range []WebhookConfig{
+		{URL: "ftp://example.com/hook"},
+		{URL: "not a url"},
+		{URL: "https://example.com/hook", Events: []string{"Started"}},
+		{URL: "https://example.com/hook", Timeout: -1},
+	} {
+		if webhook.validate() == nil {
+			tests.Fatal("invalid webhook accepted ", webhook)
+		}
+	}
+	webhook := WebhookConfig{URL: "https://example.com/hook", Events: []string{"SearchComplete", "failed"}}
+	if err := webhook.validate(); err != nil {
+		tests.Fatal(err)
+	}
+}
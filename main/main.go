@@ -13,6 +13,7 @@ func main() {
 	killableContext := watchForKill(currentContext)
 	client, err := link.NewClient(killableContext, os.Args)
 	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
@@ -7,6 +7,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/clientcredentials"
 	"io"
 	"io/ioutil"
@@ -15,6 +16,7 @@ import (
 	"net/textproto"
 	"os"
 	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -149,7 +151,25 @@ func (wrapper *Wrapper) getHTTPClient(ctx context.Context) *http.Client {
 		ClientID:     wrapper.ClientID,
 		ClientSecret: wrapper.Secret,
 	}
-	return creds.Client(ctx)
+	return oauth2.NewClient(ctx, oauth2.ReuseTokenSource(nil, countingTokenSource{creds.TokenSource(ctx)}))
+}
+
+// the number of tokens requested from the token URL by uploads
+var tokenRequests int64
+
+// TokenRequests gives the number of tokens requested from the token URL by uploads since the process started
+func TokenRequests() int64 {
+	return atomic.LoadInt64(&tokenRequests)
+}
+
+// countingTokenSource counts the tokens requested, it is wrapped so that only tokens that are not reused are counted
+type countingTokenSource struct {
+	source oauth2.TokenSource
+}
+
+func (counting countingTokenSource) Token() (*oauth2.Token, error) {
+	atomic.AddInt64(&tokenRequests, 1)
+	return counting.source.Token()
 }
 
 func (wrapper *Wrapper) uploadInOne(ctx context.Context, filenamePath string, meta map[string]MetadataValue, size int64) (progress UploadProgress, err error) {
@@ -460,7 +480,17 @@ func (wrapper *Wrapper) completeUpload(ctx context.Context, progress UploadProgr
 	return progress, nil
 }
 
+// progressKey is the key of the context value WithProgress sets
+type progressKey struct{}
+
+// WithProgress gives a context that has uploads made with it call report with the number of bytes of the file each
+// time more of it is sent
+func WithProgress(ctx context.Context, report func(sent int64)) context.Context {
+	return context.WithValue(ctx, progressKey{}, report)
+}
+
 func copyBufferWithCTX(ctx context.Context, dst io.Writer, src io.Reader, chunkSize int64) (hash string, err error) {
+	report, _ := ctx.Value(progressKey{}).(func(sent int64))
 	md5er := md5.New() // #nosec
 	var written int64
 	teeReader := io.TeeReader(src, md5er)
@@ -504,6 +534,9 @@ func copyBufferWithCTX(ctx context.Context, dst io.Writer, src io.Reader, chunkS
 			nw, ew := dst.Write(buf[0:nr])
 			if nw > 0 {
 				written += int64(nw)
+				if report != nil {
+					report(int64(nw))
+				}
 			}
 			if ew != nil {
 				err = ew
@@ -2,6 +2,7 @@ package trueconnect
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/md5" // #nosec
 	"encoding/hex"
@@ -200,3 +201,19 @@ func TestStartPartsFORREAL(tests *testing.T) {
 		tests.Skip("uploads real file to TC")
 	}
 }
+
+func TestCopyProgress(tests *testing.T) {
+	var reported int64
+	ctx := WithProgress(context.Background(), func(sent int64) {
+		reported += sent
+	})
+	source := make([]byte, copyBufferSize*2+10)
+	var destination bytes.Buffer
+	_, err := copyBufferWithCTX(ctx, &destination, bytes.NewReader(source), int64(len(source)))
+	if err != nil && err != io.EOF {
+		tests.Fatal(err)
+	}
+	if reported != int64(len(source)) || destination.Len() != len(source) {
+		tests.Fatal("progress not reported ", reported)
+	}
+}